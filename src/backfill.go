@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// how far back a backfill on startup looks for airings that never made it in
+var backfillWindow = 24 * time.Hour
+
+// catches up on songs missed while the app was down: whatever the station's
+// recently played list has that the history doesn't, and airings in the
+// history from the last window that never made it into the playlist. All of
+// them go through the same path as a live poll, oldest first, so the
+// playlist keeps the order they aired in. Returns how many were added.
+func backfill(client *http.Client, window time.Duration) (int, error) {
+	pending := []HistoryRecord{}
+
+	recent, recentErr := getRecentlyPlayed()
+	if recentErr != nil {
+		// the history can still be worked through
+		fmt.Println("Couldn't get recently played songs: " + recentErr.Error())
+	}
+	for _, info := range recent {
+		if info.Song_title == "" && info.Spotify == "" {
+			continue
+		}
+		record := newHistoryRecord(info, sourceBackfill)
+		if _, seen := findAiring(record.key()); !seen {
+			pending = append(pending, record)
+		}
+	}
+
+	since := clock.Now().Add(-window)
+	for _, record := range historyRecords() {
+		if record.unresolved() && record.airedAt().After(since) {
+			record.Status = ""
+			pending = append(pending, record)
+		}
+	}
+
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].airedAt().Before(pending[j].airedAt())
+	})
+
+	// the derived playlists look tracks up, which goes quicker all together
+	trackIds := []string{}
+	for _, record := range pending {
+		trackIds = append(trackIds, record.SpotifyId)
+	}
+	prefetchTracks(trackIds)
+
+	added := 0
+	for _, record := range pending {
+		if record.RecordedAt.IsZero() {
+			// undated recently played entries count as heard now
+			record.RecordedAt = clock.Now()
+		}
+		if resolveAiring(client, record).Status == statusAdded {
+			added++
+		}
+	}
+
+	if added > 0 {
+		fmt.Printf("Backfilled %d song(s)\n", added)
+	}
+	return added, recentErr
+}
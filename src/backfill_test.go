@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// minutesAgo formats a start time the way the feed does
+func minutesAgo(minutes int) string {
+	return time.Now().In(stationTimeZone).Add(-time.Duration(minutes) * time.Minute).Format("2006-01-02 15:04:05")
+}
+
+// writeHistory saves records to a history file for startSession to load
+func writeHistory(t *testing.T, records ...HistoryRecord) {
+	t.Helper()
+	historyPath = filepath.Join(t.TempDir(), "history.jsonl")
+	lines := []string{}
+	for _, record := range records {
+		line, _ := json.Marshal(record)
+		lines = append(lines, string(line))
+	}
+	if err := ioutil.WriteFile(historyPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginBackfillsMissedAiringsInAirOrder(t *testing.T) {
+	env := newTestEnv(t)
+	env.spotify.AddPlaylist("SONiC On Demand", "track1")
+	env.spotify.AddTrack("demo1", "Demo", "Local")
+
+	seen := newHistoryRecord(songAt("A - One", "track1", minutesAgo(40)), sourcePoll)
+	seen.Status = statusAdded
+	unresolved := newHistoryRecord(songAt("Local - Demo", "", minutesAgo(35)), sourcePoll)
+	unresolved.Status = statusNotOnSpotify
+	writeHistory(t, seen, unresolved)
+
+	env.station.played(
+		songAt("C - Three", "track3", minutesAgo(5)),
+		songAt("B - Two", "track2", minutesAgo(30)),
+		songAt("A - One", "track1", minutesAgo(40)),
+	)
+	env.station.play(songAt("C - Three", "track3", minutesAgo(5)), songAt("D - Four", "track4", minutesAgo(1)))
+
+	env.login(t)
+
+	want := []string{"track1", "demo1", "track2", "track3", "track4"}
+	waitFor(t, "the backfilled songs then the live one", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist("SONiC On Demand")), want)
+	})
+
+	resetHistory()
+	if err := loadHistory(); err != nil {
+		t.Fatal(err)
+	}
+	sources := map[string]string{}
+	for _, record := range historyRecords() {
+		if record.Status != statusAdded && record.Status != statusDuplicate {
+			t.Errorf("%s left %s", record.SongTitle, record.Status)
+		}
+		sources[record.SongTitle] = record.Source
+	}
+	if sources["B - Two"] != sourceBackfill || sources["D - Four"] != sourcePoll {
+		t.Errorf("history sources are %v", sources)
+	}
+}
+
+func TestBackfillLeavesOldUnresolvedAiringsAlone(t *testing.T) {
+	env := newTestEnv(t)
+	env.spotify.AddPlaylist("SONiC On Demand")
+	env.spotify.AddTrack("demo1", "Demo", "Local")
+
+	old := newHistoryRecord(songAt("Local - Demo", "", minutesAgo(3*24*60)), sourcePoll)
+	old.Status = statusNotOnSpotify
+	writeHistory(t, old)
+
+	client := spotifyClient(&oauth2.Token{AccessToken: "fake"})
+	if err := startSession(client); err != nil {
+		t.Fatal(err)
+	}
+	added, err := backfill(client, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 0 {
+		t.Errorf("backfilled %d songs from three days ago with a one day window", added)
+	}
+
+	if added, _ = backfill(client, 4*24*time.Hour); added != 1 {
+		t.Errorf("backfilled %d songs with a four day window, want 1", added)
+	}
+}
+
+func TestBackfillCommandUsesTheSavedLogin(t *testing.T) {
+	env := newTestEnv(t)
+	env.spotify.AddPlaylist("SONiC On Demand")
+	env.station.played(
+		songAt("B - Two", "track2", minutesAgo(10)),
+		songAt("A - One", "track1", minutesAgo(20)),
+	)
+
+	tokenPath = filepath.Join(t.TempDir(), "token.json")
+	if err := runCommand("backfill", nil); err == nil {
+		t.Errorf("backfill ran without a saved login")
+	}
+
+	if err := saveToken(&oauth2.Token{AccessToken: "saved", TokenType: "Bearer"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCommand("backfill", []string{"-since", "1h"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := tracksOf(env.spotify.Playlist("SONiC On Demand")); !sameTracks(got, []string{"track1", "track2"}) {
+		t.Errorf("backfill command left %v", got)
+	}
+}
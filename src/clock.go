@@ -0,0 +1,166 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is where the app gets the time and its tickers from, so a replay can
+// swap in a virtual one that runs faster than real time
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the part of time.Ticker the app uses
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+var clock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// virtualClock starts at a given time and jumps from tick to tick, waiting
+// only 1/speed of the virtual gap in real time. Time stands still between
+// ticks, so everything done for one tick sees that tick's time.
+type virtualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	speed   float64
+	tickers []*virtualTicker
+	changed chan struct{}
+	stop    chan struct{}
+}
+
+type virtualTicker struct {
+	clock   *virtualClock
+	c       chan time.Time
+	d       time.Duration
+	next    time.Time
+	stopped bool
+}
+
+func newVirtualClock(start time.Time, speed float64) *virtualClock {
+	c := &virtualClock{
+		now:     start,
+		speed:   speed,
+		changed: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *virtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *virtualClock) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	t := &virtualTicker{clock: c, c: make(chan time.Time, 1), d: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	c.mu.Unlock()
+	c.poke()
+	return t
+}
+
+// Close stops the clock, its tickers never fire again
+func (c *virtualClock) Close() {
+	close(c.stop)
+}
+
+func (c *virtualClock) poke() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// run fires the earliest ticker, over and over. Like time.Ticker a tick is
+// dropped when the last one hasn't been read yet.
+func (c *virtualClock) run() {
+	for {
+		c.mu.Lock()
+		var earliest *virtualTicker
+		for _, t := range c.tickers {
+			if !t.stopped && (earliest == nil || t.next.Before(earliest.next)) {
+				earliest = t
+			}
+		}
+		var wait time.Duration
+		if earliest != nil {
+			wait = time.Duration(float64(earliest.next.Sub(c.now)) / c.speed)
+		}
+		c.mu.Unlock()
+
+		if earliest == nil {
+			select {
+			case <-c.changed:
+				continue
+			case <-c.stop:
+				return
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-c.changed:
+			// a ticker was added or stopped, pick again
+			timer.Stop()
+			continue
+		case <-c.stop:
+			timer.Stop()
+			return
+		}
+
+		c.mu.Lock()
+		if !earliest.stopped {
+			c.now = earliest.next
+			earliest.next = earliest.next.Add(earliest.d)
+			select {
+			case earliest.c <- c.now:
+			default:
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (t *virtualTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *virtualTicker) Stop() {
+	c := t.clock
+	c.mu.Lock()
+	t.stopped = true
+	for i, other := range c.tickers {
+		if other == t {
+			c.tickers = append(c.tickers[:i], c.tickers[i+1:]...)
+			break
+		}
+	}
+	c.mu.Unlock()
+	c.poke()
+}
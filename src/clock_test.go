@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fixedClock stays at one time until it's set to another. Its tickers tick
+// in real time.
+type fixedClock struct {
+	realClock
+
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFixedClock(now time.Time) *fixedClock {
+	return &fixedClock{now: now}
+}
+
+func (c *fixedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fixedClock) set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func TestVirtualClockJumpsFromTickToTick(t *testing.T) {
+	start := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	c := newVirtualClock(start, 3600)
+	defer c.Close()
+
+	ticker := c.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	began := time.Now()
+	for i := 1; i <= 3; i++ {
+		tick := <-ticker.C()
+		if want := start.Add(time.Duration(i) * time.Minute); !tick.Equal(want) {
+			t.Fatalf("tick %d at %s, want %s", i, tick, want)
+		}
+		if !c.Now().Equal(tick) {
+			t.Fatalf("Now() = %s during tick %s", c.Now(), tick)
+		}
+	}
+	// three virtual minutes at 3600x is 50ms of real time
+	if elapsed := time.Since(began); elapsed > time.Second {
+		t.Errorf("three ticks took %s", elapsed)
+	}
+}
+
+func TestVirtualClockFiresEarliestTickerFirst(t *testing.T) {
+	start := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	c := newVirtualClock(start, 36000)
+	defer c.Close()
+
+	slow := c.NewTicker(3 * time.Minute)
+	fast := c.NewTicker(time.Minute)
+	defer slow.Stop()
+	defer fast.Stop()
+
+	for i := 1; i <= 3; i++ {
+		if tick := <-fast.C(); !tick.Equal(start.Add(time.Duration(i) * time.Minute)) {
+			t.Fatalf("fast tick %d at %s", i, tick)
+		}
+	}
+	if tick := <-slow.C(); !tick.Equal(start.Add(3 * time.Minute)) {
+		t.Errorf("slow tick at %s", tick)
+	}
+}
+
+func TestStoppedVirtualTickerNeverFires(t *testing.T) {
+	c := newVirtualClock(time.Now(), 36000)
+	defer c.Close()
+
+	stopped := c.NewTicker(time.Minute)
+	stopped.Stop()
+	running := c.NewTicker(time.Minute)
+	defer running.Stop()
+
+	<-running.C()
+	<-running.C()
+	select {
+	case <-stopped.C():
+		t.Errorf("stopped ticker fired")
+	default:
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runs one of the command line tools instead of the web server
+func runCommand(name string, args []string) error {
+	switch name {
+	case "replay":
+		return replayCommand(args)
+	case "backfill":
+		return backfillCommand(args)
+	case "export":
+		return exportCommand(args)
+	case "dedupe":
+		return dedupeCommand(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+func backfillCommand(args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	window := flags.Duration("since", backfillWindow, "how far back to retry airings that never made it in")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	client, err := savedSession()
+	if err != nil {
+		return err
+	}
+
+	added, err := backfill(client, *window)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+	if err := flushOutbox(); err != nil {
+		return fmt.Errorf("%d song(s) still queued, they'll go in next time the app runs: %s", outboxLen(), err.Error())
+	}
+
+	fmt.Printf("Added %d song(s) missed in the last %s\n", added, window.Round(time.Minute))
+	return nil
+}
+
+func dedupeCommand(args []string) error {
+	flags := flag.NewFlagSet("dedupe", flag.ContinueOnError)
+	flags.BoolVar(&dryRun, "dry-run", dryRun, "only list the copies that would come out")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if _, err := savedSession(); err != nil {
+		return err
+	}
+	for _, target := range currentTargets() {
+		// a song in an earlier part is a duplicate in every later one
+		seen := newPlaylistTarget(target.sink, target.name, target.playlistId)
+		for _, part := range target.parts() {
+			removed, err := dedupeTarget(part, seen)
+			if err != nil {
+				return fmt.Errorf("%s on %s: %s", part.name, part.sink.Name(), err.Error())
+			}
+			if removed > 0 {
+				fmt.Printf("Took %d duplicate(s) out of %s on %s\n", removed, part.name, part.sink.Name())
+			}
+		}
+	}
+	if dryRun {
+		fmt.Print(dryRunSummary())
+	}
+	return nil
+}
+
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "csv", "csv, jsonl, m3u or xspf")
+	from := flags.String("from", "", "first day (2006-01-02) or time (RFC 3339) to export")
+	to := flags.String("to", "", "last day or time to export")
+	station := flags.String("station", "", "only airings on this station")
+	output := flags.String("o", "", "file to write, standard output if not set")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if _, ok := exportFormats[*format]; !ok {
+		return fmt.Errorf("unknown export format %q", *format)
+	}
+
+	filter, err := newExportFilter(*from, *to, *station)
+	if err != nil {
+		return err
+	}
+	if err := loadHistory(); err != nil {
+		return err
+	}
+
+	records := filterHistory(historyRecords(), filter)
+	if *output == "" {
+		return writeExport(os.Stdout, *format, records)
+	}
+	out, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := writeExport(out, *format, records); err != nil {
+		out.Close()
+		return err
+	}
+	// a write that fails can show up only once the file is closed
+	return out.Close()
+}
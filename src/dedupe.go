@@ -0,0 +1,71 @@
+package main
+
+import "fmt"
+
+// what's in the playlist, and the positions of the tracks that are a song
+// further up it or in seen already. The songs kept are added to seen, so the
+// parts of a playlist can be gone through in order with the same one.
+func duplicates(target *playlistTarget, seen *playlistTarget) ([]SinkTrack, []int, error) {
+	listed, err := target.sink.List(target.playlistId)
+	if err != nil {
+		return nil, nil, err
+	}
+	listed = withTrackISRCs(listed)
+	positions := []int{}
+	for i, track := range listed {
+		if seen.has(track.Song) {
+			positions = append(positions, i)
+			continue
+		}
+		seen.remember(track.Song)
+	}
+	return listed, positions, nil
+}
+
+// takes the later copies of each song out of the playlist, keeping the
+// earliest, and returns how many came out. A song already in seen, from an
+// earlier part, comes out wherever it is.
+func dedupeTarget(target *playlistTarget, seen *playlistTarget) (int, error) {
+	listed, positions, err := duplicates(target, seen)
+	if err != nil || len(positions) == 0 {
+		return 0, err
+	}
+	copies, isCopy := []SinkTrack{}, map[int]bool{}
+	for _, i := range positions {
+		copies = append(copies, listed[i])
+		isCopy[i] = true
+	}
+	if remover, ok := target.sink.(copyRemover); ok {
+		if err := remover.RemoveAt(target.playlistId, copies, positions); err != nil {
+			return 0, err
+		}
+		target.uncount(len(copies))
+		return len(copies), nil
+	}
+
+	// the sink takes out every copy of a track, so more copies of one that's
+	// kept have to stay
+	kept := map[string]bool{}
+	for i, track := range listed {
+		if !isCopy[i] {
+			kept[track.Id] = true
+		}
+	}
+	removable := []SinkTrack{}
+	for _, track := range copies {
+		if !kept[track.Id] {
+			removable = append(removable, track)
+		}
+	}
+	if left := len(copies) - len(removable); left > 0 {
+		fmt.Printf("Leaving %d exact copies in %s on %s, it can't take out one copy of a track\n", left, target.name, target.sink.Name())
+	}
+	if len(removable) == 0 {
+		return 0, nil
+	}
+	if err := target.sink.Remove(target.playlistId, removable); err != nil {
+		return 0, err
+	}
+	target.uncount(len(removable))
+	return len(removable), nil
+}
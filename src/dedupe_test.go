@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// the single, the album version and a compilation copy of One, and two
+// recordings of Two
+func addReleases(env *testEnv) {
+	for id, isrc := range map[string]string{"single": "CA0000000001", "album": "CA0000000001", "best": "CA0000000001", "two": "CA0000000002", "twolive": "CA0000000003"} {
+		title := "One"
+		if isrc != "CA0000000001" {
+			title = "Two"
+		}
+		env.spotify.AddTrack(id, title, "A")
+		env.spotify.SetISRC(id, isrc)
+	}
+}
+
+func TestOtherReleasesOfASongInThePlaylistAreSkipped(t *testing.T) {
+	env := newTestEnv(t)
+	addReleases(env)
+	env.spotify.AddPlaylist(playlistName, "single")
+	env.station.played(
+		songAt("A - One", "album", minutesAgo(20)),
+		songAt("A - Two (Live)", "twolive", minutesAgo(10)),
+	)
+
+	env.login(t)
+
+	waitFor(t, "the live Two", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist(playlistName)), []string{"single", "twolive"})
+	})
+	if status := playlistsByTitle(t, "A - One")["A - One"]; len(status) != 0 {
+		t.Errorf("the album version of One went in %q", status)
+	}
+}
+
+func TestDedupeCommandKeepsTheEarliestCopy(t *testing.T) {
+	oldCeiling := spotifyCeiling
+	t.Cleanup(func() { spotifyCeiling = oldCeiling })
+	spotifyCeiling = 6
+	env := newTestEnv(t)
+	addReleases(env)
+	env.spotify.AddTrack("three", "Three", "A")
+	env.spotify.AddPlaylist(playlistName, "album", "two", "single", "album", "twolive", "best")
+	env.spotify.AddPlaylist(partName(playlistName, 2), "best", "three", "two")
+
+	tokenPath = filepath.Join(t.TempDir(), "token.json")
+	if err := saveToken(&oauth2.Token{AccessToken: "saved", TokenType: "Bearer"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCommand("dedupe", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := env.spotify.Playlist(playlistName).Tracks; !sameTracks(got, []string{"album", "two", "twolive"}) || got[0] != "album" {
+		t.Errorf("dedupe left %q", got)
+	}
+	// the copies in the second part are of songs in the first
+	if got := env.spotify.Playlist(partName(playlistName, 2)).Tracks; !sameTracks(got, []string{"three"}) {
+		t.Errorf("dedupe left %q in the second part", got)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// a Deezer app from developers.deezer.com, its redirect URL set to
+// deezerRedirectURL
+var deezerAppId = os.Getenv("DEEZER_APPID")
+var deezerSecret = os.Getenv("DEEZER_SECRET")
+
+var deezerAuthURL = "https://connect.deezer.com/oauth/auth.php"
+var deezerTokenURL = "https://connect.deezer.com/oauth/access_token.php"
+var deezerRedirectURL = "http://localhost:3000/deezer/callback"
+var deezerAPIURL = "https://api.deezer.com"
+
+// offline_access makes a token that doesn't expire, Deezer has no refresh
+var deezerPerms = "basic_access,manage_library,offline_access"
+
+// the Deezer login, kept like the Spotify one
+var deezerTokenPath = filepath.Join(dataDir, "deezer-token.json")
+
+// the login from this run, before falling back to the saved one
+var deezerLogin *oauth2.Token
+
+// GET /deezer/login
+func deezerLoginHandler(w http.ResponseWriter, r *http.Request) {
+	params := url.Values{
+		"app_id":       {deezerAppId},
+		"redirect_uri": {deezerRedirectURL},
+		"perms":        {deezerPerms},
+		"state":        {stateString},
+	}
+	http.Redirect(w, r, deezerAuthURL+"?"+params.Encode(), http.StatusTemporaryRedirect)
+}
+
+// saves the Deezer login, then carries on to the next one
+func deezerCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("state") != stateString {
+		fmt.Println("invalid state")
+		http.Redirect(w, r, "/error", http.StatusTemporaryRedirect)
+		return
+	}
+	token, err := deezerExchange(r.FormValue("code"))
+	if err != nil {
+		fmt.Println("code exchange failed: " + err.Error())
+		http.Redirect(w, r, "/error", http.StatusTemporaryRedirect)
+		return
+	}
+	if err := saveTokenAt(deezerTokenPath, token); err != nil {
+		fmt.Println(err.Error())
+	}
+	deezerLogin = token
+	continueLogin(w, r)
+}
+
+// trades the code for a token. Deezer's OAuth isn't quite the standard one
+// the oauth2 package speaks, it wants app_id and secret and answers in its
+// own shape.
+func deezerExchange(code string) (*oauth2.Token, error) {
+	params := url.Values{
+		"app_id": {deezerAppId},
+		"secret": {deezerSecret},
+		"code":   {code},
+		"output": {"json"},
+	}
+	res, err := httpClient.Get(deezerTokenURL + "?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if err := checkResponse(res); err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	answer := struct {
+		AccessToken string `json:"access_token"`
+		// seconds, 0 for a token that doesn't expire
+		Expires int `json:"expires"`
+	}{}
+	if err := json.Unmarshal(body, &answer); err != nil || answer.AccessToken == "" {
+		// a bad code gets a plain text reason
+		return nil, fmt.Errorf("deezer: %s", strings.TrimSpace(string(body)))
+	}
+	token := &oauth2.Token{AccessToken: answer.AccessToken}
+	if answer.Expires > 0 {
+		token.Expiry = clock.Now().Add(time.Duration(answer.Expires) * time.Second)
+	}
+	return token, nil
+}
+
+// whether the Deezer sink still needs someone to log in
+func needsDeezerLogin() bool {
+	if !sinkEnabled("deezer") || deezerLogin != nil {
+		return false
+	}
+	_, err := loadTokenFrom(deezerTokenPath, "")
+	return err != nil
+}
+
+// Deezer error codes worth telling apart
+const (
+	deezerQuotaExceeded = 4
+	deezerInvalidToken  = 300
+	deezerNoData        = 800
+)
+
+// deezerSink mirrors the playlist on Deezer, finding each song by its ISRC
+// when Spotify gave one and by artist and title otherwise
+type deezerSink struct {
+	token string
+
+	*matcher
+}
+
+// a failed call, which Deezer answers with a 200
+type deezerError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+type deezerTrack struct {
+	Id    int64  `json:"id"`
+	Title string `json:"title"`
+	// in seconds
+	Duration int  `json:"duration"`
+	Readable bool `json:"readable"`
+	Artist   struct {
+		Name string `json:"name"`
+	} `json:"artist"`
+}
+
+// a page of a list, next is empty on the last
+type deezerPage struct {
+	Data json.RawMessage `json:"data"`
+	Next string          `json:"next"`
+}
+
+func newDeezerSink() (*deezerSink, error) {
+	token := deezerLogin
+	if token == nil {
+		var err error
+		if token, err = loadTokenFrom(deezerTokenPath, "log in to Deezer at localhost:3000/deezer/login first"); err != nil {
+			return nil, err
+		}
+	}
+	if !token.Expiry.IsZero() && token.Expiry.Before(clock.Now()) {
+		return nil, fmt.Errorf("the Deezer login has expired, log in again at localhost:3000/deezer/login")
+	}
+	s := &deezerSink{token: token.AccessToken}
+	s.matcher = newMatcher("Deezer", s.search)
+	return s, nil
+}
+
+func (s *deezerSink) Name() string {
+	return "deezer"
+}
+
+// makes a request with the token, decoding the answer into out if given
+func (s *deezerSink) call(method string, path string, params url.Values, out interface{}) error {
+	query := url.Values{"access_token": {s.token}}
+	for key, values := range params {
+		query[key] = values
+	}
+	req, err := http.NewRequest(method, deezerAPIURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := checkResponse(res); err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	failed := struct {
+		Error *deezerError `json:"error"`
+	}{}
+	if json.Unmarshal(body, &failed) == nil && failed.Error != nil {
+		return failed.Error.apiError(method, path)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// makes a request that changes something, or notes it in a dry run
+func (s *deezerSink) change(action string, method string, path string, params url.Values) error {
+	if dryRun {
+		recordDryRun(action, method, deezerAPIURL+path+"?"+params.Encode(), nil)
+		return nil
+	}
+	return s.call(method, path, params, nil)
+}
+
+// the error as the status code the outbox would have had from anyone else
+func (e *deezerError) apiError(method string, path string) error {
+	err := &apiError{
+		Method:     method,
+		Path:       path,
+		Status:     fmt.Sprintf("%s (%d): %s", e.Type, e.Code, e.Message),
+		StatusCode: http.StatusBadRequest,
+	}
+	switch e.Code {
+	case deezerQuotaExceeded:
+		// 50 requests every 5 seconds
+		err.StatusCode, err.RetryAfter = http.StatusTooManyRequests, 5*time.Second
+	case deezerInvalidToken:
+		// the token was revoked, no retry brings it back
+		err.StatusCode = http.StatusUnauthorized
+		return loginRejected{err}
+	case deezerNoData:
+		err.StatusCode = http.StatusNotFound
+	}
+	return err
+}
+
+// whether Deezer said there's nothing there
+func deezerNotFound(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// hands each page of a list's data to each, in order
+func (s *deezerSink) list(path string, each func(data json.RawMessage) error) error {
+	for index := 0; ; {
+		page := deezerPage{}
+		if err := s.call("GET", path, url.Values{"index": {strconv.Itoa(index)}, "limit": {"100"}}, &page); err != nil {
+			return err
+		}
+		if err := each(page.Data); err != nil {
+			return err
+		}
+		if page.Next == "" {
+			return nil
+		}
+		index += 100
+	}
+}
+
+func (s *deezerSink) EnsurePlaylist(name string) (string, error) {
+	found := ""
+	err := s.list("/user/me/playlists", func(data json.RawMessage) error {
+		playlists := []struct {
+			Id    int64  `json:"id"`
+			Title string `json:"title"`
+		}{}
+		if err := json.Unmarshal(data, &playlists); err != nil {
+			return err
+		}
+		for _, playlist := range playlists {
+			if found == "" && playlist.Title == name {
+				found = strconv.FormatInt(playlist.Id, 10)
+			}
+		}
+		return nil
+	})
+	if err != nil || found != "" {
+		return found, err
+	}
+
+	fmt.Println("Making Deezer Playlist")
+	action, params := fmt.Sprintf("create playlist %q", name), url.Values{"title": {name}}
+	if dryRun {
+		return recordDryRun(action, "POST", deezerAPIURL+"/user/me/playlists?"+params.Encode(), nil), nil
+	}
+	made := struct {
+		Id int64 `json:"id"`
+	}{}
+	if err := s.call("POST", "/user/me/playlists", params, &made); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(made.Id, 10), nil
+}
+
+func (s *deezerSink) List(playlistId string) ([]SinkTrack, error) {
+	tracks := []SinkTrack{}
+	if isDryRunId(playlistId) {
+		// never made, so there's nothing to read
+		return tracks, nil
+	}
+	err := s.list("/playlist/"+playlistId+"/tracks", func(data json.RawMessage) error {
+		page := []deezerTrack{}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return err
+		}
+		for _, track := range page {
+			tracks = append(tracks, SinkTrack{Id: strconv.FormatInt(track.Id, 10), Song: track.song()})
+		}
+		return nil
+	})
+	return tracks, err
+}
+
+// adds the songs Deezer has in one go. Deezer refuses the lot if any is
+// already there, so a batch retried after getting part way skips those.
+func (s *deezerSink) Add(playlistId string, songs []Song) error {
+	existing, err := s.List(playlistId)
+	if err != nil {
+		return err
+	}
+	in := map[string]bool{}
+	for _, track := range existing {
+		in[track.Id] = true
+	}
+
+	trackIds := []string{}
+	for _, song := range songs {
+		trackId, err := s.match(song)
+		if err != nil {
+			return err
+		}
+		if trackId != "" && !in[trackId] {
+			trackIds = append(trackIds, trackId)
+			in[trackId] = true
+		}
+	}
+	if len(trackIds) == 0 {
+		return nil
+	}
+	return s.change(fmt.Sprintf("add %d song(s) to %s", len(trackIds), playlistId), "POST", "/playlist/"+playlistId+"/tracks", url.Values{
+		"songs": {strings.Join(trackIds, ",")},
+	})
+}
+
+func (s *deezerSink) Remove(playlistId string, tracks []SinkTrack) error {
+	trackIds := []string{}
+	for _, track := range tracks {
+		trackIds = append(trackIds, track.Id)
+	}
+	if len(trackIds) == 0 {
+		return nil
+	}
+	return s.change(fmt.Sprintf("remove %d track(s) from %s", len(trackIds), playlistId), "DELETE", "/playlist/"+playlistId+"/tracks", url.Values{
+		"songs": {strings.Join(trackIds, ",")},
+	})
+}
+
+// the Deezer track for a song, "" if there isn't one. The ISRC names the
+// exact recording, so it's tried first, then the same artist and title.
+func (s *deezerSink) search(song Song) (string, error) {
+	if song.ISRC != "" {
+		track := deezerTrack{}
+		err := s.call("GET", "/track/isrc:"+url.PathEscape(song.ISRC), nil, &track)
+		if err != nil && !deezerNotFound(err) {
+			return "", err
+		}
+		// a recording Deezer can't play here is no use
+		if err == nil && track.Id != 0 && track.Readable {
+			return strconv.FormatInt(track.Id, 10), nil
+		}
+	}
+
+	want := songKey(song.Artist, song.Title)
+	found := deezerPage{}
+	err := s.call("GET", "/search/track", url.Values{
+		"q":     {fmt.Sprintf(`artist:"%s" track:"%s"`, normaliseArtist(song.Artist), normaliseTitle(song.Title))},
+		"limit": {"10"},
+	}, &found)
+	if err != nil {
+		return "", err
+	}
+	tracks := []deezerTrack{}
+	if err := json.Unmarshal(found.Data, &tracks); err != nil {
+		return "", err
+	}
+	for _, track := range tracks {
+		if track.Readable && songKey(track.Artist.Name, track.Title) == want {
+			return strconv.FormatInt(track.Id, 10), nil
+		}
+	}
+	return "", nil
+}
+
+// the track as a song
+func (t deezerTrack) song() Song {
+	return Song{
+		Artist:   t.Artist.Name,
+		Title:    t.Title,
+		Duration: time.Duration(t.Duration) * time.Second,
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+type fakeDeezerTrack struct {
+	Id       int64
+	Title    string
+	Artist   string
+	ISRC     string
+	Readable bool
+}
+
+// fakeDeezer is Deezer's OAuth and the API endpoints the sink uses. Like
+// the real one it answers failures with a 200 and an error object.
+type fakeDeezer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	tracks    []fakeDeezerTrack
+	playlists map[string][]int64
+	names     map[string]string
+	calls     map[string]int
+}
+
+func newFakeDeezer() *fakeDeezer {
+	f := &fakeDeezer{playlists: map[string][]int64{}, names: map[string]string{}, calls: map[string]int{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeDeezer) addTrack(id int64, title, artist, isrc string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tracks = append(f.tracks, fakeDeezerTrack{id, title, artist, isrc, true})
+}
+
+// the track IDs in the named playlist
+func (f *fakeDeezer) playlist(name string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := []string{}
+	for id, other := range f.names {
+		if other == name {
+			for _, trackId := range f.playlists[id] {
+				ids = append(ids, strconv.FormatInt(trackId, 10))
+			}
+		}
+	}
+	return ids
+}
+
+func (f *fakeDeezer) count(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[key]
+}
+
+func (t fakeDeezerTrack) json() map[string]interface{} {
+	return map[string]interface{}{"id": t.Id, "title": t.Title, "duration": 210, "readable": t.Readable, "artist": map[string]string{"name": t.Artist}}
+}
+
+func deezerFailure(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, map[string]interface{}{"error": map[string]interface{}{"type": "Exception", "message": message, "code": code}})
+}
+
+func (f *fakeDeezer) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := r.URL.Path
+	if strings.HasPrefix(path, "/track/isrc:") {
+		path = "/track/isrc"
+	}
+	f.calls[r.Method+" "+path]++
+
+	q := r.URL.Query()
+	if path == "/oauth/access_token.php" {
+		if q.Get("app_id") != "deezer-app" || q.Get("secret") != "deezer-secret" || q.Get("code") == "" {
+			w.Write([]byte("wrong code"))
+			return
+		}
+		writeJSON(w, map[string]interface{}{"access_token": "dz-token", "expires": 0})
+		return
+	}
+	if q.Get("access_token") != "dz-token" {
+		deezerFailure(w, deezerInvalidToken, "Invalid OAuth access token.")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case path == "/user/me/playlists" && r.Method == "GET":
+		data := []map[string]interface{}{}
+		for id, name := range f.names {
+			playlistId, _ := strconv.ParseInt(id, 10, 64)
+			data = append(data, map[string]interface{}{"id": playlistId, "title": name})
+		}
+		writeJSON(w, map[string]interface{}{"data": data})
+	case path == "/user/me/playlists" && r.Method == "POST":
+		id := strconv.Itoa(900 + len(f.names))
+		f.names[id] = q.Get("title")
+		playlistId, _ := strconv.Atoi(id)
+		writeJSON(w, map[string]int{"id": playlistId})
+	case len(parts) == 3 && parts[0] == "playlist" && parts[2] == "tracks":
+		f.servePlaylist(w, r, parts[1])
+	case path == "/track/isrc":
+		isrc := strings.TrimPrefix(r.URL.Path, "/track/isrc:")
+		for _, t := range f.tracks {
+			if t.ISRC == isrc {
+				writeJSON(w, t.json())
+				return
+			}
+		}
+		deezerFailure(w, deezerNoData, "no data")
+	case path == "/search/track":
+		words := strings.Fields(strings.ToLower(strings.NewReplacer("artist:", "", "track:", "", `"`, "").Replace(q.Get("q"))))
+		data := []map[string]interface{}{}
+		for _, t := range f.tracks {
+			haystack := strings.ToLower(t.Title + " " + t.Artist)
+			found := true
+			for _, word := range words {
+				found = found && strings.Contains(haystack, word)
+			}
+			if found {
+				data = append(data, t.json())
+			}
+		}
+		writeJSON(w, map[string]interface{}{"data": data})
+	default:
+		deezerFailure(w, deezerNoData, "no data")
+	}
+}
+
+func (f *fakeDeezer) servePlaylist(w http.ResponseWriter, r *http.Request, id string) {
+	if _, ok := f.names[id]; !ok {
+		deezerFailure(w, deezerNoData, "no data")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		data := []map[string]interface{}{}
+		for _, trackId := range f.playlists[id] {
+			for _, t := range f.tracks {
+				if t.Id == trackId {
+					data = append(data, t.json())
+				}
+			}
+		}
+		writeJSON(w, map[string]interface{}{"data": data})
+	case "POST":
+		for _, song := range strings.Split(r.URL.Query().Get("songs"), ",") {
+			trackId, _ := strconv.ParseInt(song, 10, 64)
+			for _, existing := range f.playlists[id] {
+				if existing == trackId {
+					deezerFailure(w, 801, "This song already exists in this playlist")
+					return
+				}
+			}
+		}
+		for _, song := range strings.Split(r.URL.Query().Get("songs"), ",") {
+			trackId, _ := strconv.ParseInt(song, 10, 64)
+			f.playlists[id] = append(f.playlists[id], trackId)
+		}
+		w.Write([]byte("true"))
+	case "DELETE":
+		gone := map[string]bool{}
+		for _, song := range strings.Split(r.URL.Query().Get("songs"), ",") {
+			gone[song] = true
+		}
+		kept := []int64{}
+		for _, trackId := range f.playlists[id] {
+			if !gone[strconv.FormatInt(trackId, 10)] {
+				kept = append(kept, trackId)
+			}
+		}
+		f.playlists[id] = kept
+		w.Write([]byte("true"))
+	default:
+		deezerFailure(w, deezerNoData, "no data")
+	}
+}
+
+// useDeezer points the sink and its login at the fake
+func useDeezer(t *testing.T) *fakeDeezer {
+	fake := newFakeDeezer()
+	oldAPI, oldAuth, oldToken, oldPath := deezerAPIURL, deezerAuthURL, deezerTokenURL, deezerTokenPath
+	oldApp, oldSecret := deezerAppId, deezerSecret
+	deezerAPIURL, deezerAuthURL, deezerTokenURL = fake.URL, fake.URL+"/oauth/auth.php", fake.URL+"/oauth/access_token.php"
+	deezerAppId, deezerSecret = "deezer-app", "deezer-secret"
+	deezerTokenPath, deezerLogin = filepath.Join(t.TempDir(), "deezer-token.json"), nil
+	t.Cleanup(func() {
+		fake.Close()
+		deezerAPIURL, deezerAuthURL, deezerTokenURL, deezerTokenPath = oldAPI, oldAuth, oldToken, oldPath
+		deezerAppId, deezerSecret, deezerLogin = oldApp, oldSecret, nil
+	})
+	return fake
+}
+
+func TestDeezerLoginStartsTheSession(t *testing.T) {
+	env := newTestEnv(t)
+	fake := useDeezer(t)
+	fake.addTrack(101, "One", "A", "")
+	enabledSinks = "deezer"
+	env.station.play(song("A - One", ""))
+
+	rec := httptest.NewRecorder()
+	loginHandler(rec, httptest.NewRequest("GET", "/", nil))
+	if location := rec.Header().Get("Location"); location != "/deezer/login" {
+		t.Fatalf("login sent the browser to %q first", location)
+	}
+	rec = httptest.NewRecorder()
+	deezerLoginHandler(rec, httptest.NewRequest("GET", "/deezer/login", nil))
+	authURL, _ := url.Parse(rec.Header().Get("Location"))
+	if authURL.Query().Get("app_id") != "deezer-app" || !strings.Contains(authURL.Query().Get("perms"), "manage_library") {
+		t.Errorf("asked Deezer for %s", authURL)
+	}
+
+	rec = httptest.NewRecorder()
+	deezerCallbackHandler(rec, httptest.NewRequest("GET", "/deezer/callback?code=bad&state=wrong", nil))
+	if location := rec.Header().Get("Location"); location != "/error" {
+		t.Errorf("a forged callback went to %q", location)
+	}
+	rec = httptest.NewRecorder()
+	deezerCallbackHandler(rec, httptest.NewRequest("GET", "/deezer/callback?code=c&state="+authURL.Query().Get("state"), nil))
+	if location := rec.Header().Get("Location"); location != "/run" {
+		t.Fatalf("callback sent the browser to %q", location)
+	}
+	if saved, err := loadTokenFrom(deezerTokenPath, ""); err != nil || saved.AccessToken != "dz-token" || !saved.Expiry.IsZero() {
+		t.Errorf("saved %+v, %v", saved, err)
+	}
+	if info, err := os.Stat(deezerTokenPath); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("the saved login is %v, readable by others", info.Mode())
+	}
+
+	waitFor(t, "the song", func() bool { return sameTracks(fake.playlist("SONiC On Demand"), []string{"101"}) })
+}
+
+func TestDeezerMatchesByISRCFromSpotify(t *testing.T) {
+	env := newTestEnv(t)
+	fake := useDeezer(t)
+	// Deezer calls the same recording something else, only the ISRC finds it
+	env.spotify.AddTrack("track1", "One", "A")
+	env.spotify.SetISRC("track1", "CAX012100001")
+	fake.addTrack(101, "Uno", "A", "CAX012100001")
+	// not on Spotify, so found by name
+	fake.addTrack(202, "Two", "B", "")
+	// a recording Deezer can't play doesn't count
+	env.spotify.AddTrack("track3", "Three", "C")
+	env.spotify.SetISRC("track3", "CAX012100003")
+	fake.mu.Lock()
+	fake.tracks = append(fake.tracks, fakeDeezerTrack{303, "Three", "C", "CAX012100003", false})
+	fake.mu.Unlock()
+	env.spotify.AddPlaylist("SONiC On Demand")
+	enabledSinks = "spotify,deezer"
+	deezerLogin = &oauth2.Token{AccessToken: "dz-token"}
+	env.station.play(song("A - One", "track1"), song("B - Two", ""), song("C - Three", "track3"))
+
+	env.login(t)
+
+	playlistsByTitle(t, "A - One", "B - Two", "C - Three")
+	waitFor(t, "both Deezer tracks", func() bool {
+		return sameTracks(fake.playlist("SONiC On Demand"), []string{"101", "202"})
+	})
+	for _, record := range historyRecords() {
+		if record.SongTitle == "A - One" && record.ISRC != "CAX012100001" {
+			t.Errorf("history has ISRC %q", record.ISRC)
+		}
+	}
+	if n := fake.count("GET /track/isrc"); n != 2 {
+		t.Errorf("looked up %d ISRCs, want 2", n)
+	}
+	if misses := sinksByName["deezer"].(*deezerSink).Misses(); len(misses) != 1 || misses[0].Title != "Three" {
+		t.Errorf("reported misses %+v", misses)
+	}
+}
+
+func TestDeezerSinkSkipsSongsAlreadyAddedOnRetry(t *testing.T) {
+	fake := useDeezer(t)
+	fake.addTrack(101, "One", "A", "")
+	fake.addTrack(202, "Two", "B", "")
+	sink := &deezerSink{token: "dz-token"}
+	sink.matcher = newMatcher("Deezer", sink.search)
+
+	playlistId, err := sink.EnsurePlaylist("SONiC On Demand")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Add(playlistId, []Song{{Artist: "A", Title: "One"}}); err != nil {
+		t.Fatal(err)
+	}
+	// the whole batch again, as the outbox does after a failure
+	if err := sink.Add(playlistId, []Song{{Artist: "A", Title: "One"}, {Artist: "B", Title: "Two"}}); err != nil {
+		t.Fatal(err)
+	}
+	tracks, err := sink.List(playlistId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 2 || tracks[1].Artist != "B" || tracks[1].Duration != 210*time.Second {
+		t.Errorf("playlist has %+v", tracks)
+	}
+
+	if err := sink.Remove(playlistId, tracks[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if left := fake.playlist("SONiC On Demand"); !sameTracks(left, []string{"202"}) {
+		t.Errorf("after removing the first track the playlist has %v", left)
+	}
+}
+
+func TestRevokedDeezerTokenKeepsQueuedSongs(t *testing.T) {
+	newTestEnv(t)
+	fake := useDeezer(t)
+	fake.addTrack(101, "One", "A", "")
+	sink := &deezerSink{token: "dz-token"}
+	sink.matcher = newMatcher("Deezer", sink.search)
+	sinksByName["deezer"] = sink
+	playlistId, err := sink.EnsurePlaylist("SONiC On Demand")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := func() int {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		n := 0
+		for _, count := range fake.calls {
+			n += count
+		}
+		return n
+	}
+
+	sink.token = "revoked"
+	enqueueSongs("deezer", playlistId, Song{Artist: "A", Title: "One"})
+	err = flushOutbox()
+	if err == nil {
+		t.Fatal("a revoked token was taken")
+	}
+	if n := outboxLen(); n != 1 {
+		t.Errorf("%d song(s) kept after the login was rejected, want 1", n)
+	}
+	// no retry until the app is restarted with a new login
+	sent := requests()
+	if err := flushOutbox(); err != nil || requests() != sent {
+		t.Errorf("retried the revoked token: %v, %d more requests", err, requests()-sent)
+	}
+
+	sink.token = "dz-token"
+	outbox.Lock()
+	outbox.queues = map[outboxQueue]*queueState{}
+	outbox.Unlock()
+	if err := flushOutbox(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.playlist("SONiC On Demand"); !sameTracks(got, []string{"101"}) {
+		t.Errorf("after logging in again the playlist has %v", got)
+	}
+}
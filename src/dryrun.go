@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// with DRY_RUN set every change to a playlist is logged and recorded instead
+// of sent, while reads still go out as normal
+var dryRun, _ = strconv.ParseBool(os.Getenv("DRY_RUN"))
+
+// IDs handed out for playlists a dry run pretended to make
+const dryRunIdPrefix = "dry-run-"
+
+// a change a dry run held back
+type plannedChange struct {
+	At     time.Time       `json:"at"`
+	Action string          `json:"action"`
+	Method string          `json:"method"`
+	URL    string          `json:"url"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+var plannedChanges struct {
+	sync.Mutex
+	list []plannedChange
+}
+
+// sends a request that changes a playlist, or only records it in a dry run.
+// action describes the change for the log and the summary. Returns the
+// response body.
+func sendChange(client *http.Client, action string, method string, url string, payload interface{}) ([]byte, error) {
+	var requestBody []byte
+	if payload != nil {
+		var err error
+		requestBody, err = json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if dryRun {
+		id := recordDryRun(action, method, url, requestBody)
+		// enough of a response for callers that want an ID back
+		return json.Marshal(map[string]string{"id": id, "snapshot_id": id})
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	body, readErr := ioutil.ReadAll(res.Body)
+	if err := checkResponse(res); err != nil {
+		// the body too, for callers that want to know why
+		return body, err
+	}
+	return body, readErr
+}
+
+// logs and records a change that wasn't sent, returning an ID to stand in
+// for anything it would have created
+func recordDryRun(action string, method string, url string, body []byte) string {
+	plannedChanges.Lock()
+	defer plannedChanges.Unlock()
+
+	change := plannedChange{At: clock.Now(), Action: action, Method: method, URL: url}
+	if len(body) > 0 {
+		change.Body = json.RawMessage(body)
+	}
+	plannedChanges.list = append(plannedChanges.list, change)
+	fmt.Printf("Dry run, would %s: %s %s %s\n", action, method, url, body)
+
+	return dryRunIdPrefix + strconv.Itoa(len(plannedChanges.list))
+}
+
+func isDryRunId(id string) bool {
+	return strings.HasPrefix(id, dryRunIdPrefix)
+}
+
+// a copy of everything held back so far
+func dryRunChanges() []plannedChange {
+	plannedChanges.Lock()
+	defer plannedChanges.Unlock()
+	return append([]plannedChange(nil), plannedChanges.list...)
+}
+
+// lists the held back changes, oldest first
+func dryRunSummary() string {
+	changes := dryRunChanges()
+
+	var summary strings.Builder
+	fmt.Fprintf(&summary, "Dry run: %d change(s) not sent\n", len(changes))
+	for _, change := range changes {
+		fmt.Fprintf(&summary, "  %s  %s\n", change.At.Format(time.RFC3339), change.Action)
+	}
+	return summary.String()
+}
+
+// forgets everything held back so far
+func resetDryRun() {
+	plannedChanges.Lock()
+	defer plannedChanges.Unlock()
+	plannedChanges.list = nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startDryRun turns dry run on for the rest of the test. Call it before
+// newTestEnv so the app has stopped by the time it's turned back off.
+func startDryRun(t *testing.T) {
+	dryRun = true
+	resetDryRun()
+	t.Cleanup(func() {
+		dryRun = false
+		resetDryRun()
+	})
+}
+
+func TestDryRunRecordsChangesInsteadOfSendingThem(t *testing.T) {
+	startDryRun(t)
+	env := newTestEnv(t)
+	env.station.play(song("A - One", "track1"), song("A - One", "track1"), song("B - Two", "track2"))
+
+	env.login(t)
+
+	waitFor(t, "both adds", func() bool { return len(dryRunChanges()) == 3 })
+	if env.spotify.Playlist("SONiC On Demand") != nil {
+		t.Errorf("dry run created the playlist")
+	}
+	if n := env.spotify.Count("GET /v1/me/playlists"); n == 0 {
+		t.Errorf("dry run didn't read the user's playlists")
+	}
+
+	changes := dryRunChanges()
+	if changes[0].Method != "POST" || !strings.HasSuffix(changes[0].URL, "/users/fake-user/playlists") {
+		t.Errorf("first change was %+v, want the playlist creation", changes[0])
+	}
+	if !strings.Contains(string(changes[1].Body), "spotify:track:track1") ||
+		!strings.Contains(string(changes[2].Body), "spotify:track:track2") {
+		t.Errorf("adds recorded as %s and %s", changes[1].Body, changes[2].Body)
+	}
+
+	summary := dryRunSummary()
+	for _, want := range []string{"3 change(s)", `create playlist "SONiC On Demand"`, "add spotify:track:track2 to dry-run-1"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary is missing %q:\n%s", want, summary)
+		}
+	}
+}
+
+func TestDryRunStillReadsExistingPlaylist(t *testing.T) {
+	startDryRun(t)
+	env := newTestEnv(t)
+	existing := env.spotify.AddPlaylist("SONiC On Demand", "track1")
+	env.station.play(song("A - One", "track1"), song("B - Two", "track2"))
+
+	env.login(t)
+
+	waitFor(t, "the new song", func() bool { return len(dryRunChanges()) == 1 })
+	time.Sleep(5 * pollInterval)
+	if n := len(dryRunChanges()); n != 1 {
+		t.Errorf("recorded %d changes, want only the new song", n)
+	}
+	if got := tracksOf(env.spotify.Playlist("SONiC On Demand")); !sameTracks(got, []string{"track1"}) {
+		t.Errorf("dry run changed the playlist to %v", got)
+	}
+	if !strings.Contains(dryRunChanges()[0].URL, existing.Id) {
+		t.Errorf("add aimed at %s, want playlist %s", dryRunChanges()[0].URL, existing.Id)
+	}
+}
+
+func TestReplayIntoDryRun(t *testing.T) {
+	startDryRun(t)
+	newTestEnv(t)
+	pollInterval = 150 * time.Second
+	path := writeRecording(t, map[float64]SonicInfo{
+		0:   song("A - One", "track1"),
+		2.5: song("B - Two", "track2"),
+	})
+
+	tracks, err := replay(path, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tracks) != 0 {
+		t.Errorf("dry run replay put %v on the fake", tracks)
+	}
+	if n := len(dryRunChanges()); n != 3 {
+		t.Errorf("recorded %d changes, want a playlist and two adds", n)
+	}
+}
+
+func TestRealRunAfterDryRunStillAddsTheSongs(t *testing.T) {
+	dir := t.TempDir()
+	aired := []SonicInfo{
+		songAt("A - One", "track1", "2021-07-01 12:00:00"),
+		songAt("B - Two", "track2", "2021-07-01 12:04:00"),
+	}
+	useData := func() {
+		historyPath, outboxPath = filepath.Join(dir, "history.jsonl"), filepath.Join(dir, "outbox.json")
+		if err := loadHistory(); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadOutbox(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		startDryRun(t)
+		env := newTestEnv(t)
+		useData()
+		env.station.played(aired...)
+		env.login(t)
+		waitFor(t, "both adds", func() bool { return len(dryRunChanges()) == 3 })
+	})
+	for _, name := range []string{"history.jsonl", "outbox.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("dry run wrote %s", name)
+		}
+	}
+
+	env := newTestEnv(t)
+	useData()
+	env.station.played(aired...)
+	env.login(t)
+	waitFor(t, "the songs the dry run only pretended to add", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist("SONiC On Demand")), []string{"track1", "track2"})
+	})
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var exportFormats = map[string]struct {
+	contentType string
+	extension   string
+}{
+	"csv":   {"text/csv; charset=utf-8", "csv"},
+	"jsonl": {"application/x-ndjson", "jsonl"},
+	"m3u":   {"audio/x-mpegurl; charset=utf-8", "m3u"},
+	"xspf":  {"application/xspf+xml", "xspf"},
+}
+
+// which airings to export, zero values don't filter
+type exportFilter struct {
+	From    time.Time
+	To      time.Time
+	Station string
+}
+
+// reads from/to/station the same way for the command and the endpoint.
+// Dates without a time cover the whole day in the station's time zone.
+func newExportFilter(from string, to string, station string) (exportFilter, error) {
+	filter := exportFilter{Station: station}
+	var err error
+	if filter.From, err = parseExportTime(from, false); err != nil {
+		return filter, err
+	}
+	if filter.To, err = parseExportTime(to, true); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+func parseExportTime(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	day, err := time.ParseInLocation("2006-01-02", value, stationTimeZone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("can't read %q as a date (2006-01-02) or time (RFC 3339)", value)
+	}
+	if endOfDay {
+		return day.AddDate(0, 0, 1), nil
+	}
+	return day, nil
+}
+
+func (f exportFilter) matches(record HistoryRecord) bool {
+	aired := record.airedAt()
+	if !f.From.IsZero() && aired.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !aired.Before(f.To) {
+		return false
+	}
+	return f.Station == "" || strings.EqualFold(f.Station, record.Station)
+}
+
+// the airings the filter lets through, in air order
+func filterHistory(records []HistoryRecord, filter exportFilter) []HistoryRecord {
+	matched := []HistoryRecord{}
+	for _, record := range records {
+		if filter.matches(record) {
+			matched = append(matched, record)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].airedAt().Before(matched[j].airedAt())
+	})
+	return matched
+}
+
+// writes airings out in one of exportFormats
+func writeExport(w io.Writer, format string, records []HistoryRecord) error {
+	switch format {
+	case "csv":
+		return writeCSV(w, records)
+	case "jsonl":
+		encoder := json.NewEncoder(w)
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "m3u":
+		return writeM3U(w, playlistEntries(records))
+	case "xspf":
+		return writeXSPF(w, "SONiC On Demand", playlistEntries(records))
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// a column for every field of HistoryRecord, named as in the JSON Lines
+// export, so fields added to the history are exported too
+func writeCSV(w io.Writer, records []HistoryRecord) error {
+	out := csv.NewWriter(w)
+	kind := reflect.TypeOf(HistoryRecord{})
+	header := []string{}
+	for i := 0; i < kind.NumField(); i++ {
+		header = append(header, strings.Split(kind.Field(i).Tag.Get("json"), ",")[0])
+	}
+	out.Write(header)
+	for _, r := range records {
+		value := reflect.ValueOf(r)
+		row := []string{}
+		for i := 0; i < value.NumField(); i++ {
+			cell, err := csvCell(value.Field(i).Interface())
+			if err != nil {
+				return err
+			}
+			row = append(row, cell)
+		}
+		out.Write(row)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// a history field as a CSV cell: times in RFC 3339, lists space separated
+// and anything with fields of its own as JSON
+func csvCell(field interface{}) (string, error) {
+	switch v := field.(type) {
+	case string:
+		return v, nil
+	case int:
+		return strconv.Itoa(v), nil
+	case time.Time:
+		if v.IsZero() {
+			return "", nil
+		}
+		return v.Format(time.RFC3339), nil
+	case []string:
+		return strings.Join(v, " "), nil
+	}
+	if value := reflect.ValueOf(field); value.Kind() == reflect.Ptr && value.IsNil() {
+		return "", nil
+	}
+	data, err := json.Marshal(field)
+	return string(data), err
+}
+
+// one song in a playlist file
+type playlistEntry struct {
+	Artist   string
+	Title    string
+	Duration time.Duration
+	Location string
+	// when it aired, written alongside where the format has room
+	AiredAt time.Time
+}
+
+// where a player can find a song: its Spotify link when there is one
+func spotifyLocation(spotifyId string) string {
+	if spotifyId == "" {
+		return ""
+	}
+	return "https://open.spotify.com/track/" + spotifyId
+}
+
+func playlistEntries(records []HistoryRecord) []playlistEntry {
+	entries := []playlistEntry{}
+	for _, r := range records {
+		entries = append(entries, playlistEntry{
+			Artist:   r.Artist,
+			Title:    r.Title,
+			Duration: time.Duration(r.Length) * time.Second,
+			Location: spotifyLocation(r.SpotifyId),
+			AiredAt:  r.airedAt(),
+		})
+	}
+	return entries
+}
+
+// the "Artist - Title" a player shows
+func (e playlistEntry) displayName() string {
+	if e.Artist == "" {
+		return e.Title
+	}
+	return e.Artist + " - " + e.Title
+}
+
+// extended M3U. A song with nowhere to play it from gets its name as the
+// location, which is what players look for in the playlist's folder.
+func writeM3U(w io.Writer, entries []playlistEntry) error {
+	if _, err := fmt.Fprintln(w, "#EXTM3U"); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		seconds := -1
+		if e.Duration > 0 {
+			seconds = int(e.Duration.Seconds())
+		}
+		location := e.Location
+		if location == "" {
+			location = e.displayName()
+		}
+		if _, err := fmt.Fprintf(w, "#EXTINF:%d,%s\n%s\n", seconds, e.displayName(), location); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type xspfPlaylist struct {
+	XMLName   xml.Name    `xml:"playlist"`
+	Version   string      `xml:"version,attr"`
+	Namespace string      `xml:"xmlns,attr"`
+	Title     string      `xml:"title"`
+	Tracks    []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location   string `xml:"location,omitempty"`
+	Creator    string `xml:"creator,omitempty"`
+	Title      string `xml:"title"`
+	Duration   int64  `xml:"duration,omitempty"`
+	Annotation string `xml:"annotation,omitempty"`
+}
+
+func writeXSPF(w io.Writer, title string, entries []playlistEntry) error {
+	playlist := xspfPlaylist{Version: "1", Namespace: "http://xspf.org/ns/0/", Title: title}
+	for _, e := range entries {
+		track := xspfTrack{
+			Location: e.Location,
+			Creator:  e.Artist,
+			Title:    e.Title,
+			// milliseconds
+			Duration: int64(e.Duration / time.Millisecond),
+		}
+		if !e.AiredAt.IsZero() {
+			track.Annotation = "Aired " + e.AiredAt.Format(time.RFC3339)
+		}
+		playlist.Tracks = append(playlist.Tracks, track)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(playlist); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// GET /export?format=csv&from=2021-07-01&to=2021-07-31&station=CHDI
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	if format == "" {
+		format = "csv"
+	}
+	kind, ok := exportFormats[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown export format %q", format), http.StatusBadRequest)
+		return
+	}
+	filter, err := newExportFilter(r.FormValue("from"), r.FormValue("to"), r.FormValue("station"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", kind.contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="sonic-history.`+kind.extension+`"`)
+	if err := writeExport(w, format, filterHistory(historyRecords(), filter)); err != nil {
+		fmt.Println(err.Error())
+	}
+}
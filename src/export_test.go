@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// exportHistory fills the history with three days of airings on two stations
+func exportHistory(t *testing.T) {
+	newTestEnv(t)
+	for _, r := range []struct {
+		station string
+		info    SonicInfo
+	}{
+		{"CHDI", songAt("A - One", "track1", "2021-06-30 23:30:00")},
+		{"CHDI", songAt("B - Two", "track2", "2021-07-01 08:00:00")},
+		{"CFBR", songAt("X - Other", "other", "2021-07-01 09:00:00")},
+		{"CHDI", songAt("Local - Demo", "", "2021-07-01 23:59:00")},
+		{"CHDI", songAt("C - Three", "track3", "2021-07-02 00:00:00")},
+	} {
+		record := newHistoryRecord(r.info, sourcePoll)
+		record.Station = r.station
+		record.Status = statusAdded
+		if record.SpotifyId == "track1" {
+			record.ISRC, record.Show = "CA0000000001", "Morning Show"
+			record.MusicBrainz = &musicBrainzInfo{}
+		}
+		appendHistory(record)
+	}
+}
+
+func exported(t *testing.T, format string, filter exportFilter) string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := writeExport(&out, format, filterHistory(historyRecords(), filter)); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestExportFiltersByDayAndStation(t *testing.T) {
+	exportHistory(t)
+
+	filter, err := newExportFilter("2021-07-01", "2021-07-01", "chdi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, record := range filterHistory(historyRecords(), filter) {
+		got = append(got, record.SongTitle)
+	}
+	if want := []string{"B - Two", "Local - Demo"}; !sameTracks(got, want) {
+		t.Errorf("exported %v, want %v", got, want)
+	}
+
+	if _, err := newExportFilter("July", "", ""); err == nil {
+		t.Errorf("accepted a date of July")
+	}
+}
+
+func TestExportCSVAndJSONLinesHaveEveryField(t *testing.T) {
+	exportHistory(t)
+
+	rows, err := csv.NewReader(strings.NewReader(exported(t, "csv", exportFilter{}))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 6 {
+		t.Fatalf("csv has %d rows", len(rows))
+	}
+	first := map[string]string{}
+	for i, column := range rows[0] {
+		first[column] = rows[1][i]
+	}
+	want := map[string]string{
+		"station": "CHDI", "song_title": "A - One", "artist": "A", "title": "One",
+		"started_at": "2021-06-30T23:30:00-06:00", "length": "210", "spotify_id": "track1",
+		"isrc": "CA0000000001", "show": "Morning Show", "status": statusAdded,
+	}
+	for column, value := range want {
+		if first[column] != value {
+			t.Errorf("first csv row has %s %q, want %q", column, first[column], value)
+		}
+	}
+	if !strings.HasPrefix(first["musicbrainz"], "{") {
+		t.Errorf("first csv row has musicbrainz %q, want it as JSON", first["musicbrainz"])
+	}
+	fields := reflect.TypeOf(HistoryRecord{}).NumField()
+	if len(rows[0]) != fields {
+		t.Errorf("csv has %d columns for the history's %d fields: %v", len(rows[0]), fields, rows[0])
+	}
+
+	lines := strings.Split(strings.TrimSpace(exported(t, "jsonl", exportFilter{})), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("jsonl has %d lines", len(lines))
+	}
+	record := HistoryRecord{}
+	if err := json.Unmarshal([]byte(lines[2]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Station != "CFBR" || record.SpotifyId != "other" || record.Status != statusAdded {
+		t.Errorf("third jsonl line is %+v", record)
+	}
+}
+
+func TestExportM3U(t *testing.T) {
+	exportHistory(t)
+	filter, _ := newExportFilter("2021-07-01", "", "CHDI")
+
+	want := `#EXTM3U
+#EXTINF:210,B - Two
+https://open.spotify.com/track/track2
+#EXTINF:210,Local - Demo
+Local - Demo
+#EXTINF:210,C - Three
+https://open.spotify.com/track/track3
+`
+	if got := exported(t, "m3u", filter); got != want {
+		t.Errorf("m3u is\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestExportXSPF(t *testing.T) {
+	exportHistory(t)
+
+	playlist := xspfPlaylist{}
+	if err := xml.Unmarshal([]byte(exported(t, "xspf", exportFilter{})), &playlist); err != nil {
+		t.Fatal(err)
+	}
+	if len(playlist.Tracks) != 5 {
+		t.Fatalf("xspf has %d tracks", len(playlist.Tracks))
+	}
+	first := playlist.Tracks[0]
+	if first.Creator != "A" || first.Title != "One" || first.Duration != 210000 || first.Location != "https://open.spotify.com/track/track1" {
+		t.Errorf("first xspf track is %+v", first)
+	}
+	if !strings.HasPrefix(first.Annotation, "Aired 2021-06-30T23:30:00") {
+		t.Errorf("first track annotated %q", first.Annotation)
+	}
+}
+
+func TestExportEndpoint(t *testing.T) {
+	exportHistory(t)
+
+	rec := httptest.NewRecorder()
+	exportHandler(rec, httptest.NewRequest("GET", "/export?format=m3u&from=2021-07-02", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "audio/x-mpegurl; charset=utf-8" {
+		t.Errorf("answered %d with %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "C - Three") || strings.Contains(body, "B - Two") {
+		t.Errorf("exported\n%s", body)
+	}
+
+	for _, query := range []string{"format=mp3", "from=yesterday"} {
+		rec = httptest.NewRecorder()
+		exportHandler(rec, httptest.NewRequest("GET", "/export?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s answered %d", query, rec.Code)
+		}
+	}
+}
+
+func TestExportCommandReadsTheHistoryFile(t *testing.T) {
+	exportHistory(t)
+	records := historyRecords()
+	writeHistory(t, records...)
+	resetHistory()
+
+	output := filepath.Join(t.TempDir(), "out.jsonl")
+	if err := runCommand("export", []string{"-format", "jsonl", "-station", "CFBR", "-o", output}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(output)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `"X - Other"`) {
+		t.Errorf("exported %s", data)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// fakeStation is a scriptable stand-in for the Rogers now playing widget
+type fakeStation struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	script []SonicInfo
+	recent []SonicInfo
+	status int
+	hits   int
+}
+
+func newFakeStation(script ...SonicInfo) *fakeStation {
+	s := &fakeStation{script: script}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// play replaces whatever is queued with the given songs
+func (s *fakeStation) play(script ...SonicInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.script = script
+}
+
+// played sets what the recently played list answers with
+func (s *fakeStation) played(recent ...SonicInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recent = recent
+}
+
+// fail makes every request answer with status until it's set back to 0
+func (s *fakeStation) fail(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// serve answers with the head of the script, moving on until only the last
+// song is left, which keeps playing
+func (s *fakeStation) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hits++
+	if s.status != 0 {
+		http.Error(w, "", s.status)
+		return
+	}
+	if r.URL.Path == "/chdi/widget/recently_played" {
+		writeJSON(w, append([]SonicInfo{}, s.recent...))
+		return
+	}
+	if len(s.script) == 0 {
+		writeJSON(w, map[string]string{})
+		return
+	}
+	writeJSON(w, s.script[0])
+	if len(s.script) > 1 {
+		s.script = s.script[1:]
+	}
+}
+
+// song is shorthand for a now playing response
+func song(title, spotifyId string) SonicInfo {
+	return songAt(title, spotifyId, "2021-07-01 12:00:00")
+}
+
+// songAt is song with a start time
+func songAt(title, spotifyId, startedAt string) SonicInfo {
+	return SonicInfo{
+		Song_title: title,
+		Started_at: startedAt,
+		Length:     "3:30",
+		Spotify:    spotifyId,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,712 @@
+// Package fakespotify is an in-process stand-in for the parts of the Spotify
+// Web API and accounts service the app talks to, for tests and feed replays.
+package fakespotify
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// track is a track in the fake Spotify catalogue
+type track struct {
+	Id     string
+	Name   string
+	Artist string
+	ISRC   string
+	// of the track's album
+	ReleaseDate string
+	// the URL of its album art
+	Cover string
+	// why it can't be played in the user's market, empty when it can
+	Restricted string
+	// the track Spotify relinks it to in the user's market
+	RelinkedTo string
+	// the album it's on and whether that's an album, single or compilation
+	Album     string
+	AlbumType string
+	Explicit  bool
+	// nil for a track with no analysis
+	Features *Features
+}
+
+// Features are a track's audio features, as the API describes them
+type Features struct {
+	Id           string  `json:"id"`
+	Energy       float64 `json:"energy"`
+	Valence      float64 `json:"valence"`
+	Danceability float64 `json:"danceability"`
+	Tempo        float64 `json:"tempo"`
+}
+
+// Playlist is a playlist owned by the fake Spotify user
+type Playlist struct {
+	Id          string
+	Name        string
+	Description string
+	Public      bool
+	Tracks      []string
+	// the cover last uploaded, as JPEG
+	Image []byte
+}
+
+// Server answers like Spotify from an httptest server, with a catalogue and
+// playlists tests set up and inspect
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	user      string
+	playlists []*Playlist
+	catalogue map[string]track
+	// by artist ID
+	genres   map[string][]string
+	nextId   int
+	tokens   int
+	requests []string
+	// the market each request that asked for one gave
+	markets []string
+	// the scopes granted with each authorization code and access token
+	scopes map[string]string
+	// track ids a playlist won't take, like a malformed one
+	invalid map[string]bool
+
+	// status to answer the next request matching a "METHOD /path" key with
+	fail map[string][]int
+}
+
+// New starts a fake Spotify with an empty catalogue and no playlists
+func New() *Server {
+	f := &Server{
+		user:      "fake-user",
+		catalogue: map[string]track{},
+		genres:    map[string][]string{},
+		fail:      map[string][]int{},
+		scopes:    map[string]string{},
+		invalid:   map[string]bool{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+// AddTrack puts a track in the catalogue so search can find it
+func (f *Server) AddTrack(id, name, artist string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.catalogue[id] = track{Id: id, Name: name, Artist: artist}
+}
+
+// SetISRC gives a catalogue track an ISRC
+func (f *Server) SetISRC(id, isrc string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := f.catalogue[id]
+	t.ISRC = isrc
+	f.catalogue[id] = t
+}
+
+// SetReleaseDate dates a catalogue track's album
+func (f *Server) SetReleaseDate(id, date string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := f.catalogue[id]
+	t.ReleaseDate = date
+	f.catalogue[id] = t
+}
+
+// SetAlbum puts a catalogue track on an album of the type, released on the
+// date
+func (f *Server) SetAlbum(id, album, albumType, date string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := f.catalogue[id]
+	t.Album, t.AlbumType, t.ReleaseDate = album, albumType, date
+	f.catalogue[id] = t
+}
+
+// Restrict makes a catalogue track unplayable in the user's market
+func (f *Server) Restrict(id, reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := f.catalogue[id]
+	t.Restricted = reason
+	f.catalogue[id] = t
+}
+
+// Relink has Spotify play another track in place of a catalogue one in the
+// user's market
+func (f *Server) Relink(id, to string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := f.catalogue[id]
+	t.RelinkedTo = to
+	f.catalogue[id] = t
+}
+
+// SetExplicit marks a catalogue track as explicit
+func (f *Server) SetExplicit(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := f.catalogue[id]
+	t.Explicit = true
+	f.catalogue[id] = t
+}
+
+// SetCover gives a catalogue track album art
+func (f *Server) SetCover(id, url string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := f.catalogue[id]
+	t.Cover = url
+	f.catalogue[id] = t
+}
+
+// SetFeatures gives a catalogue track audio features
+func (f *Server) SetFeatures(id string, features Features) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := f.catalogue[id]
+	features.Id = id
+	t.Features = &features
+	f.catalogue[id] = t
+}
+
+// SetGenres gives an artist genres, by name
+func (f *Server) SetGenres(artist string, genres ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.genres[artistId(artist)] = genres
+}
+
+// the ID the fake gives an artist
+func artistId(name string) string {
+	return strings.ToLower(strings.Replace(name, " ", "-", -1))
+}
+
+// AddPlaylist creates a playlist directly, bypassing the API
+func (f *Server) AddPlaylist(name string, tracks ...string) *Playlist {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.createPlaylist(name, "", tracks)
+}
+
+func (f *Server) createPlaylist(name, description string, tracks []string) *Playlist {
+	f.nextId++
+	p := &Playlist{
+		Id:          "playlist" + strconv.Itoa(f.nextId),
+		Name:        name,
+		Description: description,
+		Tracks:      append([]string(nil), tracks...),
+	}
+	f.playlists = append(f.playlists, p)
+	return p
+}
+
+// Playlist returns a copy of the named playlist, or nil
+func (f *Server) Playlist(name string) *Playlist {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, p := range f.playlists {
+		if p.Name == name {
+			c := *p
+			c.Tracks = append([]string(nil), p.Tracks...)
+			return &c
+		}
+	}
+	return nil
+}
+
+// PlaylistById returns a copy of the playlist with the ID, or nil
+func (f *Server) PlaylistById(id string) *Playlist {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p := f.findPlaylist(id); p != nil {
+		c := *p
+		c.Tracks = append([]string(nil), p.Tracks...)
+		return &c
+	}
+	return nil
+}
+
+// Invalidate makes adding the track to a playlist fail with a 400, as a
+// malformed id does, along with the rest of the request
+func (f *Server) Invalidate(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.invalid[id] = true
+}
+
+// FailNext makes the next requests for key ("POST /v1/playlists/x/tracks")
+// answer with the given statuses in turn
+func (f *Server) FailNext(key string, statuses ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail[key] = append(f.fail[key], statuses...)
+}
+
+// Count returns how many requests were made for key
+func (f *Server) Count(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, r := range f.requests {
+		if r == key {
+			n++
+		}
+	}
+	return n
+}
+
+// Requests returns every request made so far, as "METHOD /path"
+func (f *Server) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// Markets returns the market each request that asked for one gave
+func (f *Server) Markets() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.markets...)
+}
+
+func (f *Server) findPlaylist(id string) *Playlist {
+	for _, p := range f.playlists {
+		if p.Id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func (f *Server) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := r.Method + " " + r.URL.Path
+	f.requests = append(f.requests, key)
+	if statuses := f.fail[key]; len(statuses) > 0 {
+		f.fail[key] = statuses[1:]
+		http.Error(w, `{"error":{"status":`+strconv.Itoa(statuses[0])+`}}`, statuses[0])
+		return
+	}
+
+	if r.URL.Path == "/authorize" {
+		f.serveAuthorize(w, r)
+		return
+	}
+	if r.URL.Path == "/api/token" {
+		f.serveToken(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") == "" {
+		http.Error(w, `{"error":{"status":401,"message":"No token provided"}}`, http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "me" && r.Method == "GET":
+		me := map[string]string{"id": f.user}
+		// the country is private, only there for a login that was granted it
+		if f.granted(r, "user-read-private") {
+			me["country"] = "CA"
+		}
+		writeJSON(w, me)
+	case len(parts) == 2 && parts[0] == "me" && parts[1] == "playlists" && r.Method == "GET":
+		f.servePlaylists(w, r)
+	case len(parts) == 3 && parts[0] == "users" && parts[2] == "playlists" && r.Method == "POST":
+		if parts[1] != f.user {
+			http.Error(w, `{"error":{"status":403}}`, http.StatusForbidden)
+			return
+		}
+		var body struct {
+			Name        string `json:"name"`
+			Description string `json:"description"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		p := f.createPlaylist(body.Name, body.Description, nil)
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, map[string]string{"id": p.Id, "name": p.Name})
+	case len(parts) == 2 && parts[0] == "playlists":
+		f.servePlaylist(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "playlists" && parts[2] == "images" && r.Method == "PUT":
+		p := f.findPlaylist(parts[1])
+		body, _ := ioutil.ReadAll(r.Body)
+		jpg, err := base64.StdEncoding.DecodeString(string(body))
+		if p == nil || err != nil || r.Header.Get("Content-Type") != "image/jpeg" {
+			http.Error(w, `{"error":{"status":400}}`, http.StatusBadRequest)
+			return
+		}
+		p.Image = jpg
+		w.WriteHeader(http.StatusAccepted)
+	case len(parts) == 3 && parts[0] == "playlists" && parts[2] == "tracks":
+		f.serveTracks(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "tracks" && r.Method == "GET":
+		t, ok := f.catalogue[parts[1]]
+		if !ok {
+			http.Error(w, `{"error":{"status":404}}`, http.StatusNotFound)
+			return
+		}
+		if market := r.URL.Query().Get("market"); market != "" {
+			f.markets = append(f.markets, market)
+			if relinked, ok := f.catalogue[t.RelinkedTo]; ok {
+				track := relinked.json()
+				track["linked_from"] = map[string]string{"id": t.Id}
+				relinked.playability(track)
+				writeJSON(w, track)
+				return
+			}
+			track := t.json()
+			t.playability(track)
+			writeJSON(w, track)
+			return
+		}
+		writeJSON(w, t.json())
+	case len(parts) == 1 && parts[0] == "tracks" && r.Method == "GET":
+		tracks := []interface{}{}
+		for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+			if t, ok := f.catalogue[id]; ok {
+				tracks = append(tracks, t.json())
+			} else {
+				tracks = append(tracks, nil)
+			}
+		}
+		writeJSON(w, map[string]interface{}{"tracks": tracks})
+	case len(parts) == 1 && parts[0] == "artists" && r.Method == "GET":
+		artists := []map[string]interface{}{}
+		for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+			artists = append(artists, map[string]interface{}{"id": id, "genres": append([]string{}, f.genres[id]...)})
+		}
+		writeJSON(w, map[string]interface{}{"artists": artists})
+	case len(parts) == 1 && parts[0] == "audio-features" && r.Method == "GET":
+		features := []*Features{}
+		for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+			features = append(features, f.catalogue[id].Features)
+		}
+		writeJSON(w, map[string]interface{}{"audio_features": features})
+	case len(parts) == 1 && parts[0] == "search" && r.Method == "GET":
+		f.serveSearch(w, r)
+	default:
+		http.Error(w, `{"error":{"status":404}}`, http.StatusNotFound)
+	}
+}
+
+// serveAuthorize grants the user's consent at once, sending the browser
+// back with a code for the scopes asked for
+func (f *Server) serveAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	f.tokens++
+	code := "fake-code-" + strconv.Itoa(f.tokens)
+	f.scopes[code] = query.Get("scope")
+	back := query.Get("redirect_uri") + "?code=" + url.QueryEscape(code) + "&state=" + url.QueryEscape(query.Get("state"))
+	http.Redirect(w, r, back, http.StatusFound)
+}
+
+// serveToken swaps a code or refresh token for an access token with the
+// same scopes
+func (f *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	grant := r.PostForm.Get("code")
+	if r.PostForm.Get("grant_type") == "refresh_token" {
+		grant = r.PostForm.Get("refresh_token")
+	} else if grant == "" {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	f.tokens++
+	access, refresh := "fake-access-"+strconv.Itoa(f.tokens), "fake-refresh-"+strconv.Itoa(f.tokens)
+	f.scopes[access], f.scopes[refresh] = f.scopes[grant], f.scopes[grant]
+	writeJSON(w, map[string]interface{}{
+		"access_token":  access,
+		"token_type":    "Bearer",
+		"refresh_token": refresh,
+		"expires_in":    3600,
+		"scope":         f.scopes[grant],
+	})
+}
+
+// whether the request's access token was granted the scope
+func (f *Server) granted(r *http.Request, scope string) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	for _, granted := range strings.Fields(f.scopes[token]) {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// pageBounds reads offset and limit the way Spotify does
+func pageBounds(r *http.Request, total, defaultLimit int) (int, int) {
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultLimit
+	}
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return offset, end
+}
+
+// nextPage builds the "next" link of a paging object
+func (f *Server) nextPage(r *http.Request, end, total int) interface{} {
+	if end >= total {
+		return nil
+	}
+	q := r.URL.Query()
+	q.Set("offset", strconv.Itoa(end))
+	return f.URL + r.URL.Path + "?" + q.Encode()
+}
+
+func (f *Server) servePlaylists(w http.ResponseWriter, r *http.Request) {
+	offset, end := pageBounds(r, len(f.playlists), 20)
+	items := []map[string]string{}
+	for _, p := range f.playlists[offset:end] {
+		items = append(items, map[string]string{"id": p.Id, "name": p.Name})
+	}
+	writeJSON(w, map[string]interface{}{
+		"items":  items,
+		"offset": offset,
+		"limit":  end - offset,
+		"total":  len(f.playlists),
+		"next":   f.nextPage(r, end, len(f.playlists)),
+	})
+}
+
+func (f *Server) servePlaylist(w http.ResponseWriter, r *http.Request, id string) {
+	p := f.findPlaylist(id)
+	if p == nil {
+		http.Error(w, `{"error":{"status":404}}`, http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, map[string]interface{}{
+			"id":          p.Id,
+			"name":        p.Name,
+			"description": p.Description,
+			"public":      p.Public,
+			"tracks":      map[string]int{"total": len(p.Tracks)},
+		})
+	case "PUT":
+		var body struct {
+			Name        *string `json:"name"`
+			Description *string `json:"description"`
+			Public      *bool   `json:"public"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Name != nil {
+			p.Name = *body.Name
+		}
+		if body.Description != nil {
+			p.Description = *body.Description
+		}
+		if body.Public != nil {
+			p.Public = *body.Public
+		}
+	case "DELETE":
+		for i, other := range f.playlists {
+			if other == p {
+				f.playlists = append(f.playlists[:i], f.playlists[i+1:]...)
+				break
+			}
+		}
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *Server) serveTracks(w http.ResponseWriter, r *http.Request, id string) {
+	p := f.findPlaylist(id)
+	if p == nil {
+		http.Error(w, `{"error":{"status":404}}`, http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		offset, end := pageBounds(r, len(p.Tracks), 100)
+		items := []map[string]interface{}{}
+		for _, trackId := range p.Tracks[offset:end] {
+			artists := []map[string]string{}
+			if artist := f.catalogue[trackId].Artist; artist != "" {
+				artists = append(artists, map[string]string{"name": artist})
+			}
+			track := map[string]interface{}{"id": trackId, "name": f.catalogue[trackId].Name, "artists": artists}
+			if r.URL.Query().Get("market") != "" {
+				f.markets = append(f.markets, r.URL.Query().Get("market"))
+				f.catalogue[trackId].playability(track)
+			}
+			items = append(items, map[string]interface{}{"track": track})
+		}
+		writeJSON(w, map[string]interface{}{
+			"items":  items,
+			"offset": offset,
+			"limit":  end - offset,
+			"total":  len(p.Tracks),
+			"next":   f.nextPage(r, end, len(p.Tracks)),
+		})
+	case "POST":
+		var body struct {
+			Uris     []string `json:"uris"`
+			Position *int     `json:"position"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if len(body.Uris) == 0 || len(body.Uris) > 100 {
+			http.Error(w, `{"error":{"status":400}}`, http.StatusBadRequest)
+			return
+		}
+		ids := []string{}
+		for _, uri := range body.Uris {
+			id := strings.TrimPrefix(uri, "spotify:track:")
+			if f.invalid[id] {
+				http.Error(w, `{"error":{"status":400,"message":"Invalid base62 id"}}`, http.StatusBadRequest)
+				return
+			}
+			ids = append(ids, id)
+		}
+		position := len(p.Tracks)
+		if body.Position != nil && *body.Position < position {
+			position = *body.Position
+		}
+		p.Tracks = append(p.Tracks[:position], append(ids, p.Tracks[position:]...)...)
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, map[string]string{"snapshot_id": "snapshot"})
+	case "DELETE":
+		var body struct {
+			Tracks []struct {
+				Uri       string `json:"uri"`
+				Positions []int  `json:"positions"`
+			} `json:"tracks"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		// positions are where tracks were before any of them came out
+		gone := map[int]bool{}
+		for _, t := range body.Tracks {
+			trackId := strings.TrimPrefix(t.Uri, "spotify:track:")
+			positions := map[int]bool{}
+			for _, pos := range t.Positions {
+				positions[pos] = true
+			}
+			for i, other := range p.Tracks {
+				if other == trackId && (len(positions) == 0 || positions[i]) {
+					gone[i] = true
+				}
+			}
+		}
+		kept := []string{}
+		for i, other := range p.Tracks {
+			if !gone[i] {
+				kept = append(kept, other)
+			}
+		}
+		p.Tracks = kept
+		writeJSON(w, map[string]string{"snapshot_id": "snapshot"})
+	case "PUT":
+		var body struct {
+			RangeStart   int `json:"range_start"`
+			InsertBefore int `json:"insert_before"`
+			RangeLength  int `json:"range_length"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.RangeLength == 0 {
+			body.RangeLength = 1
+		}
+		moved := append([]string(nil), p.Tracks[body.RangeStart:body.RangeStart+body.RangeLength]...)
+		rest := append(append([]string(nil), p.Tracks[:body.RangeStart]...), p.Tracks[body.RangeStart+body.RangeLength:]...)
+		insert := body.InsertBefore
+		if insert > body.RangeStart {
+			insert -= body.RangeLength
+		}
+		p.Tracks = append(rest[:insert], append(moved, rest[insert:]...)...)
+		writeJSON(w, map[string]string{"snapshot_id": "snapshot"})
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveSearch matches every word of q against track names and artists.
+// With a market, only tracks that can be played there are found.
+func (f *Server) serveSearch(w http.ResponseWriter, r *http.Request) {
+	words := strings.Fields(strings.ToLower(searchTerms(r.URL.Query().Get("q"))))
+	market := r.URL.Query().Get("market")
+	if market != "" {
+		f.markets = append(f.markets, market)
+	}
+	matches := []map[string]interface{}{}
+	for _, t := range f.catalogue {
+		if market != "" && t.Restricted != "" {
+			continue
+		}
+		haystack := strings.ToLower(t.Name + " " + t.Artist + " " + t.ISRC)
+		found := true
+		for _, word := range words {
+			if !strings.Contains(haystack, word) {
+				found = false
+				break
+			}
+		}
+		if found {
+			matches = append(matches, t.json())
+		}
+	}
+	offset, end := pageBounds(r, len(matches), 20)
+	writeJSON(w, map[string]interface{}{
+		"tracks": map[string]interface{}{
+			"items":  matches[offset:end],
+			"offset": offset,
+			"total":  len(matches),
+		},
+	})
+}
+
+// the track as the API describes it
+func (t track) json() map[string]interface{} {
+	return map[string]interface{}{
+		"id":           t.Id,
+		"name":         t.Name,
+		"artists":      []map[string]string{{"id": artistId(t.Artist), "name": t.Artist}},
+		"external_ids": map[string]string{"isrc": t.ISRC},
+		"explicit":     t.Explicit,
+		"album": map[string]interface{}{
+			"name":         t.Album,
+			"album_type":   t.AlbumType,
+			"release_date": t.ReleaseDate,
+			"images":       []map[string]interface{}{{"url": t.Cover, "width": 300, "height": 300}},
+		},
+	}
+}
+
+// adds what a request with a market gets told about playing the track
+func (t track) playability(track map[string]interface{}) {
+	track["is_playable"] = t.Restricted == ""
+	if t.Restricted != "" {
+		track["restrictions"] = map[string]string{"reason": t.Restricted}
+	}
+}
+
+// searchTerms drops field filters like "artist:" from a search query
+func searchTerms(q string) string {
+	q, _ = url.QueryUnescape(q)
+	for _, field := range []string{"artist:", "track:", "album:", "isrc:"} {
+		q = strings.Replace(q, field, "", -1)
+	}
+	return q
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
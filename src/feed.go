@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	// the docker image has no zoneinfo of its own
+	_ "time/tzdata"
+)
+
+// the station the feed belongs to, as it shows up in the history
+var stationCallsign = "CHDI"
+
+// the player lists the last few songs next to what's playing now
+var sonicRecentlyPlayedURL = "https://player.rogersradio.ca/chdi/widget/recently_played"
+
+// the feed gives local times, this says whose
+var stationTimeZone = loadTimeZone(envOr("STATION_TZ", "America/Edmonton"))
+
+func loadTimeZone(name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		fmt.Println(err.Error())
+		return time.UTC
+	}
+	return location
+}
+
+// splits "Artist - Title" apart. Only the first " - " counts, titles like
+// "Song - Remastered" keep the rest.
+func splitSongTitle(songTitle string) (string, string) {
+	parts := strings.SplitN(songTitle, " - ", 2)
+	if len(parts) < 2 {
+		return "", strings.TrimSpace(songTitle)
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+}
+
+var startedAtLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+}
+
+// reads the feed's start time, zero if it can't be made sense of
+func parseStartedAt(startedAt string) time.Time {
+	startedAt = strings.TrimSpace(startedAt)
+	for _, layout := range startedAtLayouts {
+		if t, err := time.ParseInLocation(layout, startedAt, stationTimeZone); err == nil {
+			return t
+		}
+	}
+	if seconds, err := strconv.ParseInt(startedAt, 10, 64); err == nil {
+		return time.Unix(seconds, 0)
+	}
+	return time.Time{}
+}
+
+// reads the feed's song length, given as "m:ss", "h:mm:ss" or seconds
+func parseLength(length string) time.Duration {
+	parts := strings.Split(strings.TrimSpace(length), ":")
+	total := 0
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return 0
+		}
+		total = total*60 + n
+	}
+	return time.Duration(total) * time.Second
+}
+
+// the songs the station played recently, oldest first. The player answers
+// with a bare list or one wrapped in an object.
+func getRecentlyPlayed() ([]SonicInfo, error) {
+	res, err := httpClient.Get(sonicRecentlyPlayedURL)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if err := checkResponse(res); err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	songs := []SonicInfo{}
+	if err := json.Unmarshal(body, &songs); err != nil {
+		wrapped := struct {
+			Items          []SonicInfo `json:"items"`
+			RecentlyPlayed []SonicInfo `json:"recently_played"`
+		}{}
+		if json.Unmarshal(body, &wrapped) != nil {
+			return nil, err
+		}
+		songs = append(wrapped.Items, wrapped.RecentlyPlayed...)
+	}
+
+	sortByStartedAt(songs)
+	return songs, nil
+}
+
+// puts songs in air order, leaving ones with no usable time where they are
+func sortByStartedAt(songs []SonicInfo) {
+	for i := 1; i < len(songs); i++ {
+		for j := i; j > 0; j-- {
+			a, b := parseStartedAt(songs[j-1].Started_at), parseStartedAt(songs[j].Started_at)
+			if a.IsZero() || b.IsZero() || !b.Before(a) {
+				break
+			}
+			songs[j-1], songs[j] = songs[j], songs[j-1]
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSplitSongTitle(t *testing.T) {
+	for songTitle, want := range map[string][2]string{
+		"The Killers - Mr. Brightside":       {"The Killers", "Mr. Brightside"},
+		"Blur - Song 2 - Remastered":         {"Blur", "Song 2 - Remastered"},
+		"  Arkells -   Knocking At The Door": {"Arkells", "Knocking At The Door"},
+		"Station ID":                         {"", "Station ID"},
+	} {
+		artist, title := splitSongTitle(songTitle)
+		if artist != want[0] || title != want[1] {
+			t.Errorf("splitSongTitle(%q) = %q, %q", songTitle, artist, title)
+		}
+	}
+}
+
+func TestParseStartedAt(t *testing.T) {
+	stationTimeZone = loadTimeZone("America/Edmonton")
+	local := time.Date(2021, 7, 1, 12, 34, 56, 0, stationTimeZone)
+
+	for startedAt, want := range map[string]time.Time{
+		"2021-07-01 12:34:56":       local,
+		"2021-07-01T12:34:56":       local,
+		"2021-07-01T18:34:56Z":      local,
+		"1625164496":                local,
+		"2021-07-01 12:34":          local.Add(-56 * time.Second),
+		"sometime in the afternoon": {},
+	} {
+		if got := parseStartedAt(startedAt); !got.Equal(want) {
+			t.Errorf("parseStartedAt(%q) = %s, want %s", startedAt, got, want)
+		}
+	}
+}
+
+func TestParseLength(t *testing.T) {
+	for length, want := range map[string]time.Duration{
+		"3:30":    3*time.Minute + 30*time.Second,
+		"1:02:03": time.Hour + 2*time.Minute + 3*time.Second,
+		"215":     215 * time.Second,
+		"":        0,
+		"3:xx":    0,
+	} {
+		if got := parseLength(length); got != want {
+			t.Errorf("parseLength(%q) = %s, want %s", length, got, want)
+		}
+	}
+}
+
+func TestGetRecentlyPlayedPutsSongsInAirOrder(t *testing.T) {
+	env := newTestEnv(t)
+	env.station.played(
+		songAt("C - Three", "track3", "2021-07-01 12:10:00"),
+		songAt("A - One", "track1", "2021-07-01 12:00:00"),
+		songAt("B - Two", "track2", "2021-07-01 12:05:00"),
+	)
+
+	songs, err := getRecentlyPlayed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, info := range songs {
+		got = append(got, info.Spotify)
+	}
+	if !sameTracks(got, []string{"track1", "track2", "track3"}) {
+		t.Errorf("recently played in order %v", got)
+	}
+
+	env.station.fail(http.StatusNotFound)
+	if _, err := getRecentlyPlayed(); err == nil {
+		t.Errorf("a 404 wasn't an error")
+	}
+}
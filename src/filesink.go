@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// where the file sink keeps its playlists, and in which of m3u or xspf
+var playlistDir = envOr("PLAYLIST_DIR", dataDir)
+var playlistFormat = envOr("PLAYLIST_FORMAT", "m3u")
+
+// fileSink keeps playlists as M3U or XSPF files that any player can open.
+// A playlist's ID is the path of its file, a track's is its location line.
+type fileSink struct {
+	name   string
+	dir    string
+	format string
+	// where a newly added song is played from, its Spotify link when nil
+	locate func(song Song) string
+}
+
+func newFileSink() *fileSink {
+	return &fileSink{name: "file", dir: playlistDir, format: playlistFormat}
+}
+
+func (s *fileSink) Name() string {
+	return s.name
+}
+
+// makes an empty playlist file if there isn't one
+func (s *fileSink) EnsurePlaylist(name string) (string, error) {
+	if s.format != "m3u" && s.format != "xspf" {
+		return "", fmt.Errorf("unknown PLAYLIST_FORMAT %q, use m3u or xspf", s.format)
+	}
+	path := filepath.Join(s.dir, playlistFileName(name)+"."+s.format)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	return path, s.write(path, fmt.Sprintf("create playlist %q", name), nil)
+}
+
+// reads the file back, a missing one is empty
+func (s *fileSink) List(playlistId string) ([]SinkTrack, error) {
+	data, err := ioutil.ReadFile(playlistId)
+	if os.IsNotExist(err) {
+		return []SinkTrack{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(playlistId, ".xspf") {
+		return readXSPF(data)
+	}
+	return readM3U(data), nil
+}
+
+func (s *fileSink) Add(playlistId string, songs []Song) error {
+	tracks, err := s.List(playlistId)
+	if err != nil {
+		return err
+	}
+	for _, song := range songs {
+		tracks = append(tracks, SinkTrack{Song: song})
+	}
+	return s.write(playlistId, fmt.Sprintf("add %d song(s) to %s", len(songs), playlistId), tracks)
+}
+
+func (s *fileSink) Remove(playlistId string, tracks []SinkTrack) error {
+	gone := map[string]bool{}
+	for _, track := range tracks {
+		gone[track.Id] = true
+	}
+	existing, err := s.List(playlistId)
+	if err != nil {
+		return err
+	}
+	kept := []SinkTrack{}
+	for _, track := range existing {
+		if !gone[track.Id] {
+			kept = append(kept, track)
+		}
+	}
+	return s.write(playlistId, fmt.Sprintf("remove %d track(s) from %s", len(existing)-len(kept), playlistId), kept)
+}
+
+// replaces the playlist file in one go, so a crash midway leaves the old one.
+// A dry run only notes what it would have written.
+func (s *fileSink) write(path string, action string, tracks []SinkTrack) error {
+	entries := []playlistEntry{}
+	for _, track := range tracks {
+		entry := track.Song.entry()
+		// tracks already in the file keep where they were played from
+		if track.Id != "" && track.Id != entry.displayName() {
+			entry.Location = track.Id
+		} else if track.Id == "" && s.locate != nil {
+			entry.Location = s.locate(track.Song)
+		}
+		entries = append(entries, entry)
+	}
+	var out bytes.Buffer
+	var err error
+	if strings.HasSuffix(path, ".xspf") {
+		name := strings.TrimSuffix(filepath.Base(path), ".xspf")
+		err = writeXSPF(&out, name, entries)
+	} else {
+		err = writeM3U(&out, entries)
+	}
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		recordDryRun(action, "WRITE", path, nil)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, out.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// the song as a line in a playlist file
+func (s Song) entry() playlistEntry {
+	return playlistEntry{
+		Artist:   s.Artist,
+		Title:    s.Title,
+		Duration: s.Duration,
+		Location: spotifyLocation(s.SpotifyId),
+		AiredAt:  s.AiredAt,
+	}
+}
+
+// a playlist name with the characters file systems object to taken out
+func playlistFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// reads back what writeM3U wrote, and copes with plain lists of locations
+func readM3U(data []byte) []SinkTrack {
+	tracks := []SinkTrack{}
+	name, seconds := "", -1
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#EXTINF:") {
+			info := strings.SplitN(strings.TrimPrefix(line, "#EXTINF:"), ",", 2)
+			seconds, _ = strconv.Atoi(info[0])
+			if len(info) == 2 {
+				name = info[1]
+			}
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if name == "" {
+			name = line
+		}
+		song := Song{SpotifyId: spotifyIdOf(line)}
+		song.Artist, song.Title = splitSongTitle(name)
+		if seconds > 0 {
+			song.Duration = time.Duration(seconds) * time.Second
+		}
+		tracks = append(tracks, SinkTrack{Id: line, Song: song})
+		name, seconds = "", -1
+	}
+	return tracks
+}
+
+// reads back what writeXSPF wrote
+func readXSPF(data []byte) ([]SinkTrack, error) {
+	playlist := xspfPlaylist{}
+	if err := xml.Unmarshal(data, &playlist); err != nil {
+		return nil, err
+	}
+	tracks := []SinkTrack{}
+	for _, t := range playlist.Tracks {
+		song := Song{
+			Artist:    t.Creator,
+			Title:     t.Title,
+			Duration:  time.Duration(t.Duration) * time.Millisecond,
+			SpotifyId: spotifyIdOf(t.Location),
+		}
+		if aired, err := time.Parse(time.RFC3339, strings.TrimPrefix(t.Annotation, "Aired ")); err == nil {
+			song.AiredAt = aired
+		}
+		id := t.Location
+		if id == "" {
+			id = song.entry().displayName()
+		}
+		tracks = append(tracks, SinkTrack{Id: id, Song: song})
+	}
+	return tracks, nil
+}
+
+// the track ID in an open.spotify.com link, empty for anything else
+func spotifyIdOf(location string) string {
+	const prefix = "https://open.spotify.com/track/"
+	if !strings.HasPrefix(location, prefix) {
+		return ""
+	}
+	return strings.SplitN(strings.TrimPrefix(location, prefix), "?", 2)[0]
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileSinkRoundTrips(t *testing.T) {
+	aired := time.Date(2021, 7, 1, 8, 0, 0, 0, time.UTC)
+	songs := []Song{
+		{Artist: "A", Title: "One", Duration: 210 * time.Second, SpotifyId: "track1", AiredAt: aired},
+		{Artist: "Local", Title: "Demo", Duration: 95 * time.Second, AiredAt: aired},
+	}
+
+	for _, format := range []string{"m3u", "xspf"} {
+		sink := &fileSink{dir: t.TempDir(), format: format}
+		playlistId, err := sink.EnsurePlaylist("SONiC: On Demand")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Base(playlistId) != "SONiC_ On Demand."+format {
+			t.Errorf("%s playlist is at %s", format, playlistId)
+		}
+		if tracks, err := sink.List(playlistId); err != nil || len(tracks) != 0 {
+			t.Errorf("new %s playlist lists %v, %v", format, tracks, err)
+		}
+
+		if err := sink.Add(playlistId, songs); err != nil {
+			t.Fatal(err)
+		}
+		tracks, err := sink.List(playlistId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tracks) != 2 {
+			t.Fatalf("%s playlist has %d tracks", format, len(tracks))
+		}
+		for i, track := range tracks {
+			want := songs[i]
+			if track.Artist != want.Artist || track.Title != want.Title || track.Duration != want.Duration || track.SpotifyId != want.SpotifyId {
+				t.Errorf("%s track %d read back as %+v, want %+v", format, i, track.Song, want)
+			}
+		}
+
+		if err := sink.Remove(playlistId, tracks[:1]); err != nil {
+			t.Fatal(err)
+		}
+		if tracks, _ = sink.List(playlistId); len(tracks) != 1 || tracks[0].Title != "Demo" {
+			t.Errorf("%s playlist has %+v after removing the first track", format, tracks)
+		}
+	}
+}
+
+func TestFileSinkRejectsUnknownFormats(t *testing.T) {
+	sink := &fileSink{dir: t.TempDir(), format: "pls"}
+	if _, err := sink.EnsurePlaylist("SONiC On Demand"); err == nil {
+		t.Errorf("made a pls playlist")
+	}
+}
+
+func TestFileOnlyRunsWithoutLogin(t *testing.T) {
+	env := newTestEnv(t)
+	enabledSinks = "file"
+	env.station.play(song("A - One", "track1"), song("Local - Demo", ""), song("A - One", "track1"))
+
+	if err := startSession(nil); err != nil {
+		t.Fatal(err)
+	}
+	startTasks(nil)
+
+	path := filepath.Join(playlistDir, "SONiC On Demand.m3u")
+	want := "#EXTM3U\n#EXTINF:210,A - One\nhttps://open.spotify.com/track/track1\n#EXTINF:210,Local - Demo\nLocal - Demo\n"
+	waitFor(t, "both songs in the file", func() bool {
+		data, _ := ioutil.ReadFile(path)
+		return string(data) == want
+	})
+	if n := len(env.spotify.Requests()); n != 0 {
+		t.Errorf("made %d requests to Spotify without it as a sink", n)
+	}
+
+	data, _ := ioutil.ReadFile(path)
+	if strings.Count(string(data), "track1") != 1 {
+		t.Errorf("repeat airing went in twice:\n%s", data)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// whether to keep a playlist per genre bucket, and the buckets: "Name: term,
+// term; Name: ...". A Spotify genre goes in the bucket with the longest term
+// in it, so "indie rock" goes under "indie rock" before "rock".
+var genresEnabled = envOr("GENRE_PLAYLISTS", "") == "true"
+var genreBuckets = envOr("GENRE_BUCKETS", "Alt Rock: alternative, rock, grunge, punk; Indie: indie; Pop: pop; Hip Hop: hip hop, rap; Electronic: electronic, edm, house, electro")
+
+// the bucket for tracks whose artists have no genres, or none in a bucket
+const unsortedGenre = "Unsorted"
+
+type genreBucket struct {
+	name  string
+	terms []string
+}
+
+// reads buckets in the form GENRE_BUCKETS takes
+func parseGenreBuckets(spec string) ([]genreBucket, error) {
+	buckets := []genreBucket{}
+	for _, part := range strings.Split(spec, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		nameAndTerms := strings.SplitN(part, ":", 2)
+		if len(nameAndTerms) != 2 || strings.TrimSpace(nameAndTerms[0]) == "" {
+			return nil, fmt.Errorf("bucket %q needs a name, then a colon and its genres", strings.TrimSpace(part))
+		}
+		bucket := genreBucket{name: strings.TrimSpace(nameAndTerms[0])}
+		if bucket.name == unsortedGenre {
+			return nil, fmt.Errorf("%s is kept for tracks in no bucket", unsortedGenre)
+		}
+		for _, term := range strings.Split(nameAndTerms[1], ",") {
+			if term = strings.ToLower(strings.TrimSpace(term)); term != "" {
+				bucket.terms = append(bucket.terms, term)
+			}
+		}
+		if len(bucket.terms) == 0 {
+			return nil, fmt.Errorf("bucket %q has no genres", bucket.name)
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+// whether term is whole words of genre, so "rock" is in "indie rock" but not
+// in "rockabilly"
+func genreHas(genre string, term string) bool {
+	return strings.Contains(" "+genre+" ", " "+term+" ")
+}
+
+// the bucket a track goes in: each genre of its artists is a vote for the
+// bucket it fits best, and the most votes wins, the earlier bucket on a tie
+func bucketFor(buckets []genreBucket, genres []string) string {
+	votes := map[string]int{}
+	for _, genre := range genres {
+		genre = strings.ToLower(genre)
+		best, longest := "", 0
+		for _, bucket := range buckets {
+			for _, term := range bucket.terms {
+				if len(term) > longest && genreHas(genre, term) {
+					best, longest = bucket.name, len(term)
+				}
+			}
+		}
+		if best != "" {
+			votes[best]++
+		}
+	}
+
+	winner := unsortedGenre
+	for _, bucket := range buckets {
+		if votes[bucket.name] > votes[winner] {
+			winner = bucket.name
+		}
+	}
+	return winner
+}
+
+// a playlist for each bucket and one for the rest, which only songs on
+// Spotify can go in
+func genrePlaylists(client *http.Client) ([]derivedPlaylist, error) {
+	if !genresEnabled {
+		return nil, nil
+	}
+	if client == nil {
+		return nil, fmt.Errorf("genre playlists need Spotify's artist genres, add spotify to SINKS")
+	}
+	buckets, err := parseGenreBuckets(genreBuckets)
+	if err != nil {
+		return nil, fmt.Errorf("GENRE_BUCKETS: %s", err.Error())
+	}
+	cache, err := openTrackCache(client)
+	if err != nil {
+		return nil, err
+	}
+	cache.wantGenres()
+
+	names := []string{}
+	for _, bucket := range buckets {
+		names = append(names, bucket.name)
+	}
+	playlists := []derivedPlaylist{}
+	for _, name := range append(names, unsortedGenre) {
+		name := name
+		playlists = append(playlists, derivedPlaylist{
+			name: derivedPlaylistPrefix + name,
+			fits: func(song Song) bool {
+				genres, known := cache.songGenres(song)
+				return known && bucketFor(buckets, genres) == name
+			},
+		})
+	}
+	return playlists, nil
+}
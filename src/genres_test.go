@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBucketForVotesByBestTerm(t *testing.T) {
+	buckets, err := parseGenreBuckets(genreBuckets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		genres []string
+		want   string
+	}{
+		{[]string{"indie rock", "canadian indie"}, "Indie"},
+		{[]string{"modern alternative rock", "permanent wave", "dance pop", "pop"}, "Pop"},
+		// a tie goes to the earlier bucket
+		{[]string{"modern alternative rock", "pop"}, "Alt Rock"},
+		{[]string{"Canadian Hip Hop"}, "Hip Hop"},
+		// whole words only
+		{[]string{"rockabilly"}, unsortedGenre},
+		{nil, unsortedGenre},
+	} {
+		if got := bucketFor(buckets, c.genres); got != c.want {
+			t.Errorf("bucketFor(%q) = %q, want %q", c.genres, got, c.want)
+		}
+	}
+
+	for _, spec := range []string{"Rock rock", "Rock:", "Unsorted: misc"} {
+		if _, err := parseGenreBuckets(spec); err == nil {
+			t.Errorf("parseGenreBuckets(%q) gave no error", spec)
+		}
+	}
+}
+
+func TestGenrePlaylistsSplitByArtistGenres(t *testing.T) {
+	env := newTestEnv(t)
+	oldEnabled, oldPath := genresEnabled, trackCachePath
+	defer func() { genresEnabled, trackCachePath = oldEnabled, oldPath }()
+	genresEnabled, trackCachePath = true, filepath.Join(t.TempDir(), "tracks.json")
+
+	env.spotify.AddTrack("t1", "One", "Arcade Fire")
+	env.spotify.SetGenres("Arcade Fire", "canadian indie", "indie rock", "permanent wave")
+	env.spotify.AddTrack("t2", "Two", "Foo Fighters")
+	env.spotify.SetGenres("Foo Fighters", "alternative rock", "modern rock", "post-grunge")
+	env.spotify.AddTrack("t3", "Three", "Local Band")
+	env.spotify.AddTrack("t4", "Four", "Arcade Fire")
+	env.station.played(
+		songAt("Arcade Fire - One", "t1", "2021-07-01 12:00:00"),
+		songAt("Foo Fighters - Two", "t2", "2021-07-01 12:04:00"),
+		songAt("Local Band - Three", "t3", "2021-07-01 12:08:00"),
+		songAt("Arcade Fire - Four", "t4", "2021-07-01 12:12:00"),
+	)
+
+	env.login(t)
+
+	for name, want := range map[string][]string{
+		"SONiC – Indie":    {"t1", "t4"},
+		"SONiC – Alt Rock": {"t2"},
+		"SONiC – Unsorted": {"t3"},
+		"SONiC – Pop":      {},
+	} {
+		waitFor(t, name, func() bool {
+			p := env.spotify.Playlist(name)
+			return p != nil && sameTracks(tracksOf(p), want)
+		})
+	}
+	if tracks, artists := env.spotify.Count("GET /v1/tracks"), env.spotify.Count("GET /v1/artists"); tracks != 1 || artists != 1 {
+		t.Errorf("looked tracks up %d times and artists %d times, want once each", tracks, artists)
+	}
+
+	cache := newTrackCache(nil, trackCachePath)
+	if err := cache.load(); err != nil {
+		t.Fatal(err)
+	}
+	if genres, known, err := cache.trackGenres("t3"); err != nil || !known || len(genres) != 0 {
+		t.Errorf("cached genres for t3 are %q, %v, %v", genres, known, err)
+	}
+	// nothing new to look up, so nothing to write
+	os.Remove(trackCachePath)
+	if err := cache.fetch([]string{"t1", "t2", "t3", "t4"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(trackCachePath); !os.IsNotExist(err) {
+		t.Errorf("saved the cache with nothing new in it")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// every airing the app has seen and what became of it, one JSON object per
+// line. Empty keeps the history in memory.
+var historyPath = filepath.Join(dataDir, "history.jsonl")
+
+// what became of an airing
+const (
+	statusAdded        = "added"
+	statusDuplicate    = "duplicate"
+	statusNotOnSpotify = "not_on_spotify"
+	// Spotify has it, but not playable in the user's market
+	statusUnplayable = "unplayable"
+	// no playlist could place it
+	statusUnmatched = "unmatched"
+	statusError     = "error"
+)
+
+// where an airing was heard about
+const (
+	sourcePoll     = "poll"
+	sourceBackfill = "backfill"
+)
+
+type HistoryRecord struct {
+	Station   string    `json:"station"`
+	SongTitle string    `json:"song_title"`
+	Artist    string    `json:"artist"`
+	Title     string    `json:"title"`
+	StartedAt time.Time `json:"started_at"`
+	// the start time as the feed gave it, which is what tells airings apart
+	RawStartedAt string `json:"raw_started_at"`
+	// in seconds
+	Length    int    `json:"length"`
+	SpotifyId string `json:"spotify_id,omitempty"`
+	// the track the feed linked or the search found, when a preferred
+	// release of the song replaced it
+	ReplacedSpotifyId string `json:"replaced_spotify_id,omitempty"`
+	// from Spotify's track, when a sink or MusicBrainz matches by it
+	ISRC string `json:"isrc,omitempty"`
+	// what MusicBrainz knows of the recording, empty when it didn't find it
+	// and missing until it's been asked
+	MusicBrainz *musicBrainzInfo `json:"musicbrainz,omitempty"`
+	// the show in the schedule it aired in, if any
+	Show string `json:"show,omitempty"`
+	// "sink:id" of each playlist it was added to
+	Playlists  []string  `json:"playlists,omitempty"`
+	Status     string    `json:"status"`
+	Source     string    `json:"source"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// builds the record for something the feed said was on air
+func newHistoryRecord(info SonicInfo, source string) HistoryRecord {
+	artist, title := splitSongTitle(info.Song_title)
+	startedAt := parseStartedAt(info.Started_at)
+	show, _ := showAt(startedAt)
+	return HistoryRecord{
+		Station:      stationCallsign,
+		SongTitle:    info.Song_title,
+		Artist:       artist,
+		Title:        title,
+		StartedAt:    startedAt,
+		RawStartedAt: info.Started_at,
+		Length:       int(parseLength(info.Length).Seconds()),
+		SpotifyId:    info.Spotify,
+		Show:         show,
+		Source:       source,
+	}
+}
+
+// identifies one airing of a song
+func (r HistoryRecord) key() string {
+	return strings.Join([]string{r.Station, r.RawStartedAt, r.SongTitle}, "|")
+}
+
+// whether the airing never made it into the playlist, and might yet
+func (r HistoryRecord) unresolved() bool {
+	return r.Status == statusNotOnSpotify || r.Status == statusUnmatched || r.Status == statusError
+}
+
+// when the airing started, falling back to when it was seen
+func (r HistoryRecord) airedAt() time.Time {
+	if r.StartedAt.IsZero() {
+		return r.RecordedAt
+	}
+	return r.StartedAt
+}
+
+// the latest record for each airing, in the order they were first seen
+var history struct {
+	sync.Mutex
+	records []HistoryRecord
+	index   map[string]int
+}
+
+// reads the history file, later records for an airing replacing earlier ones
+func loadHistory() error {
+	history.Lock()
+	defer history.Unlock()
+
+	history.records = nil
+	history.index = map[string]int{}
+	if historyPath == "" {
+		return nil
+	}
+
+	file, err := os.Open(historyPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		record := HistoryRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("%s:%d: %s", historyPath, line, err.Error())
+		}
+		storeRecord(record)
+	}
+	return scanner.Err()
+}
+
+// keeps a record in memory, history must be locked
+func storeRecord(record HistoryRecord) {
+	if history.index == nil {
+		history.index = map[string]int{}
+	}
+	if i, ok := history.index[record.key()]; ok {
+		history.records[i] = record
+		return
+	}
+	history.index[record.key()] = len(history.records)
+	history.records = append(history.records, record)
+}
+
+// adds a record to the history, replacing any earlier one for the airing
+func appendHistory(record HistoryRecord) error {
+	if record.RecordedAt.IsZero() {
+		record.RecordedAt = clock.Now()
+	}
+
+	history.Lock()
+	defer history.Unlock()
+	return writeRecord(record)
+}
+
+// changes the record for an airing where it stands, so nothing written to it
+// in the meantime is lost the way reading it and appending would lose it
+func updateAiring(key string, change func(record *HistoryRecord)) error {
+	history.Lock()
+	defer history.Unlock()
+	i, ok := history.index[key]
+	if !ok {
+		return fmt.Errorf("no airing %s in the history", key)
+	}
+	record := history.records[i]
+	change(&record)
+	return writeRecord(record)
+}
+
+// keeps a record and adds it to the file, history must be locked
+func writeRecord(record HistoryRecord) error {
+	storeRecord(record)
+
+	// a dry run only pretended to add its songs, so it keeps what became of
+	// them to itself and a real run after it still adds them
+	if historyPath == "" || dryRun {
+		return nil
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(historyPath), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(historyPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// the record for an airing, if it's been seen
+func findAiring(key string) (HistoryRecord, bool) {
+	history.Lock()
+	defer history.Unlock()
+	if i, ok := history.index[key]; ok {
+		return history.records[i], true
+	}
+	return HistoryRecord{}, false
+}
+
+// a copy of the history, in the order airings were first seen
+func historyRecords() []HistoryRecord {
+	history.Lock()
+	defer history.Unlock()
+	return append([]HistoryRecord(nil), history.records...)
+}
+
+// forgets the history held in memory, for tests and replays
+func resetHistory() {
+	history.Lock()
+	defer history.Unlock()
+	history.records = nil
+	history.index = map[string]int{}
+}
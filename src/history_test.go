@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHistoryKeepsLatestRecordPerAiring(t *testing.T) {
+	newTestEnv(t)
+	historyPath = filepath.Join(t.TempDir(), "history.jsonl")
+
+	first := newHistoryRecord(songAt("Local - Demo", "", "2021-07-01 12:00:00"), sourcePoll)
+	first.Status = statusNotOnSpotify
+	second := newHistoryRecord(songAt("B - Two", "track2", "2021-07-01 12:05:00"), sourcePoll)
+	second.Status = statusAdded
+	resolved := first
+	resolved.SpotifyId, resolved.Status, resolved.Source = "track1", statusAdded, sourceBackfill
+
+	for _, record := range []HistoryRecord{first, second, resolved} {
+		if err := appendHistory(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, _ := ioutil.ReadFile(historyPath)
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Errorf("history file has %d lines, want every record appended", lines)
+	}
+
+	resetHistory()
+	if err := loadHistory(); err != nil {
+		t.Fatal(err)
+	}
+	records := historyRecords()
+	if len(records) != 2 {
+		t.Fatalf("loaded %d airings, want 2", len(records))
+	}
+	if records[0].SongTitle != "Local - Demo" || records[0].Status != statusAdded || records[0].SpotifyId != "track1" {
+		t.Errorf("first airing loaded as %+v, want the resolved record in its original place", records[0])
+	}
+	if records[0].Artist != "Local" || records[0].Title != "Demo" || records[0].Length != 210 {
+		t.Errorf("first airing wasn't parsed: %+v", records[0])
+	}
+
+	if _, ok := findAiring(second.key()); !ok {
+		t.Errorf("couldn't find the second airing")
+	}
+	if _, ok := findAiring(newHistoryRecord(songAt("B - Two", "track2", "2021-07-01 13:05:00"), sourcePoll).key()); ok {
+		t.Errorf("a later airing of the same song counted as the same airing")
+	}
+}
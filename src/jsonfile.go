@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// reads the JSON saved at path into v. An empty path or a missing file
+// leaves v as it was.
+func readJSONFile(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return nil
+}
+
+// saves v as JSON at path, replacing the file in one go so a crash midway
+// leaves the old one. An empty path keeps nothing.
+func writeJSONFile(path string, v interface{}) error {
+	return writeJSONFileMode(path, v, 0644)
+}
+
+// writeJSONFile with the file's permissions, 0600 for one only the app
+// should read
+func writeJSONFileMode(path string, v interface{}, perm os.FileMode) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// a left over file would keep its permissions
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a Last.fm API account from last.fm/api, and the profile to scrobble to:
+// either a session key, or the user's name and password to get one with
+var lastfmAPIKey = os.Getenv("LASTFM_API_KEY")
+var lastfmSecret = os.Getenv("LASTFM_SECRET")
+var lastfmSessionKey = os.Getenv("LASTFM_SESSION_KEY")
+var lastfmUser = os.Getenv("LASTFM_USER")
+var lastfmPassword = os.Getenv("LASTFM_PASSWORD")
+
+var lastfmAPIURL = "https://ws.audioscrobbler.com/2.0/"
+
+// Last.fm error codes worth telling apart
+const (
+	lastfmInvalidSession = 9
+	lastfmOffline        = 11
+	lastfmTemporaryError = 16
+	lastfmRateLimited    = 29
+)
+
+// lastfm scrobbles to a Last.fm profile
+type lastfm struct {
+	sessionKey string
+}
+
+// logs in with the user's password when there's no session key. Session
+// keys don't expire, so this only happens once a run.
+func newLastfm() (*lastfm, error) {
+	if lastfmSecret == "" {
+		return nil, fmt.Errorf("LASTFM_SECRET isn't set")
+	}
+	if lastfmSessionKey != "" {
+		return &lastfm{sessionKey: lastfmSessionKey}, nil
+	}
+	if lastfmUser == "" || lastfmPassword == "" {
+		return nil, fmt.Errorf("set LASTFM_SESSION_KEY, or LASTFM_USER and LASTFM_PASSWORD")
+	}
+
+	answer := struct {
+		Session struct {
+			Key string `json:"key"`
+		} `json:"session"`
+	}{}
+	err := lastfmCall(url.Values{
+		"method":   {"auth.getMobileSession"},
+		"username": {lastfmUser},
+		"password": {lastfmPassword},
+	}, &answer)
+	if err != nil {
+		return nil, err
+	}
+	return &lastfm{sessionKey: answer.Session.Key}, nil
+}
+
+func (l *lastfm) Name() string {
+	return "lastfm"
+}
+
+func (l *lastfm) BatchSize() int {
+	return 50
+}
+
+func (l *lastfm) NowPlaying(play scrobble) error {
+	params := url.Values{
+		"method": {"track.updateNowPlaying"},
+		"sk":     {l.sessionKey},
+		"artist": {play.Artist},
+		"track":  {play.Title},
+	}
+	if play.Duration > 0 {
+		params.Set("duration", strconv.Itoa(int(play.Duration.Seconds())))
+	}
+	return l.change("say "+play.Artist+" - "+play.Title+" is playing", params, nil)
+}
+
+func (l *lastfm) Scrobble(plays []scrobble) error {
+	params := url.Values{"method": {"track.scrobble"}, "sk": {l.sessionKey}}
+	for i, play := range plays {
+		n := "[" + strconv.Itoa(i) + "]"
+		params.Set("artist"+n, play.Artist)
+		params.Set("track"+n, play.Title)
+		params.Set("timestamp"+n, strconv.FormatInt(play.StartedAt.Unix(), 10))
+		// the station picked it, not the listener
+		params.Set("chosenByUser"+n, "0")
+		if play.Duration > 0 {
+			params.Set("duration"+n, strconv.Itoa(int(play.Duration.Seconds())))
+		}
+	}
+
+	answer := struct {
+		Scrobbles struct {
+			Attr struct {
+				Ignored int `json:"ignored"`
+			} `json:"@attr"`
+		} `json:"scrobbles"`
+	}{}
+	if err := l.change(fmt.Sprintf("scrobble %d play(s)", len(plays)), params, &answer); err != nil {
+		return err
+	}
+	if ignored := answer.Scrobbles.Attr.Ignored; ignored > 0 {
+		fmt.Printf("Last.fm ignored %d of %d scrobble(s)\n", ignored, len(plays))
+	}
+	return nil
+}
+
+// makes a call that logs something, or notes it in a dry run
+func (l *lastfm) change(action string, params url.Values, out interface{}) error {
+	if dryRun {
+		recordDryRun(action, "POST", lastfmAPIURL+"?method="+params.Get("method"), nil)
+		return nil
+	}
+	return lastfmCall(params, out)
+}
+
+// signs and posts a call, decoding the answer into out if given
+func lastfmCall(params url.Values, out interface{}) error {
+	params.Set("api_key", lastfmAPIKey)
+	params.Set("api_sig", lastfmSignature(params))
+	params.Set("format", "json")
+
+	res, err := httpClient.PostForm(lastfmAPIURL, params)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	// failures come with a code, whatever the HTTP status
+	failed := struct {
+		Error   int    `json:"error"`
+		Message string `json:"message"`
+	}{}
+	if json.Unmarshal(body, &failed) == nil && failed.Error != 0 {
+		return lastfmError(params.Get("method"), failed.Error, failed.Message)
+	}
+	if err := checkResponse(res); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// the md5 of every parameter but format and callback, sorted by name and
+// run together, then the secret
+func lastfmSignature(params url.Values) string {
+	names := []string{}
+	for name := range params {
+		if name != "format" && name != "callback" && name != "api_sig" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var signed strings.Builder
+	for _, name := range names {
+		signed.WriteString(name + params.Get(name))
+	}
+	signed.WriteString(lastfmSecret)
+	sum := md5.Sum([]byte(signed.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// the error as the status code the retry logic understands. A session key
+// Last.fm doesn't know was revoked, and no retry brings it back.
+func lastfmError(method string, code int, message string) error {
+	err := &apiError{
+		Method:     "Last.fm",
+		Path:       method,
+		Status:     fmt.Sprintf("%d: %s", code, message),
+		StatusCode: http.StatusBadRequest,
+	}
+	switch code {
+	case lastfmInvalidSession:
+		err.StatusCode = http.StatusUnauthorized
+		return loginRejected{err}
+	case lastfmOffline, lastfmTemporaryError:
+		err.StatusCode = http.StatusServiceUnavailable
+	case lastfmRateLimited:
+		err.StatusCode, err.RetryAfter = http.StatusTooManyRequests, time.Minute
+	}
+	return err
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLastfm checks each call is signed and keeps the plays it's sent
+type fakeLastfm struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	scrobbled  []scrobble
+	nowPlaying []string
+	logins     int
+	// error codes to answer the next scrobbles with
+	fail []int
+}
+
+func newFakeLastfm() *fakeLastfm {
+	f := &fakeLastfm{}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeLastfm) failNext(codes ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail = append(f.fail, codes...)
+}
+
+// "Artist - Title" of each play scrobbled
+func (f *fakeLastfm) plays() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	plays := []string{}
+	for _, play := range f.scrobbled {
+		plays = append(plays, play.Artist+" - "+play.Title)
+	}
+	return plays
+}
+
+func (f *fakeLastfm) playing() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.nowPlaying...)
+}
+
+func lastfmFailure(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, map[string]interface{}{"error": code, "message": message})
+}
+
+func (f *fakeLastfm) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r.ParseForm()
+	params := url.Values{}
+	for name, values := range r.PostForm {
+		params[name] = values
+	}
+	if params.Get("api_key") != "key" || params.Get("api_sig") != lastfmSignature(params) {
+		lastfmFailure(w, 13, "Invalid method signature supplied")
+		return
+	}
+
+	method := params.Get("method")
+	if method == "auth.getMobileSession" {
+		if params.Get("username") != "sonic" || params.Get("password") != "secret" {
+			lastfmFailure(w, 4, "Authentication Failed")
+			return
+		}
+		f.logins++
+		writeJSON(w, map[string]interface{}{"session": map[string]string{"name": "sonic", "key": "SESSION"}})
+		return
+	}
+	if params.Get("sk") != "SESSION" {
+		lastfmFailure(w, lastfmInvalidSession, "Invalid session key")
+		return
+	}
+	switch method {
+	case "track.updateNowPlaying":
+		f.nowPlaying = append(f.nowPlaying, params.Get("artist")+" - "+params.Get("track"))
+		writeJSON(w, map[string]interface{}{"nowplaying": map[string]interface{}{}})
+	case "track.scrobble":
+		if len(f.fail) > 0 {
+			code := f.fail[0]
+			f.fail = f.fail[1:]
+			lastfmFailure(w, code, "failed")
+			return
+		}
+		accepted := 0
+		for i := 0; params.Get("artist["+strconv.Itoa(i)+"]") != ""; i++ {
+			n := "[" + strconv.Itoa(i) + "]"
+			seconds, _ := strconv.ParseInt(params.Get("timestamp"+n), 10, 64)
+			f.scrobbled = append(f.scrobbled, scrobble{
+				Artist:    params.Get("artist" + n),
+				Title:     params.Get("track" + n),
+				StartedAt: time.Unix(seconds, 0),
+			})
+			accepted++
+		}
+		writeJSON(w, map[string]interface{}{"scrobbles": map[string]interface{}{"@attr": map[string]int{"accepted": accepted, "ignored": 0}}})
+	default:
+		lastfmFailure(w, 3, "Invalid Method")
+	}
+}
+
+// useLastfm points scrobbling at the fake, logging in with a password
+func useLastfm(t *testing.T) *fakeLastfm {
+	fake := newFakeLastfm()
+	oldURL, oldKey, oldSecret, oldSession := lastfmAPIURL, lastfmAPIKey, lastfmSecret, lastfmSessionKey
+	oldUser, oldPassword, oldDir, oldInterval := lastfmUser, lastfmPassword, scrobbleDir, scrobbleInterval
+	lastfmAPIURL, lastfmAPIKey, lastfmSecret, lastfmSessionKey = fake.URL, "key", "secret", ""
+	lastfmUser, lastfmPassword, scrobbleDir, scrobbleInterval = "sonic", "secret", "", 10*time.Millisecond
+	t.Cleanup(func() {
+		fake.Close()
+		lastfmAPIURL, lastfmAPIKey, lastfmSecret, lastfmSessionKey = oldURL, oldKey, oldSecret, oldSession
+		lastfmUser, lastfmPassword, scrobbleDir, scrobbleInterval = oldUser, oldPassword, oldDir, oldInterval
+	})
+	return fake
+}
+
+func TestLastfmSignature(t *testing.T) {
+	oldSecret := lastfmSecret
+	defer func() { lastfmSecret = oldSecret }()
+	lastfmSecret = "secret"
+
+	params := url.Values{
+		"api_key":      {"key"},
+		"method":       {"track.scrobble"},
+		"sk":           {"SESSION"},
+		"artist[0]":    {"A"},
+		"track[0]":     {"One"},
+		"timestamp[0]": {"1625155200"},
+		// never signed
+		"format": {"json"},
+	}
+	if got, want := lastfmSignature(params), "d9f6977345879b39eaec851304d06b6e"; got != want {
+		t.Errorf("signed %s, want %s", got, want)
+	}
+}
+
+func TestLastfmScrobblesAiringsOnceTheyQualify(t *testing.T) {
+	env := newTestEnv(t)
+	fake := useLastfm(t)
+	at := newFixedClock(time.Date(2021, 7, 1, 12, 5, 0, 0, stationTimeZone))
+	clock = at
+	enabledSinks = "file"
+	// One has been on long enough, Two only just started
+	env.station.play(songAt("A - One", "", "2021-07-01 12:00:00"), songAt("B - Two", "", "2021-07-01 12:04:30"))
+
+	if err := startSession(nil); err != nil {
+		t.Fatal(err)
+	}
+	startTasks(nil)
+
+	waitFor(t, "Two as now playing", func() bool { return sameTracks(fake.playing(), []string{"B - Two"}) })
+	waitFor(t, "One scrobbled", func() bool { return sameTracks(fake.plays(), []string{"A - One"}) })
+
+	// half of Two's 3:30 has gone by
+	at.set(time.Date(2021, 7, 1, 12, 6, 15, 0, stationTimeZone))
+	waitFor(t, "Two scrobbled", func() bool { return sameTracks(fake.plays(), []string{"A - One", "B - Two"}) })
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if want := time.Date(2021, 7, 1, 12, 4, 30, 0, stationTimeZone); !fake.scrobbled[1].StartedAt.Equal(want) {
+		t.Errorf("Two scrobbled at %s, want when it started", fake.scrobbled[1].StartedAt)
+	}
+	if fake.logins != 1 || len(fake.nowPlaying) != 1 {
+		t.Errorf("logged in %d times and sent now playing %d times", fake.logins, len(fake.nowPlaying))
+	}
+}
+
+func TestFailedScrobblesAreKeptAndRetried(t *testing.T) {
+	newTestEnv(t)
+	fake := useLastfm(t)
+	scrobbleDir = t.TempDir()
+	now := clock.Now()
+	airing := func(title string, ago time.Duration) HistoryRecord {
+		artist, songTitle := splitSongTitle(title)
+		return HistoryRecord{SongTitle: title, Artist: artist, Title: songTitle, StartedAt: now.Add(-ago), RawStartedAt: now.Add(-ago).String(), Length: 210}
+	}
+	// from before scrobbling was set up, so never sent
+	appendHistory(airing("Old - Song", time.Hour))
+
+	service, err := newLastfm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newScrobbler(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendHistory(airing("A - One", 30*time.Minute))
+	appendHistory(airing("Too - Late", 15*24*time.Hour))
+	fake.failNext(lastfmTemporaryError)
+	s.check()
+	if err := s.flush(); err == nil || !retryable(err) {
+		t.Fatalf("flush gave %v, want an error worth retrying", err)
+	}
+
+	// a restart picks up where it left off
+	s, err = newScrobbler(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.pendingLen(); n != 1 {
+		t.Fatalf("%d scrobble(s) pending after a restart, want 1", n)
+	}
+	s.check()
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if plays := fake.plays(); !sameTracks(plays, []string{"A - One"}) {
+		t.Errorf("scrobbled %v", plays)
+	}
+
+	// Last.fm won't ever take a bad one, so it doesn't hold up the next
+	appendHistory(airing("B - Two", 10*time.Minute))
+	fake.failNext(6)
+	s.check()
+	if err := s.flush(); err != nil {
+		t.Errorf("a rejected scrobble gave %v", err)
+	}
+	appendHistory(airing("C - Three", 5*time.Minute))
+	s.check()
+	s.flush()
+	if plays := fake.plays(); !sameTracks(plays, []string{"A - One", "C - Three"}) {
+		t.Errorf("scrobbled %v", plays)
+	}
+}
+
+func TestRevokedLastfmSessionKeepsScrobbles(t *testing.T) {
+	newTestEnv(t)
+	fake := useLastfm(t)
+	scrobbleDir = t.TempDir()
+	lastfmSessionKey = "REVOKED"
+
+	service, err := newLastfm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newScrobbler(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := clock.Now()
+	appendHistory(HistoryRecord{SongTitle: "A - One", Artist: "A", Title: "One", StartedAt: now.Add(-30 * time.Minute), RawStartedAt: now.String(), Length: 210})
+	s.check()
+
+	err = s.flush()
+	if _, ok := err.(loginRejected); !ok || retryable(err) {
+		t.Errorf("a revoked session gave %v, want the login rejected for good", err)
+	}
+	if n := s.pendingLen(); n != 1 {
+		t.Errorf("%d scrobble(s) kept after the login was rejected, want 1", n)
+	}
+
+	// set again and restarted, the kept play goes
+	lastfmSessionKey = "SESSION"
+	if service, err = newLastfm(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = newScrobbler(service); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if plays := fake.plays(); !sameTracks(plays, []string{"A - One"}) {
+		t.Errorf("scrobbled %v", plays)
+	}
+}
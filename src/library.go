@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a directory of music files to match aired songs against, for the library
+// sink
+var musicDir = envOr("MUSIC_DIR", "")
+
+// the tags read from musicDir, so a restart doesn't read every file again.
+// Empty keeps the index in memory.
+var libraryIndexPath = filepath.Join(dataDir, "library.json")
+
+// how often musicDir is checked for new, changed and deleted files
+var libraryRescan = 10 * time.Minute
+
+// the extensions worth reading tags from
+var musicExtensions = map[string]bool{".mp3": true, ".flac": true, ".m4a": true, ".mp4": true, ".aac": true}
+
+// libraryFile is one music file in the index
+type libraryFile struct {
+	Path     string        `json:"path"`
+	Artist   string        `json:"artist"`
+	Title    string        `json:"title"`
+	Duration time.Duration `json:"duration"`
+	// a file is read again when either changes
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// catalogue is a searchable index of a music directory
+type catalogue struct {
+	dir       string
+	indexPath string
+
+	mu     sync.Mutex
+	byPath map[string]libraryFile
+	// paths by songKey
+	byKey map[string][]string
+}
+
+func newCatalogue(dir string, indexPath string) *catalogue {
+	return &catalogue{dir: dir, indexPath: indexPath, byPath: map[string]libraryFile{}, byKey: map[string][]string{}}
+}
+
+// reads the saved index, a missing one is empty
+func (c *catalogue) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	files := []libraryFile{}
+	if err := readJSONFile(c.indexPath, &files); err != nil {
+		return err
+	}
+	for _, file := range files {
+		c.byPath[file.Path] = file
+	}
+	c.reindex()
+	return nil
+}
+
+// writes the index out in one go, c must be locked
+func (c *catalogue) save() error {
+	if c.indexPath == "" {
+		return nil
+	}
+	files := []libraryFile{}
+	for _, file := range c.byPath {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return writeJSONFile(c.indexPath, files)
+}
+
+// rebuilds byKey from byPath, c must be locked
+func (c *catalogue) reindex() {
+	c.byKey = map[string][]string{}
+	for path, file := range c.byPath {
+		key := songKey(file.Artist, file.Title)
+		c.byKey[key] = append(c.byKey[key], path)
+	}
+	for _, paths := range c.byKey {
+		sort.Strings(paths)
+	}
+}
+
+// brings the index up to date with the directory, only reading files that
+// are new or have changed, and returns how many changed
+func (c *catalogue) scan() (int, error) {
+	seen := map[string]bool{}
+	read := map[string]libraryFile{}
+
+	c.mu.Lock()
+	known := c.byPath
+	c.mu.Unlock()
+
+	err := filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// an unreadable folder shouldn't stop the rest being indexed
+			fmt.Println(err.Error())
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !musicExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		relative, err := filepath.Rel(c.dir, path)
+		if err != nil {
+			return err
+		}
+		seen[relative] = true
+		if old, ok := known[relative]; ok && old.Size == info.Size() && old.ModTime.Equal(info.ModTime()) {
+			return nil
+		}
+
+		tags, err := readTags(path)
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+		if tags.Title == "" {
+			// untagged files are often named "Artist - Title"
+			tags.Artist, tags.Title = splitSongTitle(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+		}
+		read[relative] = libraryFile{
+			Path:     relative,
+			Artist:   tags.Artist,
+			Title:    tags.Title,
+			Duration: tags.Duration,
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed := len(read)
+	for path, file := range read {
+		c.byPath[path] = file
+	}
+	for path := range c.byPath {
+		if !seen[path] {
+			delete(c.byPath, path)
+			changed++
+		}
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+	c.reindex()
+	return changed, c.save()
+}
+
+// the file for a song, matched by the same artist and title normalisation
+// as the Spotify search
+func (c *catalogue) find(artist string, title string) (libraryFile, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	paths := c.byKey[songKey(artist, title)]
+	if len(paths) == 0 {
+		return libraryFile{}, false
+	}
+	return c.byPath[paths[0]], true
+}
+
+// how many files are indexed
+func (c *catalogue) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.byPath)
+}
+
+// librarySink keeps an M3U in the music directory of the aired songs that are
+// in it, pointing at the files
+type librarySink struct {
+	*fileSink
+	catalogue *catalogue
+}
+
+func newLibrarySink() (*librarySink, error) {
+	if musicDir == "" {
+		return nil, fmt.Errorf("the library sink needs MUSIC_DIR")
+	}
+	s := &librarySink{catalogue: newCatalogue(musicDir, libraryIndexPath)}
+	// the playlist sits in the music directory, so the paths in it are
+	// relative and still work when the directory is mounted somewhere else
+	s.fileSink = &fileSink{name: "library", dir: musicDir, format: "m3u", locate: s.locate}
+	if err := s.catalogue.load(); err != nil {
+		return nil, err
+	}
+	if _, err := s.catalogue.scan(); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Indexed %d file(s) in %s\n", s.catalogue.size(), musicDir)
+	return s, nil
+}
+
+// only songs with a file can go in
+func (s *librarySink) Accepts(song Song) bool {
+	_, ok := s.catalogue.find(song.Artist, song.Title)
+	return ok
+}
+
+func (s *librarySink) locate(song Song) string {
+	file, ok := s.catalogue.find(song.Artist, song.Title)
+	if !ok {
+		return ""
+	}
+	return filepath.ToSlash(file.Path)
+}
+
+// keeps the index up to date until ctx is cancelled
+func (s *librarySink) Run() {
+	done := ctx.Done()
+	ticker := clock.NewTicker(libraryRescan)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C():
+			changed, err := s.catalogue.scan()
+			if err != nil {
+				fmt.Println(err.Error())
+			} else if changed > 0 {
+				fmt.Printf("Library index updated, %d file(s) changed\n", changed)
+			}
+		}
+	}
+}
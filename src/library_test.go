@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useLibrary points the library sink at a new music directory
+func useLibrary(t *testing.T) string {
+	dir := t.TempDir()
+	oldDir, oldIndex, oldRescan := musicDir, libraryIndexPath, libraryRescan
+	musicDir, libraryIndexPath, libraryRescan = dir, filepath.Join(t.TempDir(), "library.json"), 10*time.Millisecond
+	t.Cleanup(func() {
+		musicDir, libraryIndexPath, libraryRescan = oldDir, oldIndex, oldRescan
+	})
+	return dir
+}
+
+func TestCatalogueFollowsTheDirectory(t *testing.T) {
+	dir := useLibrary(t)
+	os.MkdirAll(filepath.Join(dir, "A"), 0755)
+	writeFile(t, filepath.Join(dir, "A", "one.mp3"), mp3File("A", "One", "210000"))
+	writeFile(t, filepath.Join(dir, "Local - Demo.flac"), []byte("not really flac, no tags"))
+	writeFile(t, filepath.Join(dir, "cover.jpg"), []byte("jpeg"))
+
+	c := newCatalogue(dir, libraryIndexPath)
+	if changed, err := c.scan(); err != nil || changed != 2 {
+		t.Fatalf("first scan found %d files, %v", changed, err)
+	}
+	if file, ok := c.find("a", "One (Radio Edit)"); !ok || file.Path != filepath.Join("A", "one.mp3") {
+		t.Errorf("found %+v for A - One", file)
+	}
+	if _, ok := c.find("Local", "Demo"); !ok {
+		t.Errorf("untagged file wasn't found by its name")
+	}
+
+	// the saved index means nothing needs reading again
+	reloaded := newCatalogue(dir, libraryIndexPath)
+	if err := reloaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if changed, _ := reloaded.scan(); changed != 0 {
+		t.Errorf("rescan after a restart read %d unchanged files", changed)
+	}
+
+	os.Remove(filepath.Join(dir, "Local - Demo.flac"))
+	writeFile(t, filepath.Join(dir, "A", "one.mp3"), mp3File("A", "Won", "210000"))
+	os.Chtimes(filepath.Join(dir, "A", "one.mp3"), time.Now(), time.Now().Add(time.Minute))
+	if changed, _ := reloaded.scan(); changed != 2 {
+		t.Errorf("rescan saw %d changes, want a retag and a delete", changed)
+	}
+	if _, ok := reloaded.find("A", "One"); ok {
+		t.Errorf("still found the old tags")
+	}
+	if _, ok := reloaded.find("A", "Won"); !ok {
+		t.Errorf("didn't find the new tags")
+	}
+}
+
+func TestLibrarySinkKeepsAPlaylistOfOwnedSongs(t *testing.T) {
+	env := newTestEnv(t)
+	dir := useLibrary(t)
+	writeFile(t, filepath.Join(dir, "one.flac"), flacFile("A", "One", 200*time.Second))
+	writeFile(t, filepath.Join(dir, "three.m4a"), m4aFile("C", "Three", 180*time.Second))
+	enabledSinks = "library"
+	env.station.play(song("A - One", "track1"), song("B - Two", "track2"), song("C - Three", "track3"))
+
+	if err := startSession(nil); err != nil {
+		t.Fatal(err)
+	}
+	startTasks(nil)
+
+	// owned after the app started, picked up by the rescan
+	writeFile(t, filepath.Join(dir, "four.mp3"), mp3File("D", "Four", "200000"))
+	library := mainTarget("library").sink.(*librarySink)
+	waitFor(t, "the rescan", func() bool {
+		_, ok := library.catalogue.find("D", "Four")
+		return ok
+	})
+
+	path := filepath.Join(dir, "SONiC On Demand.m3u")
+	waitFor(t, "both owned songs", func() bool {
+		data, _ := ioutil.ReadFile(path)
+		return strings.Count(string(data), "#EXTINF") == 2
+	})
+	data, _ := ioutil.ReadFile(path)
+	if want := "#EXTM3U\n#EXTINF:210,A - One\none.flac\n#EXTINF:210,C - Three\nthree.m4a\n"; string(data) != want {
+		t.Errorf("playlist is\n%s\nwant\n%s", data, want)
+	}
+}
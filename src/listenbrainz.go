@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// the user token from the ListenBrainz settings page, and the server to send
+// listens to, which can be a self-hosted one
+var listenbrainzToken = os.Getenv("LISTENBRAINZ_TOKEN")
+var listenbrainzURL = strings.TrimSuffix(envOr("LISTENBRAINZ_URL", "https://api.listenbrainz.org"), "/")
+
+// listenBrainz submits airings as listens
+type listenBrainz struct {
+	client *http.Client
+}
+
+type listenBrainzListen struct {
+	ListenedAt    int64                `json:"listened_at,omitempty"`
+	TrackMetadata listenBrainzMetadata `json:"track_metadata"`
+}
+
+type listenBrainzMetadata struct {
+	ArtistName     string                 `json:"artist_name"`
+	TrackName      string                 `json:"track_name"`
+	AdditionalInfo map[string]interface{} `json:"additional_info"`
+}
+
+// checks the token before anything is sent with it
+func newListenBrainz() (*listenBrainz, error) {
+	l := &listenBrainz{
+		// ListenBrainz wants "Authorization: Token ...", which a static token
+		// of that type gives
+		client: oauth2.NewClient(context.WithValue(ctx, oauth2.HTTPClient, httpClient), oauth2.StaticTokenSource(&oauth2.Token{
+			AccessToken: listenbrainzToken,
+			TokenType:   "Token",
+		})),
+	}
+
+	res, err := l.client.Get(listenbrainzURL + "/1/validate-token")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if err := checkResponse(res); err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	valid := struct {
+		Valid   bool   `json:"valid"`
+		Message string `json:"message"`
+	}{}
+	if err := json.Unmarshal(body, &valid); err != nil {
+		return nil, err
+	}
+	if !valid.Valid {
+		return nil, fmt.Errorf("%s at %s", valid.Message, listenbrainzURL)
+	}
+	return l, nil
+}
+
+func (l *listenBrainz) Name() string {
+	return "listenbrainz"
+}
+
+func (l *listenBrainz) BatchSize() int {
+	return 100
+}
+
+func (l *listenBrainz) NowPlaying(play scrobble) error {
+	listen := play.listen()
+	listen.ListenedAt = 0
+	return l.submit("say "+play.Artist+" - "+play.Title+" is playing", "playing_now", []listenBrainzListen{listen})
+}
+
+// a single listen as it happens, or a batch as an import of what built up
+// while the app was down or ListenBrainz was
+func (l *listenBrainz) Scrobble(plays []scrobble) error {
+	listens := []listenBrainzListen{}
+	for _, play := range plays {
+		listens = append(listens, play.listen())
+	}
+	if len(listens) == 1 {
+		return l.submit("submit a listen to "+plays[0].Artist+" - "+plays[0].Title, "single", listens)
+	}
+	return l.submit(fmt.Sprintf("import %d listen(s)", len(listens)), "import", listens)
+}
+
+func (l *listenBrainz) submit(action string, listenType string, listens []listenBrainzListen) error {
+	_, err := sendChange(l.client, action, "POST", listenbrainzURL+"/1/submit-listens", map[string]interface{}{
+		"listen_type": listenType,
+		"payload":     listens,
+	})
+	return err
+}
+
+// the play as ListenBrainz has it, with where it was heard
+func (p scrobble) listen() listenBrainzListen {
+	info := map[string]interface{}{
+		"submission_client": "SONiC On Demand",
+		"station":           p.Station,
+	}
+	if p.SpotifyId != "" {
+		info["spotify_id"] = spotifyLocation(p.SpotifyId)
+	}
+	if p.Duration > 0 {
+		info["duration_ms"] = p.Duration.Milliseconds()
+	}
+	return listenBrainzListen{
+		ListenedAt: p.StartedAt.Unix(),
+		TrackMetadata: listenBrainzMetadata{
+			ArtistName:     p.Artist,
+			TrackName:      p.Title,
+			AdditionalInfo: info,
+		},
+	}
+}
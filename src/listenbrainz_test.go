@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeSubmission struct {
+	ListenType string               `json:"listen_type"`
+	Payload    []listenBrainzListen `json:"payload"`
+}
+
+// fakeListenBrainz takes listens from the holder of one token
+type fakeListenBrainz struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	submissions []fakeSubmission
+}
+
+func newFakeListenBrainz() *fakeListenBrainz {
+	f := &fakeListenBrainz{}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeListenBrainz) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	authorized := r.Header.Get("Authorization") == "Token lb-token"
+	switch r.URL.Path {
+	case "/1/validate-token":
+		if !authorized {
+			writeJSON(w, map[string]interface{}{"code": 200, "message": "Token invalid.", "valid": false})
+			return
+		}
+		writeJSON(w, map[string]interface{}{"code": 200, "message": "Token valid.", "valid": true, "user_name": "sonic"})
+	case "/1/submit-listens":
+		if !authorized {
+			http.Error(w, `{"code":401,"error":"Invalid authorization token."}`, http.StatusUnauthorized)
+			return
+		}
+		submission := fakeSubmission{}
+		json.NewDecoder(r.Body).Decode(&submission)
+		f.submissions = append(f.submissions, submission)
+		writeJSON(w, map[string]string{"status": "ok"})
+	default:
+		http.Error(w, "", http.StatusNotFound)
+	}
+}
+
+// listen types and track names of everything submitted, in order
+func (f *fakeListenBrainz) sent() []fakeSubmission {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeSubmission(nil), f.submissions...)
+}
+
+// useListenBrainz points scrobbling at the fake, with Last.fm off
+func useListenBrainz(t *testing.T) *fakeListenBrainz {
+	fake := newFakeListenBrainz()
+	oldURL, oldToken, oldKey := listenbrainzURL, listenbrainzToken, lastfmAPIKey
+	oldDir, oldInterval := scrobbleDir, scrobbleInterval
+	listenbrainzURL, listenbrainzToken, lastfmAPIKey = fake.URL, "lb-token", ""
+	scrobbleDir, scrobbleInterval = "", 10*time.Millisecond
+	t.Cleanup(func() {
+		fake.Close()
+		listenbrainzURL, listenbrainzToken, lastfmAPIKey = oldURL, oldToken, oldKey
+		scrobbleDir, scrobbleInterval = oldDir, oldInterval
+	})
+	return fake
+}
+
+func TestListenBrainzGetsPlayingNowAndSingleListens(t *testing.T) {
+	env := newTestEnv(t)
+	fake := useListenBrainz(t)
+	clock = newFixedClock(time.Date(2021, 7, 1, 12, 5, 0, 0, stationTimeZone))
+	enabledSinks = "file"
+	env.station.play(songAt("A - One", "track1", "2021-07-01 12:00:00"), songAt("B - Two", "", "2021-07-01 12:04:30"))
+
+	if err := startSession(nil); err != nil {
+		t.Fatal(err)
+	}
+	startTasks(nil)
+
+	var sent []fakeSubmission
+	waitFor(t, "a listen and what's playing", func() bool {
+		sent = fake.sent()
+		types := map[string]bool{}
+		for _, submission := range sent {
+			types[submission.ListenType] = true
+		}
+		return types["single"] && types["playing_now"]
+	})
+	for _, submission := range sent {
+		metadata := submission.Payload[0].TrackMetadata
+		info := metadata.AdditionalInfo
+		switch submission.ListenType {
+		case "single":
+			if metadata.TrackName != "One" || info["spotify_id"] != "https://open.spotify.com/track/track1" || info["station"] != "CHDI" {
+				t.Errorf("listen was %+v", metadata)
+			}
+			if want := time.Date(2021, 7, 1, 12, 0, 0, 0, stationTimeZone).Unix(); submission.Payload[0].ListenedAt != want {
+				t.Errorf("listened at %d, want %d", submission.Payload[0].ListenedAt, want)
+			}
+		case "playing_now":
+			if metadata.TrackName != "Two" || submission.Payload[0].ListenedAt != 0 {
+				t.Errorf("playing now was %+v", submission.Payload[0])
+			}
+		}
+	}
+}
+
+func TestListenBrainzImportsWhatBuiltUpOffline(t *testing.T) {
+	newTestEnv(t)
+	fake := useListenBrainz(t)
+	service, err := newListenBrainz()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newScrobbler(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := clock.Now()
+	for i, title := range []string{"A - One", "B - Two", "C - Three"} {
+		artist, songTitle := splitSongTitle(title)
+		startedAt := now.Add(time.Duration(i-3) * 10 * time.Minute)
+		appendHistory(HistoryRecord{SongTitle: title, Artist: artist, Title: songTitle, StartedAt: startedAt, RawStartedAt: startedAt.String(), Length: 210})
+	}
+	s.check()
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := fake.sent()
+	if len(sent) != 1 || sent[0].ListenType != "import" || len(sent[0].Payload) != 3 {
+		t.Fatalf("submitted %+v, want one import of three", sent)
+	}
+	if first := sent[0].Payload[0].TrackMetadata.TrackName; first != "One" {
+		t.Errorf("import started with %s, want the oldest", first)
+	}
+}
+
+func TestListenBrainzChecksTheToken(t *testing.T) {
+	newTestEnv(t)
+	useListenBrainz(t)
+	listenbrainzToken = "wrong"
+	if _, err := newListenBrainz(); err == nil {
+		t.Errorf("a bad token was accepted")
+	}
+	if scrobblers := openScrobblers(); len(scrobblers) != 0 {
+		t.Errorf("scrobbling with a bad token")
+	}
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -20,23 +22,30 @@ var stateString = "random-string"
 
 var currentUser = ""
 
-var currentSongs []string
-
 var sonicNowPlayingURL = "https://player.rogersradio.ca/chdi/widget/now_playing"
 
-var getUserIdURL = "https://api.spotify.com/v1/me"
-var getPlaylistsURL = "https://api.spotify.com/v1/me/playlists?limit=50"
-var makePlaylistURL = "https://api.spotify.com/v1/users/{user_id}/playlists"
-var addSongURL = "https://api.spotify.com/v1/playlists/{playlist_id}/tracks"
-var getSongsUrl = "https://api.spotify.com/v1/playlists/{playlist_id}/tracks?market=CA&fields=items(track.name,track.id),total&limit=100"
+// base of every Spotify Web API endpoint below, swapped out in tests
+var spotifyAPIURL = "https://api.spotify.com/v1"
+
+var getUserIdURL = "/me"
+var getPlaylistsURL = "/me/playlists?limit=50"
+var makePlaylistURL = "/users/{user_id}/playlists"
+var addSongURL = "/playlists/{playlist_id}/tracks"
+var getSongsUrl = "/playlists/{playlist_id}/tracks?market={market}&fields=items(track.name,track.id,track.duration_ms,track.artists(name),track.is_playable,track.restrictions(reason)),total&limit=100"
+
+var pollInterval = 150 * time.Second
 
-var authFinished = false
+// where anything that has to survive a restart is kept
+var dataDir = envOr("DATA_DIR", ".")
+
+// background loops started after login, waited on at shutdown
+var tasks sync.WaitGroup
 
 var (
 	config = oauth2.Config{
 		ClientID:     os.Getenv("CLIENTID"),
 		ClientSecret: os.Getenv("CLIENTSECRET"),
-		Scopes:       []string{"playlist-modify-public", "playlist-modify-private", "playlist-read-private", "playlist-read-collaborative"},
+		Scopes:       []string{"playlist-modify-public", "playlist-modify-private", "playlist-read-private", "playlist-read-collaborative", "ugc-image-upload", "user-read-private"},
 		RedirectURL:  "http://localhost:3000/callback",
 		Endpoint:     spotify.Endpoint,
 	}
@@ -44,6 +53,18 @@ var (
 
 var ctx = context.Background()
 
+// an environment variable, or fallback when it isn't set
+func envOr(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// client used for everything that isn't Spotify, and as the transport
+// underneath the oauth2 client
+var httpClient = http.DefaultClient
+
 type SonicInfo struct {
 	Song_title string `json:"song_title"`
 	Started_at string `json:"started_at"`
@@ -55,6 +76,7 @@ type PlaylistList struct {
 	Items  []PlaylistInfo `json:"items"`
 	Limit  int            `json:"limit"`
 	Offset int            `json:"offset"`
+	Next   string         `json:"next"`
 }
 
 type PlaylistInfo struct {
@@ -63,7 +85,8 @@ type PlaylistInfo struct {
 }
 
 type UserId struct {
-	Id string `json:"id"`
+	Id      string `json:"id"`
+	Country string `json:"country"`
 }
 
 type SONiCPlaylist struct {
@@ -72,16 +95,71 @@ type SONiCPlaylist struct {
 }
 
 type Track struct {
-	Track PlaylistInfo `json:"track"`
+	Track PlaylistTrack `json:"track"`
+}
+
+type PlaylistTrack struct {
+	Name       string         `json:"name"`
+	Id         string         `json:"id"`
+	DurationMs int            `json:"duration_ms"`
+	Artists    []PlaylistInfo `json:"artists"`
+	playable
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithCancel(ctx)
+
+	// so the history can be exported before anyone logs in
+	if err := loadHistory(); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	// without Spotify there's nobody to wait for, unless another sink needs
+	// a login
+	if !needsLogin() {
+		if err := startSession(nil); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		startTasks(nil)
+	}
+
 	http.HandleFunc("/", loginHandler)
 	http.HandleFunc("/callback", callbackHandler)
 	http.HandleFunc("/run", runHandler)
-	http.ListenAndServe(":3000", nil)
-	for !authFinished {
+	http.HandleFunc("/export", exportHandler)
+	http.HandleFunc("/status", statusHandler)
+	http.HandleFunc("/youtube/login", youtubeLoginHandler)
+	http.HandleFunc("/youtube/callback", youtubeCallbackHandler)
+	http.HandleFunc("/deezer/login", deezerLoginHandler)
+	http.HandleFunc("/deezer/callback", deezerCallbackHandler)
+	server := &http.Server{Addr: ":3000"}
+
+	// stop cleanly on ctrl-c or docker stop
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		server.Shutdown(context.Background())
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		fmt.Println(err.Error())
+	}
 
+	cancel()
+	tasks.Wait()
+	if dryRun {
+		fmt.Print(dryRunSummary())
 	}
 }
 
@@ -95,10 +173,41 @@ func runHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
+	// the other services come first, their callbacks send the browser back
+	// here
+	if needsYouTubeLogin() {
+		http.Redirect(w, r, "/youtube/login", http.StatusTemporaryRedirect)
+		return
+	}
+	if needsDeezerLogin() {
+		http.Redirect(w, r, "/deezer/login", http.StatusTemporaryRedirect)
+		return
+	}
 	url := config.AuthCodeURL(stateString)
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
+// whether someone has to log in before the session can start
+func needsLogin() bool {
+	return sinkEnabled("spotify") || needsYouTubeLogin() || needsDeezerLogin()
+}
+
+// after logging in to a service other than Spotify, goes back round for the
+// next login, or starts the session if that was the last
+func continueLogin(w http.ResponseWriter, r *http.Request) {
+	if needsLogin() {
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	if err := startSession(nil); err != nil {
+		fmt.Println(err.Error())
+		http.Redirect(w, r, "/error", http.StatusTemporaryRedirect)
+		return
+	}
+	http.Redirect(w, r, "/run", http.StatusTemporaryRedirect)
+	startTasks(nil)
+}
+
 func callbackHandler(w http.ResponseWriter, r *http.Request) {
 	// get the auth token
 	token, err := getAuthToken(r.FormValue("state"), r.FormValue("code"))
@@ -108,30 +217,116 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := config.Client(ctx, token)
+	if err := saveToken(token); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	client := spotifyClient(token)
 
-	// get the user's id
-	currentUser, err = getUserId(client)
-	if err != nil {
+	if err := startSession(client); err != nil {
 		fmt.Println(err.Error())
+		http.Redirect(w, r, "/error", http.StatusTemporaryRedirect)
+		return
 	}
 
-	// fix the URLs requiring a user ID
-	fixUserURLs()
+	http.Redirect(w, r, "/run", http.StatusTemporaryRedirect)
 
-	// get exisitng playlist or create new one if needed with the ID
-	playlistId, err := handlePlaylist(client)
+	startTasks(client)
+}
 
-	// fix all URLs needing the playlist ID
-	fixPlaylistURLs(playlistId)
+// wraps httpClient so requests carry the token and refresh it when needed
+func spotifyClient(token *oauth2.Token) *http.Client {
+	return config.Client(context.WithValue(ctx, oauth2.HTTPClient, httpClient), token)
+}
 
-	// get a list of all songs in the playlist
-	getAllSongs(client)
+// looks up the user and sets up the playlists, ready for MainTask. client is
+// nil when Spotify isn't one of the sinks and nobody logs in.
+func startSession(client *http.Client) error {
+	if client != nil {
+		// get the user's id, and their country for the market
+		user, err := getUser(client)
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+		currentUser, currentMarket = user.Id, chooseMarket(user.Country)
+	}
 
-	http.Redirect(w, r, "/run", http.StatusTemporaryRedirect)
+	// songs still waiting to go in from before a restart count as in the
+	// playlists already
+	if err := loadOutbox(); err != nil {
+		return err
+	}
+
+	// which show each airing is in, and the show playlists
+	if err := loadSchedule(); err != nil {
+		return err
+	}
+
+	// get exisitng playlists or create new ones, with what's in them
+	if err := openSinks(client); err != nil {
+		return err
+	}
 
-	// loop for songs
-	go MainTask(client)
+	return loadHistory()
+}
+
+// starts polling the station, after catching up on what was missed, and
+// sending queued songs
+func startTasks(client *http.Client) {
+	// before anything new is heard, which a first run would take as already
+	// scrobbled
+	scrobblers := openScrobblers()
+
+	tasks.Add(2)
+	go func() {
+		defer tasks.Done()
+		// catch up on whatever played while the app was down first
+		if _, err := backfill(client, backfillWindow); err != nil {
+			fmt.Println(err.Error())
+		}
+		MainTask(client)
+	}()
+	go func() {
+		defer tasks.Done()
+		runOutbox()
+	}()
+	if musicbrainzEnabled {
+		tasks.Add(1)
+		go func() {
+			defer tasks.Done()
+			newMusicBrainz(client).Run()
+		}()
+	}
+	if client != nil {
+		tasks.Add(1)
+		go func() {
+			defer tasks.Done()
+			runAvailabilitySweep(client)
+		}()
+	}
+	if pruning() {
+		tasks.Add(1)
+		go func() {
+			defer tasks.Done()
+			runPruner()
+		}()
+	}
+	for _, s := range scrobblers {
+		tasks.Add(1)
+		go func(s *scrobbler) {
+			defer tasks.Done()
+			s.Run()
+		}(s)
+	}
+	for _, sink := range sinksByName {
+		if background, ok := sink.(backgroundSink); ok {
+			tasks.Add(1)
+			go func() {
+				defer tasks.Done()
+				background.Run()
+			}()
+		}
+	}
 }
 
 func getAuthToken(state string, code string) (*oauth2.Token, error) {
@@ -145,39 +340,56 @@ func getAuthToken(state string, code string) (*oauth2.Token, error) {
 	return token, nil
 }
 
-func fixUserURLs() {
-	makePlaylistURL = strings.Replace(makePlaylistURL, "{user_id}", currentUser, 1)
+// fills in the user ID of an endpoint and makes it absolute
+func spotifyURL(endpoint string) string {
+	return playlistURL(endpoint, "")
 }
 
-func fixPlaylistURLs(playlistId string) {
-	addSongURL = strings.Replace(addSongURL, "{playlist_id}", playlistId, 1)
-	getSongsUrl = strings.Replace(getSongsUrl, "{playlist_id}", playlistId, 1)
+// like spotifyURL, filling in a playlist ID too
+func playlistURL(endpoint string, playlistId string) string {
+	endpoint = strings.Replace(endpoint, "{user_id}", currentUser, 1)
+	endpoint = strings.Replace(endpoint, "{playlist_id}", playlistId, 1)
+	endpoint = strings.Replace(endpoint, "{market}", currentMarket, 1)
+	return spotifyAPIURL + endpoint
 }
 
-func getUserId(client *http.Client) (string, error) {
-	res, err := client.Get(getUserIdURL)
-	if err != nil {
-		fmt.Println(err.Error())
-		return "", err
-	}
+// a non 2xx response from Spotify or the station
+type apiError struct {
+	Method     string
+	Path       string
+	Status     string
+	StatusCode int
+	// how long a 429 asked us to back off for
+	RetryAfter time.Duration
+}
 
-	defer res.Body.Close()
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Method, e.Path, e.Status)
+}
 
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		fmt.Println(err.Error())
-		return "", err
+// turns a non 2xx response into an *apiError
+func checkResponse(res *http.Response) error {
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		err := &apiError{
+			Method:     res.Request.Method,
+			Path:       res.Request.URL.Path,
+			Status:     res.Status,
+			StatusCode: res.StatusCode,
+		}
+		if seconds, convErr := strconv.Atoi(res.Header.Get("Retry-After")); convErr == nil {
+			err.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return err
 	}
-
-	data := UserId{}
-	json.Unmarshal(body, &data)
-	return data.Id, nil
+	return nil
 }
 
-func getNowPlaying() SonicInfo {
-	res, err := http.Get(sonicNowPlayingURL)
+func getUser(client *http.Client) (UserId, error) {
+	data := UserId{}
+	res, err := client.Get(spotifyURL(getUserIdURL))
 	if err != nil {
 		fmt.Println(err.Error())
+		return data, err
 	}
 
 	defer res.Body.Close()
@@ -185,166 +397,212 @@ func getNowPlaying() SonicInfo {
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		fmt.Println(err.Error())
+		return data, err
 	}
 
-	data := SonicInfo{}
 	json.Unmarshal(body, &data)
-
-	return data
+	return data, nil
 }
 
-// will either find or create Sonic Playlist and return ID
-func handlePlaylist(client *http.Client) (string, error) {
-	var playlistId, err = checkForPlaylist(client)
-	if err != nil {
-		fmt.Println(err.Error())
-		return "", err
-	} else if playlistId == "" {
-		fmt.Println("Making Playlist")
-		playlistId, err = makePlaylist(client)
-	}
-	return playlistId, nil
-
-}
+func getNowPlaying() (SonicInfo, error) {
+	data := SonicInfo{}
 
-// will get playlist ID for Sonic On Demand if it exists
-func checkForPlaylist(client *http.Client) (string, error) {
-	res, err := client.Get(getPlaylistsURL)
+	res, err := httpClient.Get(sonicNowPlayingURL)
 	if err != nil {
-		fmt.Println(err.Error())
-		return "", err
+		return data, err
 	}
 
 	defer res.Body.Close()
 
+	if err := checkResponse(res); err != nil {
+		return data, err
+	}
+
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		fmt.Println(err.Error())
-		return "", err
+		return data, err
 	}
 
-	data := PlaylistList{}
-	json.Unmarshal(body, &data)
-	for _, value := range data.Items {
-		if value.Name == "SONiC On Demand" {
-			return value.Id, nil
+	if recordFeedPath != "" {
+		if err := recordPoll(recordFeedPath, body); err != nil {
+			fmt.Println(err.Error())
 		}
 	}
-	return "", nil
-}
 
-func makePlaylist(client *http.Client) (string, error) {
-	requestBody, err := json.Marshal(map[string]string{
-		"name":        "SONiC On Demand",
-		"description": "Playlsit made from SONiC 102.9",
-	})
+	err = json.Unmarshal(body, &data)
+	return data, err
+}
 
-	req, err := http.NewRequest("POST", makePlaylistURL, bytes.NewBuffer(requestBody))
-	if err != nil {
-		fmt.Println(err.Error())
+// polls the station until ctx is cancelled
+func MainTask(client *http.Client) {
+	done := ctx.Done()
+	ticker := clock.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C():
+			pollNowPlaying(client)
+		}
 	}
+}
 
-	res, err := client.Do(req)
+// checks what's on air once and adds it to the playlist if it's new
+func pollNowPlaying(client *http.Client) {
+	nowPlaying, err := getNowPlaying()
 	if err != nil {
 		fmt.Println(err.Error())
-		return "", err
+		return
 	}
+	fmt.Println(nowPlaying)
 
-	defer res.Body.Close()
+	handleAiring(client, nowPlaying, sourcePoll)
+}
 
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		fmt.Println(err.Error())
-		return "", err
+// takes an airing the app hasn't seen before through to the playlist
+func handleAiring(client *http.Client, info SonicInfo, source string) {
+	if info.Song_title == "" && info.Spotify == "" {
+		// nothing on air, or the feed had a hiccup
+		return
 	}
 
-	data := PlaylistInfo{}
-	json.Unmarshal(body, &data)
+	record := newHistoryRecord(info, source)
+	if _, seen := findAiring(record.key()); seen {
+		fmt.Println("Already seen this airing")
+		return
+	}
 
-	return data.Id, nil
+	resolveAiring(client, record)
 }
 
-func getAllSongs(client *http.Client) error {
-	totalSongs := 100
-
-	for currentOffest := 0; currentOffest < totalSongs; currentOffest += 100 {
-
-		currentURL := getSongsUrl + "&offset=" + strconv.Itoa(currentOffest)
-
-		res, err := client.Get(currentURL)
+// finds the song on Spotify if the feed didn't link it, offers it to every
+// playlist and notes the outcome in the history: added if any playlist took
+// it, duplicate if they all had it already
+func resolveAiring(client *http.Client, record HistoryRecord) HistoryRecord {
+	if record.SpotifyId == "" && client != nil {
+		songId, err := searchTrack(client, record.Artist, record.Title)
 		if err != nil {
 			fmt.Println(err.Error())
-			return err
+			record.Status = statusError
 		}
-
-		defer res.Body.Close()
-
-		body, err := ioutil.ReadAll(res.Body)
+		record.SpotifyId = songId
+	}
+	aired := ""
+	if record.SpotifyId != "" && client != nil && preferOriginals {
+		preferred, err := preferredVersion(client, record.SpotifyId, record.Artist, record.Title)
 		if err != nil {
+			// the track found will do
 			fmt.Println(err.Error())
-			return err
+		} else if preferred != record.SpotifyId {
+			aired = record.SpotifyId
+			record.ReplacedSpotifyId, record.SpotifyId, record.ISRC = record.SpotifyId, preferred, ""
 		}
-
-		data := SONiCPlaylist{}
-		json.Unmarshal(body, &data)
-		for _, value := range data.Items {
-			currentSongs = append(currentSongs, value.Track.Id)
+	}
+	// a track that can't be played in the user's market is swapped for the
+	// one Spotify relinks it to there, or kept out of the Spotify playlists
+	unplayable := ""
+	if record.SpotifyId != "" && client != nil {
+		linked, reason, err := checkPlayable(client, record.SpotifyId)
+		if err == nil && reason != "" && aired != "" {
+			// the preferred release can't be played there, the aired one
+			// still might
+			record.ReplacedSpotifyId, record.SpotifyId = "", aired
+			linked, reason, err = checkPlayable(client, aired)
+		}
+		if err != nil {
+			// it'll go in as it is
+			fmt.Println(err.Error())
+		} else if linked != record.SpotifyId {
+			if record.ReplacedSpotifyId == "" {
+				record.ReplacedSpotifyId = record.SpotifyId
+			}
+			record.SpotifyId, record.ISRC = linked, ""
+		}
+		if reason != "" {
+			fmt.Printf("%s - %s can't be played in %s: %s\n", record.Artist, record.Title, currentMarket, reason)
+			unplayable = reason
 		}
-		totalSongs = data.Total
 	}
-
-	return nil
-}
-
-func checkForSong(songId string) bool {
-	for i := 0; i < len(currentSongs); i++ {
-		if currentSongs[i] == songId {
-			return true
+	// Deezer and MusicBrainz match by ISRC, which only the track itself has
+	if record.SpotifyId != "" && record.ISRC == "" && client != nil && (sinkEnabled("deezer") || musicbrainzEnabled) {
+		isrc, err := lookupISRC(client, record.SpotifyId)
+		if err != nil {
+			fmt.Println(err.Error())
 		}
+		record.ISRC = isrc
 	}
-	return false
-}
-
-func addSong(client *http.Client, songId string) error {
-	songURI := "spotify:track:" + songId
 
-	requestBody, err := json.Marshal(map[string][]string{
-		"uris": []string{songURI},
-	})
+	if record.Status != statusError {
+		record.Status, record.Playlists = offerToTargets(record.song())
+		if record.Status == statusUnmatched && unplayable != "" {
+			record.Status = statusUnplayable
+		}
+	}
 
-	req, err := http.NewRequest("POST", addSongURL, bytes.NewBuffer(requestBody))
-	if err != nil {
-		fmt.Println(err.Error())
+	switch record.Status {
+	case statusNotOnSpotify:
+		fmt.Println("Song not on spotify")
+	case statusDuplicate:
+		fmt.Println("Song already in playlist")
+	case statusUnplayable:
+		fmt.Println("Song can't be played in " + currentMarket)
 	}
 
-	res, err := client.Do(req)
-	if err != nil {
+	if err := appendHistory(record); err != nil {
 		fmt.Println(err.Error())
-		return err
 	}
-
-	defer res.Body.Close()
-
-	// also ensure song is added to app
-	currentSongs = append(currentSongs, songId)
-
-	return nil
+	return record
 }
 
-func MainTask(client *http.Client) {
-	ticker := time.NewTicker(150 * time.Second)
-
-	for _ = range ticker.C {
-
-		nowPlaying := getNowPlaying()
-		fmt.Println(nowPlaying)
-
-		if nowPlaying.Spotify == "" {
-			fmt.Println("Song not on spotify")
-		} else if checkForSong(nowPlaying.Spotify) {
-			fmt.Println("Song already in playlist")
-		} else {
-			addSong(client, nowPlaying.Spotify)
+// offers a song to every main playlist and the derived ones it fits, returning the status for the
+// history and the playlists it was queued for
+func offerToTargets(song Song) (string, []string) {
+	song = withISRCs([]Song{song})[0]
+	queued, duplicates, failed := []string{}, 0, false
+	for _, target := range currentTargets() {
+		if target.fits != nil && !target.fits(song) {
+			continue
+		}
+		// the first song of a new period clears out the last one's first
+		if target.prune != nil && target.startsPeriod(song) {
+			if err := pruneTarget(target, newAiringLookup()); err != nil {
+				fmt.Println(err.Error())
+			}
+		}
+		if target.full() && target.accepts(song) && !target.has(song) {
+			next, err := overflow(target)
+			if err != nil {
+				fmt.Println(err.Error())
+				failed = true
+				continue
+			}
+			target = next
+		}
+		outcome, err := target.offer(song)
+		if err != nil {
+			fmt.Println(err.Error())
+			failed = true
+		}
+		switch outcome {
+		case offerQueued:
+			queued = append(queued, target.String())
+		case offerDuplicate:
+			duplicates++
 		}
 	}
+
+	switch {
+	case len(queued) > 0:
+		return statusAdded, queued
+	case failed:
+		return statusError, nil
+	case duplicates > 0:
+		return statusDuplicate, nil
+	case song.SpotifyId == "":
+		return statusNotOnSpotify, nil
+	default:
+		return statusUnmatched, nil
+	}
 }
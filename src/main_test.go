@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jdvdb/SONiC-On-Demand/fakespotify"
+	"golang.org/x/oauth2"
+)
+
+// testEnv points the app at fake Spotify and station servers and puts every
+// global back when the test ends
+type testEnv struct {
+	spotify *fakespotify.Server
+	station *fakeStation
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	env := &testEnv{
+		spotify: fakespotify.New(),
+		station: newFakeStation(),
+	}
+
+	oldAPI, oldNowPlaying, oldEndpoint := spotifyAPIURL, sonicNowPlayingURL, config.Endpoint
+	oldRecent, oldHistory, oldToken := sonicRecentlyPlayedURL, historyPath, tokenPath
+	oldCtx, oldInterval := ctx, pollInterval
+	oldOutbox, oldOutboxInterval, oldBackoff := outboxPath, outboxInterval, outboxBackoff
+	oldSinks, oldPlaylistDir, oldTracks := enabledSinks, playlistDir, trackCachePath
+	// tests can set the clock, it's put back once the tasks using it stop
+	oldClock := clock
+
+	spotifyAPIURL = env.spotify.URL + "/v1"
+	sonicNowPlayingURL = env.station.URL + "/chdi/widget/now_playing"
+	sonicRecentlyPlayedURL = env.station.URL + "/chdi/widget/recently_played"
+	historyPath, tokenPath = "", ""
+	resetHistory()
+	config.Endpoint = oauth2.Endpoint{
+		AuthURL:  env.spotify.URL + "/authorize",
+		TokenURL: env.spotify.URL + "/api/token",
+	}
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithCancel(context.Background())
+	pollInterval = 10 * time.Millisecond
+	outboxPath, outboxInterval, outboxBackoff = "", 10*time.Millisecond, 20*time.Millisecond
+	resetOutbox()
+	enabledSinks, playlistDir, trackCachePath = "spotify", t.TempDir(), ""
+	currentUser, targets, sinksByName = "", nil, map[string]PlaylistSink{}
+	prefetchers, openedTrackCache, openedFeatureCache = nil, nil, nil
+
+	t.Cleanup(func() {
+		cancel()
+		tasks.Wait()
+		env.spotify.Close()
+		env.station.Close()
+		spotifyAPIURL, sonicNowPlayingURL, config.Endpoint = oldAPI, oldNowPlaying, oldEndpoint
+		sonicRecentlyPlayedURL, historyPath, tokenPath = oldRecent, oldHistory, oldToken
+		resetHistory()
+		ctx, pollInterval = oldCtx, oldInterval
+		outboxPath, outboxInterval, outboxBackoff = oldOutbox, oldOutboxInterval, oldBackoff
+		resetOutbox()
+		enabledSinks, playlistDir, trackCachePath = oldSinks, oldPlaylistDir, oldTracks
+		clock = oldClock
+		currentUser, targets, sinksByName = "", nil, map[string]PlaylistSink{}
+		prefetchers, openedTrackCache, openedFeatureCache = nil, nil, nil
+		currentMarket, playabilities.byTrack = "from_token", map[string]playability{}
+		unavailable.byPlaylist = map[string][]unavailableTrack{}
+	})
+	return env
+}
+
+// login walks through the browser side of the OAuth flow
+func (env *testEnv) login(t *testing.T) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	loginHandler(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("login answered %d, want redirect", rec.Code)
+	}
+	authURL, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authURL.Path != "/authorize" {
+		t.Fatalf("login redirected to %s", authURL)
+	}
+
+	// the user agrees to the scopes asked for and comes back with a code
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := noRedirects.Get(authURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	back, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callback := "/callback?" + back.RawQuery
+	rec = httptest.NewRecorder()
+	callbackHandler(rec, httptest.NewRequest("GET", callback, nil))
+	if location := rec.Header().Get("Location"); location != "/run" {
+		t.Fatalf("callback redirected to %q, want /run", location)
+	}
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func tracksOf(p *fakespotify.Playlist) []string {
+	if p == nil {
+		return nil
+	}
+	return p.Tracks
+}
+
+func sameTracks(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLoginCreatesPlaylistAndAddsNewSongs(t *testing.T) {
+	env := newTestEnv(t)
+	env.station.play(song("Artist One - Song One", "track1"), song("Artist Two - Song Two", "track2"))
+
+	env.login(t)
+
+	if env.spotify.Count("POST /api/token") != 1 {
+		t.Errorf("exchanged %d tokens, want 1", env.spotify.Count("POST /api/token"))
+	}
+	if currentUser != "fake-user" {
+		t.Errorf("currentUser = %q", currentUser)
+	}
+	waitFor(t, "both songs", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist("SONiC On Demand")), []string{"track1", "track2"})
+	})
+	if p := env.spotify.Playlist("SONiC On Demand"); p.Id != mainTarget("spotify").playlistId {
+		t.Errorf("main playlist is %q, want %q", mainTarget("spotify").playlistId, p.Id)
+	}
+}
+
+func TestLoginFindsExistingPlaylistAndSkipsKnownSongs(t *testing.T) {
+	env := newTestEnv(t)
+	// push the playlist onto a later page of the user's playlists
+	for i := 0; i < 60; i++ {
+		env.spotify.AddPlaylist("Other " + strconv.Itoa(i))
+	}
+	existing := []string{}
+	for i := 0; i < 250; i++ {
+		existing = append(existing, "old"+strconv.Itoa(i))
+	}
+	env.spotify.AddPlaylist("SONiC On Demand", existing...)
+	env.station.play(song("Old - Song", "old249"), song("New - Song", "new1"))
+
+	env.login(t)
+
+	if n := env.spotify.Count("GET /v1/playlists/playlist61/tracks"); n != 3 {
+		t.Fatalf("read %d pages of songs, want all 250 across 3 pages", n)
+	}
+	want := append(append([]string(nil), existing...), "new1")
+	waitFor(t, "the new song", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist("SONiC On Demand")), want)
+	})
+	if n := env.spotify.Count("POST /v1/users/fake-user/playlists"); n != 0 {
+		t.Errorf("created %d playlists, want to reuse the existing one", n)
+	}
+}
+
+func TestPollSkipsSongsNotOnSpotify(t *testing.T) {
+	env := newTestEnv(t)
+	env.station.play(song("Local Band - Demo", ""), song("Artist - Song", "track1"))
+
+	env.login(t)
+
+	waitFor(t, "the spotify song", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist("SONiC On Demand")), []string{"track1"})
+	})
+}
+
+func TestPollSurvivesStationErrors(t *testing.T) {
+	env := newTestEnv(t)
+	env.station.fail(http.StatusBadGateway)
+
+	env.login(t)
+
+	waitFor(t, "a few polls", func() bool {
+		env.station.mu.Lock()
+		defer env.station.mu.Unlock()
+		return env.station.hits >= 3
+	})
+	env.station.fail(0)
+	env.station.play(song("Artist - Song", "track1"))
+	waitFor(t, "the song after recovery", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist("SONiC On Demand")), []string{"track1"})
+	})
+}
+
+func TestCallbackRejectsWrongState(t *testing.T) {
+	env := newTestEnv(t)
+
+	rec := httptest.NewRecorder()
+	callbackHandler(rec, httptest.NewRequest("GET", "/callback?code=fake-code&state=forged", nil))
+
+	if location := rec.Header().Get("Location"); location != "/error" {
+		t.Errorf("callback redirected to %q, want /error", location)
+	}
+	if env.spotify.Count("POST /api/token") != 0 {
+		t.Errorf("exchanged a token for a forged state")
+	}
+}
+
+func TestAddSongReportsSpotifyErrors(t *testing.T) {
+	env := newTestEnv(t)
+	env.login(t)
+	target := mainTarget("spotify")
+	songs := []Song{{SpotifyId: "track1"}}
+
+	env.spotify.FailNext("POST /v1/playlists/"+target.playlistId+"/tracks", http.StatusInternalServerError)
+	if err := target.sink.Add(target.playlistId, songs); err == nil {
+		t.Errorf("Add ignored a 500")
+	}
+	if err := target.sink.Add(target.playlistId, songs); err != nil {
+		t.Errorf("Add: %v", err)
+	}
+}
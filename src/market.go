@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the country tracks have to be playable in, e.g. "CA". Empty takes the
+// country on the user's Spotify profile.
+var marketSetting = envOr("MARKET", "")
+
+// the market in use once the user is known. Spotify reads from_token as the
+// country of whoever the token belongs to.
+var currentMarket = "from_token"
+
+// how often the playlists are checked for tracks that can't be played any
+// more
+var availabilityInterval = 24 * time.Hour
+
+// the market to check tracks against, given the user's profile country
+func chooseMarket(country string) string {
+	switch {
+	case marketSetting != "":
+		return strings.ToUpper(marketSetting)
+	case country != "":
+		return country
+	default:
+		return "from_token"
+	}
+}
+
+// what Spotify says about playing a track when asked with a market
+type playable struct {
+	IsPlayable   *bool `json:"is_playable"`
+	Restrictions struct {
+		Reason string `json:"reason"`
+	} `json:"restrictions"`
+}
+
+// a track looked up in the market, which has linked_from when Spotify
+// relinked it to another track there
+type playableTrack struct {
+	Id string `json:"id"`
+	playable
+	LinkedFrom *struct {
+		Id string `json:"id"`
+	} `json:"linked_from"`
+}
+
+// why the track can't be played, empty when it can. Spotify leaves
+// is_playable out when it doesn't know, which counts as playable.
+func (t playable) unplayableReason() string {
+	if t.IsPlayable == nil || *t.IsPlayable {
+		return ""
+	}
+	if t.Restrictions.Reason != "" {
+		return t.Restrictions.Reason
+	}
+	return "unavailable"
+}
+
+// playability is what was found for a track in the market: the track to
+// add in its place, which is itself unless Spotify relinked it, and why it
+// can't be played
+type playability struct {
+	id     string
+	reason string
+}
+
+// each track looked up, so it's only asked about once
+var playabilities = struct {
+	sync.Mutex
+	byTrack map[string]playability
+}{byTrack: map[string]playability{}}
+
+// checks the track can be played in the market, returning the track Spotify
+// plays for it there and why it can't be played, if it can't
+func checkPlayable(client *http.Client, trackId string) (string, string, error) {
+	playabilities.Lock()
+	known, ok := playabilities.byTrack[trackId]
+	playabilities.Unlock()
+	if ok {
+		return known.id, known.reason, nil
+	}
+
+	track := playableTrack{}
+	trackURL := spotifyURL(getTrackURL) + url.PathEscape(trackId) + "?market=" + url.QueryEscape(currentMarket)
+	if err := getSpotify(client, trackURL, &track); err != nil {
+		return trackId, "", err
+	}
+	found := playability{id: trackId, reason: track.unplayableReason()}
+	if track.LinkedFrom != nil && track.Id != "" {
+		found.id = track.Id
+	}
+
+	// the sinks only see the track it was relinked to, so it's known by both
+	playabilities.Lock()
+	playabilities.byTrack[trackId] = found
+	playabilities.byTrack[found.id] = playability{id: found.id, reason: found.reason}
+	playabilities.Unlock()
+	return found.id, found.reason, nil
+}
+
+// whether a track was found to be unplayable in the market
+func knownUnplayable(trackId string) bool {
+	playabilities.Lock()
+	defer playabilities.Unlock()
+	return playabilities.byTrack[trackId].reason != ""
+}
+
+// unavailableTrack is a playlist track that can't be played in the market
+// any more
+type unavailableTrack struct {
+	Playlist string `json:"playlist"`
+	Id       string `json:"id"`
+	Artist   string `json:"artist"`
+	Title    string `json:"title"`
+	Reason   string `json:"reason"`
+}
+
+// the tracks the last sweep found unavailable, by sink and playlist id, as
+// another sink's playlist can have the same name
+var unavailable = struct {
+	sync.Mutex
+	byPlaylist map[string][]unavailableTrack
+}{byPlaylist: map[string][]unavailableTrack{}}
+
+// the tracks the last sweep of the playlist found unavailable
+func unavailableIn(part *playlistTarget) []unavailableTrack {
+	unavailable.Lock()
+	defer unavailable.Unlock()
+	return unavailable.byPlaylist[part.String()]
+}
+
+// lists each Spotify playlist and flags the tracks that can't be played in
+// the market, which Spotify still lists but greys out
+func sweepAvailability(client *http.Client) error {
+	for _, target := range currentTargets() {
+		if _, ok := target.sink.(*spotifySink); !ok {
+			continue
+		}
+		for _, part := range target.parts() {
+			listed, err := getPlaylistTracks(client, part.playlistId)
+			if err != nil {
+				return err
+			}
+			flagged := []unavailableTrack{}
+			for _, track := range listed {
+				reason := track.unplayableReason()
+				if reason == "" {
+					continue
+				}
+				song := track.sinkTrack().Song
+				fmt.Printf("%s - %s in %s can't be played in %s: %s\n", song.Artist, song.Title, part.name, currentMarket, reason)
+				flagged = append(flagged, unavailableTrack{
+					Playlist: part.name,
+					Id:       track.Id,
+					Artist:   song.Artist,
+					Title:    song.Title,
+					Reason:   reason,
+				})
+			}
+			unavailable.Lock()
+			unavailable.byPlaylist[part.String()] = flagged
+			unavailable.Unlock()
+		}
+	}
+	return nil
+}
+
+// sweeps the playlists every availabilityInterval until the app stops
+func runAvailabilitySweep(client *http.Client) {
+	done := ctx.Done()
+	ticker := clock.NewTicker(availabilityInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C():
+		}
+		if err := sweepAvailability(client); err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+}
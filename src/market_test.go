@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnplayableTracksAreRelinkedOrSkipped(t *testing.T) {
+	env := newTestEnv(t)
+	for _, id := range []string{"old", "new", "gone", "fine", "moved", "blocked"} {
+		env.spotify.AddTrack(id, "Song "+id, "A")
+	}
+	env.spotify.Relink("old", "new")
+	env.spotify.Restrict("gone", "market")
+	env.spotify.Relink("moved", "blocked")
+	env.spotify.Restrict("blocked", "market")
+	env.station.played(
+		songAt("A - Song old", "old", "2021-07-01 12:00:00"),
+		songAt("A - Song gone", "gone", "2021-07-01 12:04:00"),
+		songAt("A - Song moved", "moved", "2021-07-01 12:06:00"),
+		songAt("A - Song fine", "fine", "2021-07-01 12:08:00"),
+	)
+
+	env.login(t)
+
+	waitFor(t, "the playable songs", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist(playlistName)), []string{"new", "fine"})
+	})
+	waitFor(t, "every airing in the history", func() bool { return len(historyRecords()) == 4 })
+	for _, record := range historyRecords() {
+		switch record.SongTitle {
+		case "Song old":
+			if record.SpotifyId != "new" || record.ReplacedSpotifyId != "old" {
+				t.Errorf("relinked airing went in as %q replacing %q", record.SpotifyId, record.ReplacedSpotifyId)
+			}
+		case "Song gone", "Song moved":
+			if record.Status != statusUnplayable {
+				t.Errorf("unplayable airing is %q, want %q", record.Status, statusUnplayable)
+			}
+		}
+	}
+
+	for _, market := range env.spotify.Markets() {
+		if market != "CA" {
+			t.Errorf("asked about market %q, want the user's country", market)
+		}
+	}
+}
+
+func TestMarketSettingBeatsTheProfile(t *testing.T) {
+	old := marketSetting
+	defer func() { marketSetting = old }()
+
+	marketSetting = ""
+	if got := chooseMarket("CA"); got != "CA" {
+		t.Errorf("market = %q, want the profile's CA", got)
+	}
+	if got := chooseMarket(""); got != "from_token" {
+		t.Errorf("market = %q with no country, want from_token", got)
+	}
+	marketSetting = "us"
+	if got := chooseMarket("CA"); got != "US" {
+		t.Errorf("market = %q, want the configured US", got)
+	}
+}
+
+func TestSweepFlagsTracksThatWentUnavailable(t *testing.T) {
+	oldInterval := availabilityInterval
+	t.Cleanup(func() { availabilityInterval = oldInterval })
+	availabilityInterval = 10 * time.Millisecond
+	env := newTestEnv(t)
+	enabledSinks = "spotify,file"
+	env.spotify.AddTrack("kept", "Kept", "A")
+	env.spotify.AddTrack("pulled", "Pulled", "B")
+	env.spotify.AddPlaylist(playlistName, "kept", "pulled")
+
+	env.login(t)
+	env.spotify.Restrict("pulled", "product")
+
+	flaggedIn := func(sink string) []unavailableTrack {
+		for _, playlist := range currentStatus().Playlists {
+			if playlist.Sink == sink && playlist.Name == playlistName {
+				return playlist.Parts[0].Unavailable
+			}
+		}
+		return nil
+	}
+	waitFor(t, "the pulled track to be flagged", func() bool {
+		return len(flaggedIn("spotify")) == 1
+	})
+	flagged := flaggedIn("spotify")[0]
+	if flagged.Id != "pulled" || flagged.Reason != "product" || flagged.Artist != "B" {
+		t.Errorf("flagged %+v", flagged)
+	}
+	// the file playlist of the same name has nothing greyed out
+	if got := flaggedIn("file"); len(got) != 0 {
+		t.Errorf("file playlist flagged %+v", got)
+	}
+	if got := tracksOf(env.spotify.Playlist(playlistName)); !sameTracks(got, []string{"kept", "pulled"}) {
+		t.Errorf("playlist is %v, the sweep should only flag tracks", got)
+	}
+}
+
+func TestProfileCountryNeedsThePrivateScope(t *testing.T) {
+	oldScopes := config.Scopes
+	t.Cleanup(func() { config.Scopes = oldScopes })
+	config.Scopes = nil
+	for _, scope := range oldScopes {
+		if scope != "user-read-private" {
+			config.Scopes = append(config.Scopes, scope)
+		}
+	}
+	env := newTestEnv(t)
+	env.station.play(song("A - One", "track1"))
+
+	env.login(t)
+
+	waitFor(t, "the song", func() bool { return len(tracksOf(env.spotify.Playlist(playlistName))) == 1 })
+	for _, market := range env.spotify.Markets() {
+		if market != "from_token" {
+			t.Errorf("asked about market %q without the scope for the user's country", market)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// whether to keep mood playlists, and the bands of Spotify audio features
+// that put a song in each: "Name: feature=min..max, ...; Name: ...". Either
+// end of a band can be left open.
+var moodsEnabled = envOr("MOOD_PLAYLISTS", "") == "true"
+var moodBands = envOr("MOOD_BANDS", "High Energy: energy=0.75..; Chill: energy=..0.45, tempo=..110; Dance: danceability=0.7.., tempo=100..135")
+
+// Spotify's audio features for every track looked up, so none is asked
+// about twice. Empty keeps them in memory.
+var audioFeaturesPath = filepath.Join(dataDir, "audio-features.json")
+
+var audioFeaturesURL = "/audio-features?ids="
+
+// audioFeatures is the part of Spotify's analysis of a track the moods go by
+type audioFeatures struct {
+	Id           string  `json:"id"`
+	Energy       float64 `json:"energy"`
+	Valence      float64 `json:"valence"`
+	Danceability float64 `json:"danceability"`
+	// beats per minute
+	Tempo float64 `json:"tempo"`
+}
+
+// the named feature, false when there's no such feature
+func (f audioFeatures) value(feature string) (float64, bool) {
+	switch feature {
+	case "energy":
+		return f.Energy, true
+	case "valence":
+		return f.Valence, true
+	case "danceability":
+		return f.Danceability, true
+	case "tempo":
+		return f.Tempo, true
+	}
+	return 0, false
+}
+
+// featureBand is a range of one audio feature, ends included
+type featureBand struct {
+	feature string
+	min     float64
+	max     float64
+}
+
+type mood struct {
+	name  string
+	bands []featureBand
+}
+
+// reads moods in the form MOOD_BANDS takes
+func parseMoods(spec string) ([]mood, error) {
+	moods := []mood{}
+	for _, part := range strings.Split(spec, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		nameAndBands := strings.SplitN(part, ":", 2)
+		if len(nameAndBands) != 2 || strings.TrimSpace(nameAndBands[0]) == "" {
+			return nil, fmt.Errorf("mood %q needs a name, then a colon and its bands", strings.TrimSpace(part))
+		}
+		m := mood{name: strings.TrimSpace(nameAndBands[0])}
+		for _, band := range strings.Split(nameAndBands[1], ",") {
+			parsed, err := parseBand(strings.TrimSpace(band))
+			if err != nil {
+				return nil, fmt.Errorf("mood %q: %s", m.name, err.Error())
+			}
+			m.bands = append(m.bands, parsed)
+		}
+		moods = append(moods, m)
+	}
+	return moods, nil
+}
+
+// reads "feature=min..max", with either end left out for no limit
+func parseBand(band string) (featureBand, error) {
+	featureAndRange := strings.SplitN(band, "=", 2)
+	ends := []string{}
+	if len(featureAndRange) == 2 {
+		ends = strings.SplitN(featureAndRange[1], "..", 2)
+	}
+	if len(ends) != 2 {
+		return featureBand{}, fmt.Errorf("band %q isn't feature=min..max", band)
+	}
+	parsed := featureBand{feature: strings.ToLower(strings.TrimSpace(featureAndRange[0])), min: math.Inf(-1), max: math.Inf(1)}
+	if _, ok := (audioFeatures{}).value(parsed.feature); !ok {
+		return featureBand{}, fmt.Errorf("unknown feature %q, use energy, valence, danceability or tempo", parsed.feature)
+	}
+	for i, limit := range []*float64{&parsed.min, &parsed.max} {
+		end := strings.TrimSpace(ends[i])
+		if end == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(end, 64)
+		if err != nil {
+			return featureBand{}, fmt.Errorf("band %q: %s isn't a number", band, end)
+		}
+		*limit = value
+	}
+	return parsed, nil
+}
+
+// whether the features are inside every band
+func (m mood) fits(features audioFeatures) bool {
+	for _, band := range m.bands {
+		value, _ := features.value(band.feature)
+		if value < band.min || value > band.max {
+			return false
+		}
+	}
+	return true
+}
+
+// a playlist for each mood, which only songs on Spotify can go in
+func moodPlaylists(client *http.Client) ([]derivedPlaylist, error) {
+	if !moodsEnabled {
+		return nil, nil
+	}
+	if client == nil {
+		return nil, fmt.Errorf("mood playlists need Spotify's audio features, add spotify to SINKS")
+	}
+	moods, err := parseMoods(moodBands)
+	if err != nil {
+		return nil, fmt.Errorf("MOOD_BANDS: %s", err.Error())
+	}
+	cache, err := openFeatureCache(client)
+	if err != nil {
+		return nil, err
+	}
+
+	playlists := []derivedPlaylist{}
+	for _, m := range moods {
+		m := m
+		playlists = append(playlists, derivedPlaylist{
+			name: derivedPlaylistPrefix + m.name,
+			fits: func(song Song) bool {
+				features, known := cache.songFeatures(song)
+				return known && m.fits(features)
+			},
+		})
+	}
+	return playlists, nil
+}
+
+// featureCache keeps Spotify's audio features for tracks, asking for the
+// ones it doesn't have a batch at a time
+type featureCache struct {
+	client *http.Client
+	path   string
+
+	mu sync.Mutex
+	// nil for tracks Spotify has no features for
+	features map[string]*audioFeatures
+}
+
+// the cache every derived playlist shares while the sinks are open
+var openedFeatureCache *featureCache
+
+// the shared cache, read from audioFeaturesPath the first time
+func openFeatureCache(client *http.Client) (*featureCache, error) {
+	if openedFeatureCache != nil {
+		return openedFeatureCache, nil
+	}
+	cache := newFeatureCache(client, audioFeaturesPath)
+	if err := cache.load(); err != nil {
+		return nil, err
+	}
+	openedFeatureCache = cache
+	prefetchers = append(prefetchers, cache.fetch)
+	return cache, nil
+}
+
+func newFeatureCache(client *http.Client, path string) *featureCache {
+	return &featureCache{client: client, path: path, features: map[string]*audioFeatures{}}
+}
+
+// reads the saved features, a missing file is none
+func (c *featureCache) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return readJSONFile(c.path, &c.features)
+}
+
+// writes the cache out in one go, c must be locked
+func (c *featureCache) save() error {
+	return writeJSONFile(c.path, c.features)
+}
+
+// the features for a track, looking it up if it's new
+func (c *featureCache) get(trackId string) (*audioFeatures, error) {
+	if err := c.fetch([]string{trackId}); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.features[trackId], nil
+}
+
+// the song's features, known false when it isn't on Spotify or Spotify has
+// none for it
+func (c *featureCache) songFeatures(song Song) (audioFeatures, bool) {
+	if song.SpotifyId == "" {
+		return audioFeatures{}, false
+	}
+	found, err := c.get(song.SpotifyId)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+	if found == nil {
+		return audioFeatures{}, false
+	}
+	return *found, true
+}
+
+// looks up the tracks that aren't cached yet, as many to a request as
+// Spotify takes, without holding the cache while Spotify answers
+func (c *featureCache) fetch(trackIds []string) error {
+	c.mu.Lock()
+	missing, seen := []string{}, map[string]bool{}
+	for _, id := range trackIds {
+		if _, ok := c.features[id]; !ok && id != "" && !seen[id] {
+			missing = append(missing, id)
+			seen[id] = true
+		}
+	}
+	c.mu.Unlock()
+
+	for len(missing) > 0 {
+		batch := missing
+		if len(batch) > maxSongsPerRequest {
+			batch = batch[:maxSongsPerRequest]
+		}
+		missing = missing[len(batch):]
+
+		found, err := getAudioFeatures(c.client, batch)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		for i, id := range batch {
+			c.features[id] = found[i]
+		}
+		err = c.save()
+		c.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the features of each track, nil where Spotify has none
+func getAudioFeatures(client *http.Client, trackIds []string) ([]*audioFeatures, error) {
+	res, err := client.Get(spotifyURL(audioFeaturesURL) + strings.Join(trackIds, ","))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if err := checkResponse(res); err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	data := struct {
+		AudioFeatures []*audioFeatures `json:"audio_features"`
+	}{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
+	}
+	if len(data.AudioFeatures) != len(trackIds) {
+		return nil, fmt.Errorf("asked for the audio features of %d tracks and got %d", len(trackIds), len(data.AudioFeatures))
+	}
+	return data.AudioFeatures, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jdvdb/SONiC-On-Demand/fakespotify"
+)
+
+func TestParseMoods(t *testing.T) {
+	moods, err := parseMoods(moodBands)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moods) != 3 || moods[0].name != "High Energy" || moods[2].name != "Dance" {
+		t.Fatalf("default moods are %+v", moods)
+	}
+
+	dance := moods[2]
+	for _, c := range []struct {
+		features audioFeatures
+		want     bool
+	}{
+		{audioFeatures{Danceability: 0.8, Tempo: 120}, true},
+		// the ends of a band are in it
+		{audioFeatures{Danceability: 0.7, Tempo: 135}, true},
+		{audioFeatures{Danceability: 0.8, Tempo: 140}, false},
+		{audioFeatures{Danceability: 0.5, Tempo: 120}, false},
+	} {
+		if got := dance.fits(c.features); got != c.want {
+			t.Errorf("Dance fits %+v = %v, want %v", c.features, got, c.want)
+		}
+	}
+
+	for _, spec := range []string{
+		"Loud energy=0.8..",
+		"Loud: loudness=0.8..",
+		"Loud: energy=0.8",
+		"Loud: energy=high..",
+		": energy=0.8..",
+	} {
+		if _, err := parseMoods(spec); err == nil {
+			t.Errorf("parseMoods(%q) gave no error", spec)
+		}
+	}
+}
+
+func TestMoodPlaylistsSortBackfilledSongsByFeatures(t *testing.T) {
+	env := newTestEnv(t)
+	oldEnabled, oldPath := moodsEnabled, audioFeaturesPath
+	defer func() { moodsEnabled, audioFeaturesPath = oldEnabled, oldPath }()
+	moodsEnabled, audioFeaturesPath = true, filepath.Join(t.TempDir(), "audio-features.json")
+
+	env.spotify.AddTrack("loud", "Loud", "A")
+	env.spotify.SetFeatures("loud", fakespotify.Features{Energy: 0.9, Danceability: 0.4, Tempo: 150})
+	env.spotify.AddTrack("calm", "Calm", "B")
+	env.spotify.SetFeatures("calm", fakespotify.Features{Energy: 0.3, Danceability: 0.3, Tempo: 80})
+	env.spotify.AddTrack("groove", "Groove", "C")
+	env.spotify.SetFeatures("groove", fakespotify.Features{Energy: 0.6, Danceability: 0.8, Tempo: 118})
+	// Spotify hasn't analysed this one
+	env.spotify.AddTrack("new", "New", "D")
+	env.station.played(
+		songAt("A - Loud", "loud", "2021-07-01 12:00:00"),
+		songAt("B - Calm", "calm", "2021-07-01 12:04:00"),
+		songAt("C - Groove", "groove", "2021-07-01 12:08:00"),
+		songAt("D - New", "new", "2021-07-01 12:12:00"),
+	)
+
+	env.login(t)
+
+	waitFor(t, "every playlist filled", func() bool {
+		main := env.spotify.Playlist("SONiC On Demand")
+		return main != nil && len(main.Tracks) == 4
+	})
+	for name, want := range map[string][]string{
+		"SONiC – High Energy": {"loud"},
+		"SONiC – Chill":       {"calm"},
+		"SONiC – Dance":       {"groove"},
+	} {
+		waitFor(t, name, func() bool {
+			p := env.spotify.Playlist(name)
+			return p != nil && sameTracks(tracksOf(p), want)
+		})
+	}
+	if n := env.spotify.Count("GET /v1/audio-features"); n != 1 {
+		t.Errorf("asked for audio features %d times, want all four in one go", n)
+	}
+
+	// nothing is asked twice, even after a restart
+	cache := newFeatureCache(nil, audioFeaturesPath)
+	if err := cache.load(); err != nil {
+		t.Fatal(err)
+	}
+	if features, err := cache.get("loud"); err != nil || features == nil || features.Energy != 0.9 {
+		t.Errorf("cached features for loud are %+v, %v", features, err)
+	}
+	if features, err := cache.get("new"); err != nil || features != nil {
+		t.Errorf("cached features for new are %+v, %v", features, err)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// whether to look aired songs up on MusicBrainz, and who to tell it's
+// asking, which it wants in the User-Agent
+var musicbrainzEnabled = envOr("MUSICBRAINZ", "") == "true"
+var musicbrainzContact = envOr("MUSICBRAINZ_CONTACT", "https://github.com/jdvdb/SONiC-On-Demand")
+
+var musicbrainzURL = "https://musicbrainz.org/ws/2"
+
+// MusicBrainz allows one request a second
+var musicbrainzInterval = time.Second
+
+// how often the history is checked for airings to look up
+var enrichInterval = time.Minute
+
+// the most tags kept for a recording, most used first
+const maxRecordingTags = 10
+
+// musicBrainzInfo is what's kept in the history of a recording MusicBrainz
+// found
+type musicBrainzInfo struct {
+	RecordingId string   `json:"recording_id,omitempty"`
+	ArtistIds   []string `json:"artist_ids,omitempty"`
+	// the earliest release it's on
+	ReleaseId string `json:"release_id,omitempty"`
+	// the artists as MusicBrainz credits them, "A feat. B"
+	ArtistCredit string   `json:"artist_credit,omitempty"`
+	Title        string   `json:"title,omitempty"`
+	Year         int      `json:"year,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+}
+
+// a recording as the web service gives it, from a lookup or a search
+type mbRecording struct {
+	Id               string `json:"id"`
+	Title            string `json:"title"`
+	FirstReleaseDate string `json:"first-release-date"`
+	ArtistCredit     []struct {
+		Name       string `json:"name"`
+		Joinphrase string `json:"joinphrase"`
+		Artist     struct {
+			Id string `json:"id"`
+		} `json:"artist"`
+	} `json:"artist-credit"`
+	Releases []struct {
+		Id   string `json:"id"`
+		Date string `json:"date"`
+	} `json:"releases"`
+	Tags []struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	} `json:"tags"`
+}
+
+// musicBrainz fills in the history with what MusicBrainz knows of each
+// aired song, a request a second at most
+type musicBrainz struct {
+	// Spotify, for the ISRCs of airings from before, nil without it
+	client   *http.Client
+	throttle Ticker
+	// what's been found by ISRC or songKey, so a song that airs again
+	// doesn't need asking about
+	found map[string]*musicBrainzInfo
+	// airings MusicBrainz wouldn't look up, left alone until a restart
+	skipped map[string]bool
+}
+
+func newMusicBrainz(client *http.Client) *musicBrainz {
+	m := &musicBrainz{client: client, found: map[string]*musicBrainzInfo{}, skipped: map[string]bool{}}
+	for _, record := range historyRecords() {
+		if record.MusicBrainz != nil {
+			m.found[enrichKey(record.ISRC, record)] = record.MusicBrainz
+		}
+	}
+	return m
+}
+
+// looks up airings as they come until ctx is cancelled. A failure waits for
+// the next check of the history.
+func (m *musicBrainz) Run() {
+	done := ctx.Done()
+	m.throttle = clock.NewTicker(musicbrainzInterval)
+	defer m.throttle.Stop()
+	ticker := clock.NewTicker(enrichInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.enrichHistory(); err != nil {
+			fmt.Println("Couldn't look songs up on MusicBrainz, will retry: " + err.Error())
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// looks up every airing that hasn't been, oldest first. An airing
+// MusicBrainz turns down is skipped, only throttling or not getting through
+// stops the pass.
+func (m *musicBrainz) enrichHistory() error {
+	for _, record := range historyRecords() {
+		if record.MusicBrainz != nil || record.Artist == "" || record.Title == "" || m.skipped[record.key()] {
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		info, isrc, err := m.enrich(record)
+		if err != nil && retryable(err) {
+			return err
+		} else if err != nil {
+			fmt.Printf("Skipping %s on MusicBrainz: %s\n", record.SongTitle, err.Error())
+			m.skipped[record.key()] = true
+			continue
+		}
+		err = updateAiring(record.key(), func(record *HistoryRecord) {
+			record.MusicBrainz = info
+			if record.ISRC == "" {
+				record.ISRC = isrc
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the key a lookup is remembered by
+func enrichKey(isrc string, record HistoryRecord) string {
+	if isrc != "" {
+		return "isrc:" + isrc
+	}
+	return songKey(record.Artist, record.Title)
+}
+
+// finds the airing's recording by its ISRC, or by artist and title when
+// there isn't one or MusicBrainz doesn't know it. Returns the ISRC too, which
+// older airings may not have had.
+func (m *musicBrainz) enrich(record HistoryRecord) (*musicBrainzInfo, string, error) {
+	isrc := record.ISRC
+	if isrc == "" && record.SpotifyId != "" && m.client != nil {
+		var err error
+		if isrc, err = lookupISRC(m.client, record.SpotifyId); err != nil {
+			// artist and title will do
+			fmt.Println(err.Error())
+		}
+	}
+	key := enrichKey(isrc, record)
+	if info, ok := m.found[key]; ok {
+		return info, isrc, nil
+	}
+
+	want := songKey(record.Artist, record.Title)
+	var best *mbRecording
+	if isrc != "" {
+		found := struct {
+			Recordings []mbRecording `json:"recordings"`
+		}{}
+		err := m.get("/isrc/"+url.PathEscape(isrc), url.Values{"inc": {"artist-credits+releases+tags"}}, &found)
+		if apiErr, ok := err.(*apiError); ok && apiErr.StatusCode == http.StatusNotFound {
+			err = nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		// the ISRC is the recording, though a few are shared by mistake
+		for i := range found.Recordings {
+			if best == nil || songKey(found.Recordings[i].artistCredit(), found.Recordings[i].Title) == want {
+				best = &found.Recordings[i]
+			}
+		}
+	}
+	if best == nil {
+		found := struct {
+			Recordings []mbRecording `json:"recordings"`
+		}{}
+		query := fmt.Sprintf(`recording:"%s" AND artist:"%s"`, luceneEscape(normaliseTitle(record.Title)), luceneEscape(record.Artist))
+		if err := m.get("/recording", url.Values{"query": {query}, "limit": {"10"}}, &found); err != nil {
+			return nil, "", err
+		}
+		// search only goes on words, so the same song is checked for
+		for i := range found.Recordings {
+			if songKey(found.Recordings[i].artistCredit(), found.Recordings[i].Title) == want {
+				best = &found.Recordings[i]
+				break
+			}
+		}
+	}
+
+	info := &musicBrainzInfo{}
+	if best != nil {
+		info = best.info()
+	}
+	m.found[key] = info
+	return info, isrc, nil
+}
+
+// asks the web service once the throttle allows, decoding the answer into out
+func (m *musicBrainz) get(path string, params url.Values, out interface{}) error {
+	if m.throttle != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-m.throttle.C():
+		}
+	}
+
+	params.Set("fmt", "json")
+	req, err := http.NewRequest("GET", musicbrainzURL+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "SONiC-On-Demand/1.0 ( "+musicbrainzContact+" )")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := checkResponse(res); err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	// an answer that can't be read won't read any better asked again
+	if err := json.Unmarshal(body, out); err != nil {
+		return permanentError{err}
+	}
+	return nil
+}
+
+// the credited artists run together the way MusicBrainz shows them
+func (r mbRecording) artistCredit() string {
+	var credit strings.Builder
+	for _, artist := range r.ArtistCredit {
+		credit.WriteString(artist.Name + artist.Joinphrase)
+	}
+	return credit.String()
+}
+
+// what's kept of the recording
+func (r mbRecording) info() *musicBrainzInfo {
+	info := &musicBrainzInfo{RecordingId: r.Id, ArtistCredit: r.artistCredit(), Title: r.Title}
+	for _, artist := range r.ArtistCredit {
+		info.ArtistIds = append(info.ArtistIds, artist.Artist.Id)
+	}
+
+	// undated releases go last
+	releases := r.Releases
+	sort.SliceStable(releases, func(i, j int) bool {
+		return releases[j].Date == "" || (releases[i].Date != "" && releases[i].Date < releases[j].Date)
+	})
+	date := r.FirstReleaseDate
+	if len(releases) > 0 {
+		info.ReleaseId = releases[0].Id
+		if date == "" {
+			date = releases[0].Date
+		}
+	}
+	if len(date) >= 4 {
+		info.Year, _ = strconv.Atoi(date[:4])
+	}
+
+	tags := r.Tags
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].Count > tags[j].Count })
+	for _, tag := range tags {
+		if len(info.Tags) == maxRecordingTags {
+			break
+		}
+		info.Tags = append(info.Tags, tag.Name)
+	}
+	return info
+}
+
+// quotes the characters that mean something in a search query
+func luceneEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
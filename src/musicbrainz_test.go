@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMusicBrainz knows a few recordings by ISRC and by search, and notes
+// when each request came
+type fakeMusicBrainz struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []time.Time
+	paths    []string
+	agents   map[string]bool
+}
+
+func newFakeMusicBrainz() *fakeMusicBrainz {
+	f := &fakeMusicBrainz{agents: map[string]bool{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func credit(names ...string) []map[string]interface{} {
+	credits := []map[string]interface{}{}
+	for i, name := range names {
+		joinphrase := ""
+		if i < len(names)-1 {
+			joinphrase = " & "
+		}
+		credits = append(credits, map[string]interface{}{"name": name, "joinphrase": joinphrase, "artist": map[string]string{"id": "artist-" + name}})
+	}
+	return credits
+}
+
+func (f *fakeMusicBrainz) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, time.Now())
+	f.paths = append(f.paths, r.URL.Path)
+	f.agents[r.Header.Get("User-Agent")] = true
+
+	switch {
+	case r.URL.Path == "/ws/2/isrc/CAX012100001":
+		writeJSON(w, map[string]interface{}{"isrc": "CAX012100001", "recordings": []map[string]interface{}{{
+			"id":                 "rec-one",
+			"title":              "One",
+			"first-release-date": "",
+			"artist-credit":      credit("A", "Friend"),
+			"releases":           []map[string]string{{"id": "later", "date": "1990-01-01"}, {"id": "undated"}, {"id": "first", "date": "1987-03-09"}},
+			"tags":               []map[string]interface{}{{"name": "rock", "count": 3}, {"name": "pop", "count": 5}},
+		}}})
+	case r.URL.Path == "/ws/2/isrc/CAX012100009":
+		http.Error(w, `{"error":"Invalid isrc."}`, http.StatusBadRequest)
+	case strings.HasPrefix(r.URL.Path, "/ws/2/isrc/"):
+		http.Error(w, `{"error":"Not Found"}`, http.StatusNotFound)
+	case r.URL.Path == "/ws/2/recording":
+		recordings := []map[string]interface{}{}
+		if q := r.URL.Query().Get("query"); strings.Contains(strings.ToLower(q), `recording:"two"`) {
+			recordings = append(recordings,
+				map[string]interface{}{"id": "rec-cover", "title": "Two", "artist-credit": credit("Cover Band")},
+				map[string]interface{}{"id": "rec-two", "title": "Two", "first-release-date": "2001-05", "artist-credit": credit("B")},
+			)
+		}
+		writeJSON(w, map[string]interface{}{"recordings": recordings})
+	default:
+		http.Error(w, "", http.StatusNotFound)
+	}
+}
+
+func (f *fakeMusicBrainz) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+func TestMusicBrainzFillsInTheHistory(t *testing.T) {
+	env := newTestEnv(t)
+	fake := newFakeMusicBrainz()
+	defer fake.Close()
+	oldURL, oldEnabled, oldInterval, oldEnrich := musicbrainzURL, musicbrainzEnabled, musicbrainzInterval, enrichInterval
+	musicbrainzURL, musicbrainzEnabled, musicbrainzInterval, enrichInterval = fake.URL+"/ws/2", true, 30*time.Millisecond, 10*time.Millisecond
+	defer func() {
+		musicbrainzURL, musicbrainzEnabled, musicbrainzInterval, enrichInterval = oldURL, oldEnabled, oldInterval, oldEnrich
+	}()
+
+	env.spotify.AddTrack("track1", "One", "A")
+	env.spotify.SetISRC("track1", "CAX012100001")
+	env.spotify.AddTrack("track3", "Three", "C")
+	env.spotify.SetISRC("track3", "CAX012100003")
+	env.station.play(
+		songAt("A - One", "track1", "2021-07-01 12:00:00"),
+		songAt("B - Two", "", "2021-07-01 12:04:00"),
+		songAt("C - Three", "track3", "2021-07-01 12:08:00"),
+		songAt("A - One", "track1", "2021-07-01 12:12:00"),
+	)
+
+	env.login(t)
+
+	enriched := map[string]HistoryRecord{}
+	waitFor(t, "all four airings looked up", func() bool {
+		count := 0
+		for _, record := range historyRecords() {
+			if record.MusicBrainz != nil {
+				enriched[record.SongTitle] = record
+				count++
+			}
+		}
+		return count == 4
+	})
+
+	one := enriched["A - One"]
+	if one.ISRC != "CAX012100001" || one.Status == "" {
+		t.Errorf("A - One lost what the poller wrote: %+v", one)
+	}
+	if info := one.MusicBrainz; info.RecordingId != "rec-one" || info.ArtistCredit != "A & Friend" || len(info.ArtistIds) != 2 ||
+		info.ReleaseId != "first" || info.Year != 1987 || strings.Join(info.Tags, ",") != "pop,rock" {
+		t.Errorf("A - One got %+v", info)
+	}
+	if info := enriched["B - Two"].MusicBrainz; info.RecordingId != "rec-two" || info.Year != 2001 {
+		t.Errorf("B - Two got %+v", info)
+	}
+	if info := enriched["C - Three"].MusicBrainz; info.RecordingId != "" {
+		t.Errorf("C - Three isn't on MusicBrainz but got %+v", info)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	// One by ISRC once, Two by search, Three by ISRC then search
+	if len(fake.paths) != 4 {
+		t.Errorf("asked MusicBrainz %v", fake.paths)
+	}
+	for i := 1; i < len(fake.requests); i++ {
+		if gap := fake.requests[i].Sub(fake.requests[i-1]); gap < 25*time.Millisecond {
+			t.Errorf("requests %d and %d were %s apart", i-1, i, gap)
+		}
+	}
+	for agent := range fake.agents {
+		if !strings.HasPrefix(agent, "SONiC-On-Demand/") {
+			t.Errorf("identified as %q", agent)
+		}
+	}
+}
+
+func TestMusicBrainzSkipsAiringsItTurnsDown(t *testing.T) {
+	newTestEnv(t)
+	fake := newFakeMusicBrainz()
+	defer fake.Close()
+	oldURL := musicbrainzURL
+	musicbrainzURL = fake.URL + "/ws/2"
+	defer func() { musicbrainzURL = oldURL }()
+
+	now := clock.Now()
+	appendHistory(HistoryRecord{SongTitle: "D - Bad", Artist: "D", Title: "Bad", ISRC: "CAX012100009", StartedAt: now.Add(-8 * time.Minute), RawStartedAt: now.Add(-8 * time.Minute).String()})
+	appendHistory(HistoryRecord{SongTitle: "A - One", Artist: "A", Title: "One", ISRC: "CAX012100001", StartedAt: now.Add(-4 * time.Minute), RawStartedAt: now.Add(-4 * time.Minute).String()})
+
+	m := newMusicBrainz(nil)
+	for pass := 0; pass < 2; pass++ {
+		if err := m.enrichHistory(); err != nil {
+			t.Fatalf("pass %d stopped: %s", pass, err)
+		}
+	}
+	for _, record := range historyRecords() {
+		switch record.SongTitle {
+		case "A - One":
+			if record.MusicBrainz == nil || record.MusicBrainz.RecordingId != "rec-one" {
+				t.Errorf("the airing after the bad one got %+v", record.MusicBrainz)
+			}
+		case "D - Bad":
+			if record.MusicBrainz != nil {
+				t.Errorf("the turned down airing got %+v", record.MusicBrainz)
+			}
+		}
+	}
+	if n := fake.count(); n != 2 {
+		t.Errorf("asked MusicBrainz %d times, want the bad airing asked about once", n)
+	}
+
+	// a MusicBrainz that can't be reached stops the pass
+	fake.Close()
+	appendHistory(HistoryRecord{SongTitle: "B - Two", Artist: "B", Title: "Two", StartedAt: now, RawStartedAt: now.String()})
+	if err := m.enrichHistory(); err == nil || !retryable(err) {
+		t.Errorf("an unreachable MusicBrainz gave %v", err)
+	}
+}
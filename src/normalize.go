@@ -0,0 +1,68 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// matching an aired song to a track somewhere else means comparing artist
+// and title strings that are rarely written quite the same way. These
+// functions boil them down to something comparable.
+
+var accents = strings.NewReplacer(
+	"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "a", "å", "a",
+	"ç", "c",
+	"è", "e", "é", "e", "ê", "e", "ë", "e",
+	"ì", "i", "í", "i", "î", "i", "ï", "i",
+	"ñ", "n",
+	"ò", "o", "ó", "o", "ô", "o", "õ", "o", "ö", "o", "ø", "o",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u",
+	"ý", "y", "ÿ", "y",
+	"æ", "ae", "œ", "oe", "ß", "ss",
+)
+
+// "(feat. Someone)", "[Radio Edit]" and the like
+var bracketed = regexp.MustCompile(`\s*[\(\[][^\)\]]*[\)\]]`)
+
+// " - Remastered 2011", " - Radio Edit", " - Single Version"
+var versionSuffix = regexp.MustCompile(`(?i)\s+-\s+.*\b(remaster(ed)?|edit|version|mix|mono|stereo|live|single)\b.*$`)
+
+// "feat. X", "ft X", "featuring X" to the end of the string
+var featuring = regexp.MustCompile(`(?i)\s+(feat\.?|ft\.?|featuring|with)\s+.*$`)
+
+var nonAlphanumeric = regexp.MustCompile(`[^a-z0-9]+`)
+
+// lower case, no accents, "&" as "and", punctuation as single spaces
+func normalise(s string) string {
+	s = accents.Replace(strings.ToLower(s))
+	s = strings.Replace(s, "&", " and ", -1)
+	s = strings.Replace(s, "'", "", -1)
+	s = strings.Replace(s, "’", "", -1)
+	return strings.TrimSpace(nonAlphanumeric.ReplaceAllString(s, " "))
+}
+
+// the title without featured artists or version notes
+func normaliseTitle(title string) string {
+	title = bracketed.ReplaceAllString(title, "")
+	title = versionSuffix.ReplaceAllString(title, "")
+	title = featuring.ReplaceAllString(title, "")
+	return normalise(title)
+}
+
+// the lead artist, without a leading "The" or anyone featured
+func normaliseArtist(artist string) string {
+	artist = bracketed.ReplaceAllString(artist, "")
+	artist = featuring.ReplaceAllString(artist, "")
+	for _, separator := range []string{", ", " x ", " X ", " & ", " and ", " / "} {
+		if i := strings.Index(artist, separator); i > 0 {
+			artist = artist[:i]
+		}
+	}
+	artist = normalise(artist)
+	return strings.TrimPrefix(artist, "the ")
+}
+
+// one key per song, the same however the artist and title were written
+func songKey(artist string, title string) string {
+	return normaliseArtist(artist) + "|" + normaliseTitle(title)
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestSongKeyIgnoresHowSongsAreWritten(t *testing.T) {
+	for _, pair := range [][4]string{
+		{"The Killers", "Mr. Brightside", "Killers", "Mr Brightside"},
+		{"Beyoncé", "Halo", "Beyonce", "HALO"},
+		{"Mumford & Sons", "The Cave", "Mumford and Sons", "The Cave"},
+		{"Calvin Harris feat. Rihanna", "This Is What You Came For", "Calvin Harris", "This Is What You Came For (feat. Rihanna)"},
+		{"Queen", "Don't Stop Me Now - Remastered 2011", "Queen", "Dont Stop Me Now"},
+		{"Daft Punk, Pharrell Williams", "Get Lucky [Radio Edit]", "Daft Punk", "Get Lucky"},
+	} {
+		if a, b := songKey(pair[0], pair[1]), songKey(pair[2], pair[3]); a != b {
+			t.Errorf("%q and %q should match", a, b)
+		}
+	}
+
+	for _, pair := range [][4]string{
+		{"Blur", "Song 2", "Blur", "Song 3"},
+		{"Arkells", "Leather Jacket", "Arcade Fire", "Leather Jacket"},
+	} {
+		if a, b := songKey(pair[0], pair[1]), songKey(pair[2], pair[3]); a == b {
+			t.Errorf("%q and %q shouldn't match", a, b)
+		}
+	}
+}
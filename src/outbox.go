@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// songs waiting to go into a playlist are kept here until the sink takes
+// them, so a network blip or a restart doesn't lose any. Empty keeps them in memory.
+var outboxPath = filepath.Join(dataDir, "outbox.json")
+
+// how often the outbox checks for work when nothing wakes it up
+var outboxInterval = 5 * time.Second
+
+// the first retry waits this long, doubling each failure up to outboxMaxBackoff
+var outboxBackoff = 5 * time.Second
+var outboxMaxBackoff = 10 * time.Minute
+
+// Spotify takes at most this many URIs per request, and no sink is sent more
+// at once
+const maxSongsPerRequest = 100
+
+type outboxEntry struct {
+	Sink     string `json:"sink"`
+	Playlist string `json:"playlist"`
+	Song     Song   `json:"song"`
+	// from before there were other sinks, when only an ID was queued
+	SongId   string    `json:"song_id,omitempty"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+var outbox struct {
+	sync.Mutex
+	entries []outboxEntry
+	// each playlist on each sink waits out its own failures, so one sink
+	// being rate limited doesn't hold up the others
+	queues map[outboxQueue]*queueState
+	// nudges runOutbox when something new is queued
+	wake chan struct{}
+}
+
+// outboxQueue is the songs bound for one playlist on one sink, which go in
+// the order they were queued
+type outboxQueue struct {
+	sink     string
+	playlist string
+}
+
+type queueState struct {
+	failures int
+	retryAt  time.Time
+	// a batch is being sent, so no one else sends this queue meanwhile
+	sending bool
+	// the sink turned down its login, so the queue waits for a restart
+	rejected error
+}
+
+func init() {
+	outbox.wake = make(chan struct{}, 1)
+	outbox.queues = map[outboxQueue]*queueState{}
+}
+
+// reads whatever was left queued before a restart
+func loadOutbox() error {
+	outbox.Lock()
+	defer outbox.Unlock()
+
+	entries := []outboxEntry{}
+	if err := readJSONFile(outboxPath, &entries); err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		if entry.Sink == "" {
+			entries[i].Sink = "spotify"
+			entries[i].Song.SpotifyId = entry.SongId
+			entries[i].SongId = ""
+		}
+	}
+	outbox.entries = entries
+	return nil
+}
+
+// writes the queue out, replacing the file in one go so a crash midway
+// leaves the old one
+func saveOutbox() error {
+	// a dry run's queue is only ever pretended to be sent
+	if dryRun {
+		return nil
+	}
+	return writeJSONFile(outboxPath, outbox.entries)
+}
+
+// queues songs for a playlist on a sink behind everything already waiting
+func enqueueSongs(sinkName string, playlistId string, songs ...Song) error {
+	outbox.Lock()
+	for _, song := range songs {
+		outbox.entries = append(outbox.entries, outboxEntry{Sink: sinkName, Playlist: playlistId, Song: song, QueuedAt: clock.Now()})
+	}
+	err := saveOutbox()
+	outbox.Unlock()
+
+	select {
+	case outbox.wake <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+// the songs still waiting to go into a playlist on a sink
+func queuedSongs(sinkName string, playlistId string) []Song {
+	outbox.Lock()
+	defer outbox.Unlock()
+
+	songs := []Song{}
+	for _, entry := range outbox.entries {
+		if entry.Sink == sinkName && entry.Playlist == playlistId {
+			songs = append(songs, entry.Song)
+		}
+	}
+	return songs
+}
+
+// how many songs are waiting
+func outboxLen() int {
+	outbox.Lock()
+	defer outbox.Unlock()
+	return len(outbox.entries)
+}
+
+// sends queued songs oldest first, in batches of songs bound for the same
+// playlist on the same sink, until every queue is empty or has failed. A
+// failed batch stays at the front of its queue so nothing gets added out of
+// order, but the other queues carry on.
+func flushOutbox() error {
+	return flushQueues(false)
+}
+
+// flushQueues sends each queue in turn, skipping the ones still backing off
+// from a failure if asked to, and returns the first failure
+func flushQueues(skipWaiting bool) error {
+	var firstErr error
+	for _, queue := range pendingQueues(skipWaiting) {
+		if err := flushQueue(queue); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// the queues with songs waiting, in the order their oldest song was queued
+func pendingQueues(skipWaiting bool) []outboxQueue {
+	outbox.Lock()
+	defer outbox.Unlock()
+
+	now := clock.Now()
+	queues := []outboxQueue{}
+	seen := map[outboxQueue]bool{}
+	for _, entry := range outbox.entries {
+		queue := outboxQueue{entry.Sink, entry.Playlist}
+		if seen[queue] {
+			continue
+		}
+		seen[queue] = true
+		if state := outbox.queues[queue]; state != nil && (state.sending || state.rejected != nil || skipWaiting && now.Before(state.retryAt)) {
+			continue
+		}
+		queues = append(queues, queue)
+	}
+	return queues
+}
+
+// sends one queue a batch at a time until it's empty or a request fails.
+// The outbox is only locked between requests, so songs can be queued while
+// one is on its way.
+func flushQueue(queue outboxQueue) error {
+	outbox.Lock()
+	state := outbox.queues[queue]
+	if state == nil {
+		state = &queueState{}
+		outbox.queues[queue] = state
+	}
+	if state.sending {
+		outbox.Unlock()
+		return nil
+	}
+	state.sending = true
+	defer func() {
+		outbox.Lock()
+		state.sending = false
+		outbox.Unlock()
+	}()
+	outbox.Unlock()
+
+	// songs to send one at a time, after a batch the sink turned down, so
+	// only the ones it won't take are dropped
+	alone := 0
+	for {
+		limit := maxSongsPerRequest
+		if alone > 0 {
+			limit = 1
+		}
+		outbox.Lock()
+		songs := []Song{}
+		for _, entry := range outbox.entries {
+			if len(songs) == limit {
+				break
+			}
+			if entry.Sink == queue.sink && entry.Playlist == queue.playlist {
+				songs = append(songs, entry.Song)
+			}
+		}
+		outbox.Unlock()
+		if len(songs) == 0 {
+			return nil
+		}
+
+		var err error
+		sink, enabled := sinksByName[queue.sink]
+		if enabled {
+			err = sink.Add(queue.playlist, songs)
+		} else {
+			err = permanentError{fmt.Errorf("the %s sink isn't enabled", queue.sink)}
+		}
+
+		outbox.Lock()
+		if _, ok := err.(loginRejected); ok {
+			state.rejected = err
+			outbox.Unlock()
+			fmt.Printf("%s turned down the login, its songs are kept until it's set again and the app restarted: %s\n", queue.sink, err.Error())
+			return fmt.Errorf("%s:%s: %s", queue.sink, queue.playlist, err.Error())
+		} else if err != nil && retryable(err) {
+			state.failures++
+			state.retryAt = clock.Now().Add(backoff(state.failures, err))
+			outbox.Unlock()
+			return fmt.Errorf("%s:%s: %s", queue.sink, queue.playlist, err.Error())
+		} else if err != nil && enabled && len(songs) > 1 {
+			// one song can spoil the batch, so find which
+			alone = len(songs)
+			outbox.Unlock()
+			continue
+		} else if err != nil {
+			// the sink won't ever take these, holding them would block the rest
+			fmt.Printf("Dropping %d queued song(s) for %s:%s: %s\n", len(songs), queue.sink, queue.playlist, err.Error())
+		}
+
+		if alone > 0 {
+			alone--
+		}
+		state.failures = 0
+		state.retryAt = time.Time{}
+		removeQueued(queue, len(songs))
+		err = saveOutbox()
+		outbox.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// takes the first n songs of a queue out of the outbox, which has to be
+// locked. Songs queued since are only ever behind them.
+func removeQueued(queue outboxQueue, n int) {
+	kept := outbox.entries[:0]
+	for _, entry := range outbox.entries {
+		if n > 0 && entry.Sink == queue.sink && entry.Playlist == queue.playlist {
+			n--
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	outbox.entries = kept
+}
+
+// whether a failed request is worth trying again: network trouble, an
+// expired token, rate limiting and server errors are. So is anything a sink
+// gets wrong locally, like a full disk.
+func retryable(err error) bool {
+	switch err.(type) {
+	case permanentError, loginRejected:
+		return false
+	}
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		return true
+	}
+	return apiErr.StatusCode == http.StatusUnauthorized ||
+		apiErr.StatusCode == http.StatusTooManyRequests ||
+		apiErr.StatusCode >= 500
+}
+
+// how long to wait after the given number of failures in a row
+func backoff(failures int, err error) time.Duration {
+	if apiErr, ok := err.(*apiError); ok && apiErr.RetryAfter > 0 {
+		return apiErr.RetryAfter
+	}
+	wait := outboxBackoff
+	for i := 1; i < failures && wait < outboxMaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > outboxMaxBackoff {
+		wait = outboxMaxBackoff
+	}
+	return wait
+}
+
+// sends queued songs whenever some are added, retrying failures with backoff,
+// until ctx is cancelled
+func runOutbox() {
+	done := ctx.Done()
+	ticker := clock.NewTicker(outboxInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C():
+		case <-outbox.wake:
+		}
+
+		if err := flushQueues(true); err != nil {
+			fmt.Println("Couldn't add queued songs, will retry: " + err.Error())
+		}
+	}
+}
+
+// an error no retry will fix
+type permanentError struct {
+	error
+}
+
+// a service that turns down the login it was given, which nothing will fix
+// until the user sets it again
+type loginRejected struct {
+	error
+}
+
+// forgets everything queued, for tests and replays
+func resetOutbox() {
+	outbox.Lock()
+	defer outbox.Unlock()
+	outbox.entries = nil
+	outbox.queues = map[outboxQueue]*queueState{}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// spotifySongs is what the Spotify sink queues for these tracks
+func spotifySongs(ids ...string) []Song {
+	songs := []Song{}
+	for _, id := range ids {
+		songs = append(songs, Song{SpotifyId: id})
+	}
+	return songs
+}
+
+// useSpotify lets flushOutbox send to the fake without a session
+func useSpotify(client *http.Client) {
+	sinksByName = map[string]PlaylistSink{"spotify": &spotifySink{client: client}}
+}
+
+func TestOutboxRetriesFailedAddsInAirOrder(t *testing.T) {
+	env := newTestEnv(t)
+	env.spotify.AddPlaylist("SONiC On Demand")
+	env.spotify.FailNext("POST /v1/playlists/playlist1/tracks", http.StatusServiceUnavailable, http.StatusBadGateway)
+	env.station.play(song("A - One", "track1"), song("B - Two", "track2"), song("C - Three", "track3"))
+
+	env.login(t)
+
+	waitFor(t, "all three songs", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist("SONiC On Demand")), []string{"track1", "track2", "track3"})
+	})
+	if n := env.spotify.Count("POST /v1/playlists/playlist1/tracks"); n < 3 {
+		t.Errorf("made %d add requests, want the two failures retried", n)
+	}
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	env := newTestEnv(t)
+	outboxPath = filepath.Join(t.TempDir(), "data", "outbox.json")
+	env.spotify.AddPlaylist("SONiC On Demand", "track1")
+
+	// queued before the "crash", never sent
+	if err := enqueueSongs("spotify", "playlist1", spotifySongs("track2", "track3")...); err != nil {
+		t.Fatal(err)
+	}
+	resetOutbox()
+
+	env.station.play(song("C - Three", "track3"), song("D - Four", "track4"))
+	env.login(t)
+
+	// track3 is already queued so it mustn't go in twice
+	waitFor(t, "the queued songs then the new one", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist("SONiC On Demand")), []string{"track1", "track2", "track3", "track4"})
+	})
+	waitFor(t, "the outbox to empty", func() bool { return outboxLen() == 0 })
+
+	resetOutbox()
+	if err := loadOutbox(); err != nil {
+		t.Fatal(err)
+	}
+	if n := outboxLen(); n != 0 {
+		t.Errorf("%d songs still saved after they were sent", n)
+	}
+}
+
+func TestOutboxReadsQueuesFromBeforeSinks(t *testing.T) {
+	newTestEnv(t)
+	outboxPath = filepath.Join(t.TempDir(), "outbox.json")
+	legacy := `[{"playlist":"playlist1","song_id":"track2","queued_at":"2021-07-01T08:00:00Z"}]`
+	if err := ioutil.WriteFile(outboxPath, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadOutbox(); err != nil {
+		t.Fatal(err)
+	}
+	if got := queuedSongs("spotify", "playlist1"); len(got) != 1 || got[0].SpotifyId != "track2" {
+		t.Errorf("queued for spotify: %+v", got)
+	}
+}
+
+func TestOutboxBatchesUpToSpotifysLimit(t *testing.T) {
+	env := newTestEnv(t)
+	env.spotify.AddPlaylist("First")
+	env.spotify.AddPlaylist("Second")
+	useSpotify(spotifyClient(&oauth2.Token{AccessToken: "fake"}))
+
+	want := []string{}
+	for i := 0; i < 250; i++ {
+		want = append(want, "track"+strconv.Itoa(i))
+	}
+	enqueueSongs("spotify", "playlist1", spotifySongs(want[:150]...)...)
+	enqueueSongs("spotify", "playlist2", spotifySongs("other")...)
+	enqueueSongs("spotify", "playlist1", spotifySongs(want[150:]...)...)
+
+	if err := flushOutbox(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := tracksOf(env.spotify.Playlist("First")); !sameTracks(got, want) {
+		t.Errorf("first playlist has %d tracks out of order", len(got))
+	}
+	// 100 + 50, then the other playlist, then 100
+	if n := env.spotify.Count("POST /v1/playlists/playlist1/tracks"); n != 3 {
+		t.Errorf("made %d requests for 250 songs, want 3", n)
+	}
+	if got := tracksOf(env.spotify.Playlist("Second")); !sameTracks(got, []string{"other"}) {
+		t.Errorf("second playlist has %v", got)
+	}
+}
+
+func TestOutboxDropsSongsSpotifyRejects(t *testing.T) {
+	env := newTestEnv(t)
+	env.spotify.AddPlaylist("SONiC On Demand")
+	useSpotify(spotifyClient(&oauth2.Token{AccessToken: "fake"}))
+
+	env.spotify.Invalidate("bad")
+	enqueueSongs("spotify", "playlist1", spotifySongs("track1", "bad", "track2")...)
+	enqueueSongs("spotify", "gone", spotifySongs("track1")...)
+	enqueueSongs("unknown", "playlist1", spotifySongs("track3")...)
+
+	if err := flushOutbox(); err != nil {
+		t.Fatal(err)
+	}
+	if n := outboxLen(); n != 0 {
+		t.Errorf("%d songs left queued", n)
+	}
+	// the songs sent with the rejected one still go in
+	if got := tracksOf(env.spotify.Playlist("SONiC On Demand")); !sameTracks(got, []string{"track1", "track2"}) {
+		t.Errorf("playlist has %v, want only the rejected song dropped", got)
+	}
+
+	// and the playlist goes back to taking whole batches
+	enqueueSongs("spotify", "playlist1", spotifySongs("track4", "track5")...)
+	if err := flushOutbox(); err != nil {
+		t.Fatal(err)
+	}
+	if n := env.spotify.Count("POST /v1/playlists/playlist1/tracks"); n != 5 {
+		t.Errorf("sent %d requests, want the batch, each of its songs and one more batch", n)
+	}
+}
+
+func TestOutboxBacksOff(t *testing.T) {
+	outboxBackoff, outboxMaxBackoff = 5*time.Second, time.Minute
+	defer func() { outboxBackoff, outboxMaxBackoff = 5*time.Second, 10*time.Minute }()
+
+	serverError := &apiError{StatusCode: 503}
+	for failures, want := range map[int]time.Duration{1: 5 * time.Second, 2: 10 * time.Second, 4: 40 * time.Second, 10: time.Minute} {
+		if got := backoff(failures, serverError); got != want {
+			t.Errorf("backoff after %d failures = %s, want %s", failures, got, want)
+		}
+	}
+	if got := backoff(1, &apiError{StatusCode: 429, RetryAfter: 30 * time.Second}); got != 30*time.Second {
+		t.Errorf("backoff ignored Retry-After, waited %s", got)
+	}
+
+	for err, want := range map[error]bool{
+		errors.New("connection reset"): true,
+		&apiError{StatusCode: 401}:     true,
+		&apiError{StatusCode: 429}:     true,
+		&apiError{StatusCode: 502}:     true,
+		&apiError{StatusCode: 400}:     false,
+		&apiError{StatusCode: 404}:     false,
+	} {
+		if got := retryable(err); got != want {
+			t.Errorf("retryable(%v) = %t", err, got)
+		}
+	}
+}
+
+func TestOutboxFailureHoldsUpOnlyItsOwnPlaylist(t *testing.T) {
+	env := newTestEnv(t)
+	env.spotify.AddPlaylist("First")
+	env.spotify.AddPlaylist("Second")
+	useSpotify(spotifyClient(&oauth2.Token{AccessToken: "fake"}))
+	outboxBackoff = time.Hour
+
+	env.spotify.FailNext("POST /v1/playlists/playlist1/tracks", http.StatusServiceUnavailable)
+	enqueueSongs("spotify", "playlist1", spotifySongs("track1")...)
+	enqueueSongs("spotify", "playlist2", spotifySongs("track2")...)
+
+	if err := flushOutbox(); err == nil {
+		t.Errorf("flushed without the failure")
+	}
+	if got := tracksOf(env.spotify.Playlist("Second")); !sameTracks(got, []string{"track2"}) {
+		t.Errorf("second playlist has %v, want it sent past the first's failure", got)
+	}
+
+	// the first playlist waits out its backoff while the second carries on
+	enqueueSongs("spotify", "playlist2", spotifySongs("track3")...)
+	if err := flushQueues(true); err != nil {
+		t.Fatal(err)
+	}
+	if got := tracksOf(env.spotify.Playlist("Second")); !sameTracks(got, []string{"track2", "track3"}) {
+		t.Errorf("second playlist has %v", got)
+	}
+	if n := env.spotify.Count("POST /v1/playlists/playlist1/tracks"); n != 1 {
+		t.Errorf("made %d requests for the first playlist during its backoff", n)
+	}
+	if got := queuedSongs("spotify", "playlist1"); len(got) != 1 {
+		t.Errorf("queued for the first playlist: %+v", got)
+	}
+}
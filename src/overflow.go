@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// how many tracks a Spotify playlist takes before songs go in a new part of
+// it. It's a little under the 10,000 Spotify stops taking more at, leaving
+// room for songs added by hand. 0 never starts a new part.
+var spotifyCeiling = 9900
+
+func init() {
+	if ceiling, err := strconv.Atoi(os.Getenv("PLAYLIST_CEILING")); err == nil {
+		spotifyCeiling = ceiling
+	}
+}
+
+// a sink whose playlists stop taking songs at some size says how many
+// tracks each should hold before songs go in a new part
+type cappedSink interface {
+	Ceiling() int
+}
+
+// guards targets while a full playlist is swapped for its next part
+var targetsMu sync.Mutex
+
+// the playlists songs go in now, safe to range over while parts are added
+func currentTargets() []*playlistTarget {
+	targetsMu.Lock()
+	defer targetsMu.Unlock()
+	return append([]*playlistTarget(nil), targets...)
+}
+
+// "SONiC On Demand (Part 2)" for the second part
+func partName(name string, part int) string {
+	if part < 2 {
+		return name
+	}
+	return fmt.Sprintf("%s (Part %d)", name, part)
+}
+
+// the playlist's parts from the first to this one
+func (t *playlistTarget) parts() []*playlistTarget {
+	return append(append([]*playlistTarget(nil), t.earlier...), t)
+}
+
+// whether the playlist is at its sink's ceiling, never for sinks without one
+func (t *playlistTarget) full() bool {
+	capped, ok := t.sink.(cappedSink)
+	if !ok {
+		return false
+	}
+	ceiling := capped.Ceiling()
+	return ceiling > 0 && t.count() >= ceiling
+}
+
+// finds or makes the part after this one, which takes the songs this one
+// would have and knows what's in every part before it
+func (t *playlistTarget) nextPart() (*playlistTarget, error) {
+	parts := t.parts()
+	next, err := openPlaylist(t.sink, partName(parts[0].name, len(parts)+1))
+	if err != nil {
+		return nil, err
+	}
+	next.earlier, next.fits, next.prune = parts, t.fits, t.prune
+	next.period, next.periodStart = t.period, t.periodStart
+	return next, nil
+}
+
+// starts the next part of a full playlist and puts it in the playlist's
+// place in targets
+func overflow(full *playlistTarget) (*playlistTarget, error) {
+	next, err := full.nextPart()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("%s on %s is full, continuing in %s\n", full.name, full.sink.Name(), next.name)
+
+	targetsMu.Lock()
+	defer targetsMu.Unlock()
+	for i, target := range targets {
+		if target == full {
+			targets[i] = next
+		}
+	}
+	return next, nil
+}
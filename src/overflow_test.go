@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFullPlaylistContinuesInTheNextPart(t *testing.T) {
+	oldCeiling := spotifyCeiling
+	t.Cleanup(func() { spotifyCeiling = oldCeiling })
+	spotifyCeiling = 3
+	env := newTestEnv(t)
+	env.spotify.AddPlaylist(playlistName, "a", "b")
+	env.station.played(
+		songAt("A - Song C", "c", "2021-07-01 12:00:00"),
+		songAt("A - Song D", "d", "2021-07-01 12:04:00"),
+		songAt("A - Song A", "a", "2021-07-01 12:08:00"),
+		songAt("A - Song E", "e", "2021-07-01 12:12:00"),
+	)
+
+	env.login(t)
+
+	part2 := partName(playlistName, 2)
+	waitFor(t, "the second part", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist(part2)), []string{"d", "e"})
+	})
+	if got := tracksOf(env.spotify.Playlist(playlistName)); !sameTracks(got, []string{"a", "b", "c"}) {
+		t.Errorf("first part is %v", got)
+	}
+
+	rec := httptest.NewRecorder()
+	statusHandler(rec, httptest.NewRequest("GET", "/status", nil))
+	status := appStatus{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Playlists) != 1 || status.Playlists[0].Name != playlistName {
+		t.Fatalf("status lists %+v", status.Playlists)
+	}
+	parts := status.Playlists[0].Parts
+	if len(parts) != 2 || parts[0].Name != playlistName || parts[1].Name != part2 || parts[1].Tracks != 2 {
+		t.Errorf("status parts are %+v", parts)
+	}
+}
+
+func TestRestartDedupesAcrossParts(t *testing.T) {
+	oldCeiling := spotifyCeiling
+	t.Cleanup(func() { spotifyCeiling = oldCeiling })
+	spotifyCeiling = 2
+	env := newTestEnv(t)
+	env.spotify.AddPlaylist(playlistName, "a", "b")
+	env.spotify.AddPlaylist(partName(playlistName, 2), "c")
+	env.station.played(
+		songAt("A - Song B", "b", "2021-07-01 12:00:00"),
+		songAt("A - Song C", "c", "2021-07-01 12:04:00"),
+		songAt("A - Song D", "d", "2021-07-01 12:08:00"),
+	)
+
+	env.login(t)
+
+	waitFor(t, "the new song in the second part", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist(partName(playlistName, 2))), []string{"c", "d"})
+	})
+	if got := tracksOf(env.spotify.Playlist(playlistName)); !sameTracks(got, []string{"a", "b"}) {
+		t.Errorf("first part is %v", got)
+	}
+	if n := env.spotify.Count("POST /v1/users/fake-user/playlists"); n != 0 {
+		t.Errorf("created %d playlists, want the existing parts reused", n)
+	}
+}
+
+func TestEachSinkHasItsOwnCeiling(t *testing.T) {
+	oldSpotify, oldYouTube := spotifyCeiling, youtubeCeiling
+	t.Cleanup(func() { spotifyCeiling, youtubeCeiling = oldSpotify, oldYouTube })
+	spotifyCeiling, youtubeCeiling = 3, 2
+
+	for _, c := range []struct {
+		sink PlaylistSink
+		want bool
+	}{
+		{&spotifySink{}, false},
+		{&youtubeSink{}, true},
+		{&fileSink{}, false},
+	} {
+		target := newPlaylistTarget(c.sink, playlistName, "playlist1")
+		target.remember(Song{Artist: "A", Title: "One", SpotifyId: "a"})
+		target.remember(Song{Artist: "B", Title: "Two", SpotifyId: "b"})
+		if got := target.full(); got != c.want {
+			t.Errorf("%T with two tracks full = %t, want %t", c.sink, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// a Go template for the Spotify playlists' descriptions, kept up to date
+// every descriptionRefresh. Left empty, a playlist keeps the one it was made
+// with. It has .Name, .Tracks, .Updated and .TopArtist, the artist added
+// most in the last week.
+var descriptionTemplate = envOr("DESCRIPTION_TEMPLATE", "")
+
+// whether to make each Spotify playlist's cover from the album art of the
+// songs added last
+var coversEnabled = envOr("PLAYLIST_COVERS", "") == "true"
+
+var descriptionRefresh = time.Hour
+
+var playlistImagesURL = "/playlists/{playlist_id}/images"
+
+// the cover is coverGrid by coverGrid album arts, coverSize each
+const coverGrid = 2
+
+// Spotify won't take a cover bigger than this, once it's base64
+const maxCoverBytes = 256 * 1024
+
+// playlistStats is what a description template can show
+type playlistStats struct {
+	Name      string
+	Tracks    int
+	Updated   string
+	TopArtist string
+}
+
+// what was last set on each playlist, so unchanged ones aren't sent again
+var lastRefresh = struct {
+	sync.Mutex
+	descriptions map[string]string
+	covers       map[string]string
+}{descriptions: map[string]string{}, covers: map[string]string{}}
+
+// keeps the descriptions and covers of the playlists on Spotify up to date
+// until ctx is cancelled
+func (s *spotifySink) Run() {
+	if descriptionTemplate == "" && !coversEnabled {
+		return
+	}
+	describe, err := template.New("description").Parse(descriptionTemplate)
+	if err != nil {
+		fmt.Printf("DESCRIPTION_TEMPLATE: %s\n", err.Error())
+		return
+	}
+
+	done := ctx.Done()
+	ticker := clock.NewTicker(descriptionRefresh)
+	defer ticker.Stop()
+	for {
+		for _, target := range currentTargets() {
+			if target.sink != PlaylistSink(s) {
+				continue
+			}
+			if descriptionTemplate != "" {
+				if err := s.refreshDescription(target, describe); err != nil {
+					fmt.Println(err.Error())
+				}
+			}
+			if coversEnabled {
+				if err := s.refreshCover(target); err != nil {
+					fmt.Println(err.Error())
+				}
+			}
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// the airings that went in the playlist, latest first
+func addedTo(target *playlistTarget) []HistoryRecord {
+	added := []HistoryRecord{}
+	for _, record := range historyRecords() {
+		if indexOf(record.Playlists, target.String()) >= 0 {
+			added = append(added, record)
+		}
+	}
+	sort.SliceStable(added, func(i, j int) bool { return added[i].StartedAt.After(added[j].StartedAt) })
+	return added
+}
+
+// the numbers for the playlist's description
+func statsFor(target *playlistTarget) playlistStats {
+	now := clock.Now()
+	counts := map[string]int{}
+	for _, record := range addedTo(target) {
+		if now.Sub(record.StartedAt) <= 7*24*time.Hour && record.Artist != "" {
+			counts[record.Artist]++
+		}
+	}
+	top := ""
+	for artist, count := range counts {
+		if count > counts[top] || (count == counts[top] && artist < top) {
+			top = artist
+		}
+	}
+	return playlistStats{
+		Name:      target.name,
+		Tracks:    target.count(),
+		Updated:   now.In(stationTimeZone).Format("Jan 2 15:04"),
+		TopArtist: top,
+	}
+}
+
+func (s *spotifySink) refreshDescription(target *playlistTarget, describe *template.Template) error {
+	var out bytes.Buffer
+	if err := describe.Execute(&out, statsFor(target)); err != nil {
+		return err
+	}
+	// Spotify takes no line breaks in a description
+	description := strings.Join(strings.Fields(out.String()), " ")
+
+	lastRefresh.Lock()
+	unchanged := lastRefresh.descriptions[target.playlistId] == description
+	lastRefresh.Unlock()
+	if unchanged {
+		return nil
+	}
+	_, err := sendChange(s.client, "describe "+target.playlistId, "PUT", playlistURL("/playlists/{playlist_id}", target.playlistId), map[string]string{
+		"description": description,
+	})
+	if err != nil {
+		return err
+	}
+	lastRefresh.Lock()
+	lastRefresh.descriptions[target.playlistId] = description
+	lastRefresh.Unlock()
+	return nil
+}
+
+// sets a grid of the album arts of the latest songs added as the cover, once
+// there are enough of them
+func (s *spotifySink) refreshCover(target *playlistTarget) error {
+	cache, err := openTrackCache(s.client)
+	if err != nil {
+		return err
+	}
+	covers := []string{}
+	for _, record := range addedTo(target) {
+		if len(covers) == coverGrid*coverGrid {
+			break
+		}
+		if record.SpotifyId == "" {
+			continue
+		}
+		cover, err := cache.cover(record.SpotifyId)
+		if err != nil {
+			return err
+		}
+		if cover != "" && indexOf(covers, cover) < 0 {
+			covers = append(covers, cover)
+		}
+	}
+	if len(covers) < coverGrid*coverGrid {
+		return nil
+	}
+
+	key := strings.Join(covers, " ")
+	lastRefresh.Lock()
+	unchanged := lastRefresh.covers[target.playlistId] == key
+	lastRefresh.Unlock()
+	if unchanged {
+		return nil
+	}
+	jpg, err := coverImage(covers)
+	if err != nil {
+		return err
+	}
+	if err := uploadCover(s.client, target.playlistId, jpg); err != nil {
+		return err
+	}
+	lastRefresh.Lock()
+	lastRefresh.covers[target.playlistId] = key
+	lastRefresh.Unlock()
+	return nil
+}
+
+// fetches the album arts and lays them out in a grid as a JPEG
+func coverImage(urls []string) ([]byte, error) {
+	cover := image.NewRGBA(image.Rect(0, 0, coverGrid*coverSize, coverGrid*coverSize))
+	for i, url := range urls {
+		art, err := fetchImage(url)
+		if err != nil {
+			return nil, err
+		}
+		x, y := i%coverGrid*coverSize, i/coverGrid*coverSize
+		drawScaled(cover, image.Rect(x, y, x+coverSize, y+coverSize), art)
+	}
+	for quality := 90; quality > 0; quality -= 20 {
+		var out bytes.Buffer
+		if err := jpeg.Encode(&out, cover, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, err
+		}
+		if base64.StdEncoding.EncodedLen(out.Len()) <= maxCoverBytes {
+			return out.Bytes(), nil
+		}
+	}
+	return nil, fmt.Errorf("couldn't make a cover small enough for Spotify")
+}
+
+func fetchImage(url string) (image.Image, error) {
+	res, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := checkResponse(res); err != nil {
+		return nil, err
+	}
+	art, _, err := image.Decode(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", url, err.Error())
+	}
+	return art, nil
+}
+
+// draws src stretched over r of dst, nearest pixel
+func drawScaled(dst draw.Image, r image.Rectangle, src image.Image) {
+	bounds := src.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		sy := bounds.Min.Y + (y-r.Min.Y)*bounds.Dy()/r.Dy()
+		for x := r.Min.X; x < r.Max.X; x++ {
+			sx := bounds.Min.X + (x-r.Min.X)*bounds.Dx()/r.Dx()
+			dst.Set(x, y, src.At(sx, sy))
+		}
+	}
+}
+
+// sets the playlist's cover, which Spotify takes as base64 rather than JSON
+func uploadCover(client *http.Client, playlistId string, jpg []byte) error {
+	url := playlistURL(playlistImagesURL, playlistId)
+	action := fmt.Sprintf("set the cover of %s", playlistId)
+	if dryRun {
+		recordDryRun(action, "PUT", url, nil)
+		return nil
+	}
+	req, err := http.NewRequest("PUT", url, strings.NewReader(base64.StdEncoding.EncodeToString(jpg)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "image/jpeg")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return checkResponse(res)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveArt answers /<name>.jpg with a small JPEG of one colour
+func serveArt(t *testing.T, colours map[string]color.Color) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		colour, ok := colours[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".jpg")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		art := image.NewRGBA(image.Rect(0, 0, 64, 64))
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 64; x++ {
+				art.Set(x, y, colour)
+			}
+		}
+		jpeg.Encode(w, art, nil)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPlaylistDescriptionAndCoverAreRefreshed(t *testing.T) {
+	oldTemplate, oldCovers, oldRefresh := descriptionTemplate, coversEnabled, descriptionRefresh
+	t.Cleanup(func() { descriptionTemplate, coversEnabled, descriptionRefresh = oldTemplate, oldCovers, oldRefresh })
+	descriptionTemplate = "From SONiC 102.9.\n{{.Tracks}} songs, top artist this week {{.TopArtist}}, updated {{.Updated}}"
+	coversEnabled, descriptionRefresh = true, 10*time.Millisecond
+	env := newTestEnv(t)
+	clock = newFixedClock(time.Date(2021, 7, 1, 12, 30, 0, 0, stationTimeZone))
+
+	colours := map[string]color.Color{
+		"red": color.RGBA{255, 0, 0, 255}, "green": color.RGBA{0, 255, 0, 255},
+		"blue": color.RGBA{0, 0, 255, 255}, "white": color.RGBA{255, 255, 255, 255},
+	}
+	art := serveArt(t, colours)
+	played := []SonicInfo{}
+	for i, name := range []string{"white", "blue", "green", "red"} {
+		id := "t" + name
+		artist := "B"
+		if i%2 == 0 {
+			artist = "A"
+		}
+		env.spotify.AddTrack(id, name, artist)
+		env.spotify.SetCover(id, art.URL+"/"+name+".jpg")
+		played = append(played, songAt(artist+" - "+name, id, time.Date(2021, 7, 1, 12, 4*i, 0, 0, stationTimeZone).Format("2006-01-02 15:04:05")))
+	}
+	env.spotify.AddTrack("tmore", "more", "A")
+	played = append(played, songAt("A - more", "tmore", "2021-07-01 11:00:00"))
+	env.station.played(played...)
+
+	env.login(t)
+
+	want := "From SONiC 102.9. 5 songs, top artist this week A, updated Jul 1 12:30"
+	waitFor(t, "the description", func() bool {
+		p := env.spotify.Playlist(playlistName)
+		return p != nil && p.Description == want
+	})
+	waitFor(t, "the cover", func() bool { return len(env.spotify.Playlist(playlistName).Image) > 0 })
+
+	cover, err := jpeg.Decode(bytes.NewReader(env.spotify.Playlist(playlistName).Image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := cover.Bounds().Size(); size.X != coverGrid*coverSize || size.Y != coverGrid*coverSize {
+		t.Fatalf("the cover is %v", size)
+	}
+	// the latest song first
+	for i, name := range []string{"red", "green", "blue", "white"} {
+		r, g, b, _ := cover.At(i%coverGrid*coverSize+coverSize/2, i/coverGrid*coverSize+coverSize/2).RGBA()
+		wr, wg, wb, _ := colours[name].RGBA()
+		if diff(r, wr) > 0x2000 || diff(g, wg) > 0x2000 || diff(b, wb) > 0x2000 {
+			t.Errorf("tile %d isn't %s", i, name)
+		}
+	}
+}
+
+func diff(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a Plex Media Server to keep playlists on, and which of its music libraries
+// to match against, the first one when empty
+var plexURL = strings.TrimSuffix(envOr("PLEX_URL", ""), "/")
+var plexToken = envOr("PLEX_TOKEN", "")
+var plexSection = envOr("PLEX_SECTION", "")
+
+// Plex won't make an empty playlist, so a new one is only made when the
+// first songs go in. Until then its ID is this and the playlist's name.
+const plexPendingPrefix = "pending:"
+
+// plexSink keeps audio playlists on a Plex server, matching aired songs
+// against one of its music libraries by artist and title
+type plexSink struct {
+	baseURL string
+	token   string
+	// the server's ID, which item URIs need
+	machineId string
+	// the library section searched
+	sectionId string
+
+	*matcher
+
+	mu sync.Mutex
+	// real IDs of the playlists made since they were pending
+	made map[string]string
+}
+
+// what Plex answers with, only the parts the sink reads
+type plexContainer struct {
+	MediaContainer struct {
+		MachineIdentifier string          `json:"machineIdentifier"`
+		Directory         []plexDirectory `json:"Directory"`
+		Metadata          []plexMetadata  `json:"Metadata"`
+	} `json:"MediaContainer"`
+}
+
+type plexDirectory struct {
+	Key   string `json:"key"`
+	Type  string `json:"type"`
+	Title string `json:"title"`
+}
+
+type plexMetadata struct {
+	RatingKey string `json:"ratingKey"`
+	Title     string `json:"title"`
+	// the album artist, and the track's own when it differs
+	GrandparentTitle string `json:"grandparentTitle"`
+	OriginalTitle    string `json:"originalTitle"`
+	// in milliseconds
+	Duration       int  `json:"duration"`
+	PlaylistItemId int  `json:"playlistItemID"`
+	Smart          bool `json:"smart"`
+}
+
+func newPlexSink() (*plexSink, error) {
+	if plexURL == "" || plexToken == "" {
+		return nil, fmt.Errorf("the plex sink needs PLEX_URL and PLEX_TOKEN")
+	}
+	s := &plexSink{baseURL: plexURL, token: plexToken, made: map[string]string{}}
+	s.matcher = newMatcher("Plex", s.search)
+
+	identity := plexContainer{}
+	if err := s.call("GET", "/identity", nil, &identity); err != nil {
+		return nil, err
+	}
+	s.machineId = identity.MediaContainer.MachineIdentifier
+
+	sections := plexContainer{}
+	if err := s.call("GET", "/library/sections", nil, &sections); err != nil {
+		return nil, err
+	}
+	for _, section := range sections.MediaContainer.Directory {
+		if section.Type == "artist" && (plexSection == "" || section.Title == plexSection) {
+			s.sectionId = section.Key
+			break
+		}
+	}
+	if s.sectionId == "" {
+		return nil, fmt.Errorf("no Plex music library called %q", plexSection)
+	}
+	return s, nil
+}
+
+func (s *plexSink) Name() string {
+	return "plex"
+}
+
+// makes a request with the token, decoding the answer into out if given
+func (s *plexSink) call(method string, path string, params url.Values, out interface{}) error {
+	endpoint := s.baseURL + path
+	if len(params) > 0 {
+		endpoint += "?" + params.Encode()
+	}
+	req, err := http.NewRequest(method, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Plex-Token", s.token)
+	req.Header.Set("X-Plex-Client-Identifier", "sonic-on-demand")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := checkResponse(res); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
+
+// makes a request that changes something, or notes it in a dry run
+func (s *plexSink) change(action string, method string, path string, params url.Values, out interface{}) error {
+	if dryRun {
+		recordDryRun(action, method, s.baseURL+path+"?"+params.Encode(), nil)
+		return nil
+	}
+	return s.call(method, path, params, out)
+}
+
+// the URI Plex wants for library items
+func (s *plexSink) itemsURI(ratingKeys []string) string {
+	return "server://" + s.machineId + "/com.plexapp.plugins.library/library/metadata/" + strings.Join(ratingKeys, ",")
+}
+
+// the ID of the named audio playlist, made or not yet
+func (s *plexSink) findPlaylist(name string) (string, error) {
+	playlists := plexContainer{}
+	if err := s.call("GET", "/playlists", url.Values{"playlistType": {"audio"}}, &playlists); err != nil {
+		return "", err
+	}
+	for _, playlist := range playlists.MediaContainer.Metadata {
+		if playlist.Title == name && !playlist.Smart {
+			return playlist.RatingKey, nil
+		}
+	}
+	return "", nil
+}
+
+func (s *plexSink) EnsurePlaylist(name string) (string, error) {
+	playlistId, err := s.findPlaylist(name)
+	if err != nil || playlistId != "" {
+		return playlistId, err
+	}
+	return plexPendingPrefix + name, nil
+}
+
+// the real ID for a playlist, "" if a pending one still hasn't been made
+func (s *plexSink) resolve(playlistId string) (string, error) {
+	if !strings.HasPrefix(playlistId, plexPendingPrefix) {
+		return playlistId, nil
+	}
+	s.mu.Lock()
+	made, ok := s.made[playlistId]
+	s.mu.Unlock()
+	if ok {
+		return made, nil
+	}
+	// made before a restart
+	return s.findPlaylist(strings.TrimPrefix(playlistId, plexPendingPrefix))
+}
+
+func (s *plexSink) List(playlistId string) ([]SinkTrack, error) {
+	tracks := []SinkTrack{}
+	playlistId, err := s.resolve(playlistId)
+	if err != nil || playlistId == "" {
+		return tracks, err
+	}
+
+	items := plexContainer{}
+	if err := s.call("GET", "/playlists/"+playlistId+"/items", nil, &items); err != nil {
+		return nil, err
+	}
+	for _, item := range items.MediaContainer.Metadata {
+		tracks = append(tracks, SinkTrack{
+			Id: fmt.Sprint(item.PlaylistItemId),
+			Song: Song{
+				Artist:   item.artist(),
+				Title:    item.Title,
+				Duration: time.Duration(item.Duration) * time.Millisecond,
+			},
+		})
+	}
+	return tracks, nil
+}
+
+// adds the songs the library has in one go, making the playlist with them
+// if it's still pending
+func (s *plexSink) Add(playlistId string, songs []Song) error {
+	ratingKeys := []string{}
+	for _, song := range songs {
+		ratingKey, err := s.match(song)
+		if err != nil {
+			return err
+		}
+		if ratingKey != "" {
+			ratingKeys = append(ratingKeys, ratingKey)
+		}
+	}
+	if len(ratingKeys) == 0 {
+		return nil
+	}
+
+	existing, err := s.resolve(playlistId)
+	if err != nil {
+		return err
+	}
+	if existing != "" {
+		return s.change(fmt.Sprintf("add %d song(s) to %s", len(ratingKeys), existing), "PUT", "/playlists/"+existing+"/items", url.Values{
+			"uri": {s.itemsURI(ratingKeys)},
+		}, nil)
+	}
+
+	name := strings.TrimPrefix(playlistId, plexPendingPrefix)
+	fmt.Println("Making Plex Playlist")
+	made := plexContainer{}
+	err = s.change(fmt.Sprintf("create playlist %q with %d song(s)", name, len(ratingKeys)), "POST", "/playlists", url.Values{
+		"type":  {"audio"},
+		"title": {name},
+		"smart": {"0"},
+		"uri":   {s.itemsURI(ratingKeys)},
+	}, &made)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+	if len(made.MediaContainer.Metadata) == 0 {
+		// the songs are in, the next Add finds the playlist by name
+		return nil
+	}
+	s.mu.Lock()
+	s.made[playlistId] = made.MediaContainer.Metadata[0].RatingKey
+	s.mu.Unlock()
+	return nil
+}
+
+// takes tracks out one at a time, Plex has no way to do several at once
+func (s *plexSink) Remove(playlistId string, tracks []SinkTrack) error {
+	playlistId, err := s.resolve(playlistId)
+	if err != nil || playlistId == "" {
+		return err
+	}
+	for _, track := range tracks {
+		if err := s.change("remove item "+track.Id+" from "+playlistId, "DELETE", "/playlists/"+playlistId+"/items/"+track.Id, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the rating key of the song in the music library, empty if it isn't there.
+// Plex matches part of the title, so it's searched for as aired and then
+// without the version notes the library may not have.
+func (s *plexSink) search(song Song) (string, error) {
+	want := songKey(song.Artist, song.Title)
+	queries := []string{song.Title}
+	if normalised := normaliseTitle(song.Title); !strings.EqualFold(normalised, song.Title) {
+		queries = append(queries, normalised)
+	}
+	for _, query := range queries {
+		found := plexContainer{}
+		err := s.call("GET", "/library/sections/"+s.sectionId+"/search", url.Values{
+			// tracks
+			"type":  {"10"},
+			"title": {query},
+		}, &found)
+		if err != nil {
+			return "", err
+		}
+		for _, track := range found.MediaContainer.Metadata {
+			if songKey(track.artist(), track.Title) == want {
+				return track.RatingKey, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// the track's artist, which Plex only gives separately when it isn't the
+// album's
+func (m plexMetadata) artist() string {
+	if m.OriginalTitle != "" {
+		return m.OriginalTitle
+	}
+	return m.GrandparentTitle
+}
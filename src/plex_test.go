@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePlex is a Plex server with one music library, answering to the token
+// "plex-token"
+type fakePlex struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	library   []plexMetadata
+	playlists []*fakePlexPlaylist
+	nextItem  int
+	creates   int
+}
+
+type fakePlexPlaylist struct {
+	plexMetadata
+	items []plexMetadata
+}
+
+func newFakePlex() *fakePlex {
+	f := &fakePlex{}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakePlex) addTrack(ratingKey, artist, title string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.library = append(f.library, plexMetadata{RatingKey: ratingKey, GrandparentTitle: artist, Title: title, Duration: 200000})
+}
+
+func (f *fakePlex) addPlaylist(name string, ratingKeys ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.makePlaylist(name, ratingKeys)
+}
+
+func (f *fakePlex) makePlaylist(name string, ratingKeys []string) *fakePlexPlaylist {
+	p := &fakePlexPlaylist{plexMetadata: plexMetadata{RatingKey: "pl" + strconv.Itoa(len(f.playlists)+1), Title: name}}
+	f.playlists = append(f.playlists, p)
+	f.addItems(p, ratingKeys)
+	return p
+}
+
+func (f *fakePlex) addItems(p *fakePlexPlaylist, ratingKeys []string) {
+	for _, key := range ratingKeys {
+		for _, track := range f.library {
+			if track.RatingKey == key {
+				f.nextItem++
+				track.PlaylistItemId = f.nextItem
+				p.items = append(p.items, track)
+			}
+		}
+	}
+}
+
+// the rating keys in the named playlist
+func (f *fakePlex) playlist(name string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, p := range f.playlists {
+		if p.Title == name {
+			keys := []string{}
+			for _, item := range p.items {
+				keys = append(keys, item.RatingKey)
+			}
+			return keys
+		}
+	}
+	return nil
+}
+
+// the rating keys in a server:// URI
+func uriKeys(uri string) []string {
+	return strings.Split(uri[strings.LastIndex(uri, "/")+1:], ",")
+}
+
+func (f *fakePlex) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("X-Plex-Token") != "plex-token" {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	answer := plexContainer{}
+	container := &answer.MediaContainer
+	q := r.URL.Query()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.URL.Path == "/identity":
+		container.MachineIdentifier = "fake-machine"
+	case r.URL.Path == "/library/sections":
+		container.Directory = []plexDirectory{{Key: "1", Type: "movie", Title: "Films"}, {Key: "2", Type: "artist", Title: "Music"}}
+	case r.URL.Path == "/library/sections/2/search":
+		for _, track := range f.library {
+			if strings.Contains(strings.ToLower(track.Title), strings.ToLower(q.Get("title"))) {
+				container.Metadata = append(container.Metadata, track)
+			}
+		}
+	case r.URL.Path == "/playlists" && r.Method == "GET":
+		for _, p := range f.playlists {
+			container.Metadata = append(container.Metadata, p.plexMetadata)
+		}
+	case r.URL.Path == "/playlists" && r.Method == "POST":
+		if !strings.HasPrefix(q.Get("uri"), "server://fake-machine/") {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		f.creates++
+		container.Metadata = append(container.Metadata, f.makePlaylist(q.Get("title"), uriKeys(q.Get("uri"))).plexMetadata)
+	case len(parts) >= 3 && parts[0] == "playlists" && parts[2] == "items":
+		var p *fakePlexPlaylist
+		for _, other := range f.playlists {
+			if other.RatingKey == parts[1] {
+				p = other
+			}
+		}
+		if p == nil {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			container.Metadata = p.items
+		case "PUT":
+			f.addItems(p, uriKeys(q.Get("uri")))
+		case "DELETE":
+			kept := []plexMetadata{}
+			for _, item := range p.items {
+				if len(parts) < 4 || strconv.Itoa(item.PlaylistItemId) != parts[3] {
+					kept = append(kept, item)
+				}
+			}
+			p.items = kept
+		}
+	default:
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(answer)
+}
+
+// usePlex points the sink at the fake for the rest of the test
+func usePlex(t *testing.T) *fakePlex {
+	fake := newFakePlex()
+	oldURL, oldToken, oldSection := plexURL, plexToken, plexSection
+	plexURL, plexToken, plexSection = fake.URL, "plex-token", ""
+	t.Cleanup(func() {
+		fake.Close()
+		plexURL, plexToken, plexSection = oldURL, oldToken, oldSection
+	})
+	return fake
+}
+
+func TestPlexSinkMakesThePlaylistWithTheFirstMatches(t *testing.T) {
+	env := newTestEnv(t)
+	fake := usePlex(t)
+	fake.addTrack("101", "A", "One")
+	fake.addTrack("102", "Local", "Demo")
+	enabledSinks = "spotify,plex"
+	env.station.play(song("A - One", "track1"), song("Local - Demo (Radio Edit)", ""), song("B - Two", "track2"))
+
+	env.login(t)
+
+	playlistsByTitle(t, "A - One", "Local - Demo (Radio Edit)", "B - Two")
+	waitFor(t, "the library's songs", func() bool {
+		return sameTracks(fake.playlist("SONiC On Demand"), []string{"101", "102"})
+	})
+	waitFor(t, "the Spotify songs", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist("SONiC On Demand")), []string{"track1", "track2"})
+	})
+	fake.mu.Lock()
+	creates := fake.creates
+	fake.mu.Unlock()
+	if creates != 1 {
+		t.Errorf("made the playlist %d times", creates)
+	}
+	if misses := sinksByName["plex"].(*plexSink).Misses(); len(misses) != 1 || misses[0].Title != "Two" {
+		t.Errorf("reported misses %+v, want B - Two", misses)
+	}
+}
+
+func TestPlexSinkPicksUpWhereThePlaylistLeftOff(t *testing.T) {
+	env := newTestEnv(t)
+	fake := usePlex(t)
+	fake.addTrack("101", "A", "One")
+	fake.addTrack("103", "C", "Three")
+	fake.addPlaylist("SONiC On Demand", "101")
+	enabledSinks = "plex"
+	env.station.play(song("A - One", "track1"), song("C - Three", "track3"))
+
+	if err := startSession(nil); err != nil {
+		t.Fatal(err)
+	}
+	startTasks(nil)
+
+	playlists := playlistsByTitle(t, "A - One", "C - Three")
+	waitFor(t, "the new song", func() bool {
+		return sameTracks(fake.playlist("SONiC On Demand"), []string{"101", "103"})
+	})
+	if len(playlists["A - One"]) != 0 {
+		t.Errorf("A - One was queued again for %v", playlists["A - One"])
+	}
+
+	target := mainTarget("plex")
+	tracks, err := target.sink.List(target.playlistId)
+	if err != nil || len(tracks) != 2 || tracks[1].Artist != "C" {
+		t.Fatalf("listed %+v, %v", tracks, err)
+	}
+	if err := target.sink.Remove(target.playlistId, tracks[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.playlist("SONiC On Demand"); !sameTracks(got, []string{"103"}) {
+		t.Errorf("playlist has %v after removing 101", got)
+	}
+}
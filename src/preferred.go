@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// whether to swap the track the feed links, or the search finds, for the
+// original release of the song, and which of its explicit and clean
+// versions to take: "explicit", "clean" or either when empty
+var preferOriginals = envOr("PREFER_ORIGINALS", "") == "true"
+var preferExplicit = envOr("PREFER_EXPLICIT", "")
+
+// words that make a track another recording than the one aired, unless the
+// aired title says so too
+var otherVersion = regexp.MustCompile(`(?i)\b(live|remix(ed)?|acoustic|demo|instrumental|karaoke)\b`)
+
+// album names that are really compilations, whatever Spotify calls them:
+// "Greatest Hits", "The Very Best of", "The Essential Johnny Cash", "The
+// Ultimate Collection", "Number Ones", or "Gold" on its own or before a colon
+var compilationName = regexp.MustCompile(`(?i)(\b(greatest|biggest) hits\b|\bbest of\b|^the essential\b|\b(the|complete|definitive|essential|ultimate) collection\b|\bnumber ones\b|#1s\b|^gold\s*(:|$))`)
+
+// versionTrack is a Spotify track with what's needed to tell its releases
+// apart
+type versionTrack struct {
+	SearchTrack
+	playable
+	Explicit bool `json:"explicit"`
+	Album    struct {
+		Name        string `json:"name"`
+		AlbumType   string `json:"album_type"`
+		ReleaseDate string `json:"release_date"`
+	} `json:"album"`
+}
+
+// the preferred track for each track looked at and the title it aired as, so
+// each is only resolved once
+var preferredVersions = struct {
+	sync.Mutex
+	byTrack map[string]string
+}{byTrack: map[string]string{}}
+
+// the best release of the aired song, which is the track given when nothing
+// beats it. The other releases are found by the track's ISRC and by the
+// aired artist and title, in the user's market so a release that can't be
+// played there isn't picked.
+func preferredVersion(client *http.Client, trackId string, artist string, title string) (string, error) {
+	key := trackId + "|" + title
+	preferredVersions.Lock()
+	preferred, ok := preferredVersions.byTrack[key]
+	preferredVersions.Unlock()
+	if ok {
+		return preferred, nil
+	}
+
+	linked := versionTrack{}
+	if err := getSpotify(client, spotifyURL(getTrackURL)+url.PathEscape(trackId), &linked); err != nil {
+		return "", err
+	}
+	queries := []string{fmt.Sprintf("track:%s artist:%s", normaliseTitle(title), normaliseArtist(artist))}
+	if linked.ExternalIds.ISRC != "" {
+		queries = append(queries, "isrc:"+linked.ExternalIds.ISRC)
+	}
+
+	best, want := linked, songKey(artist, title)
+	for _, query := range queries {
+		found := struct {
+			Tracks struct {
+				Items []versionTrack `json:"items"`
+			} `json:"tracks"`
+		}{}
+		searched := spotifyURL(searchURL) + url.QueryEscape(query) + "&market=" + url.QueryEscape(currentMarket)
+		if err := getSpotify(client, searched, &found); err != nil {
+			return "", err
+		}
+		for _, candidate := range found.Tracks.Items {
+			sameRecording := linked.ExternalIds.ISRC != "" && candidate.ExternalIds.ISRC == linked.ExternalIds.ISRC
+			if candidate.unplayableReason() != "" {
+				continue
+			}
+			if (sameRecording || songKey(candidate.artist(), candidate.Name) == want) && betterVersion(candidate, best, title) {
+				best = candidate
+			}
+		}
+	}
+
+	if best.Id != trackId {
+		fmt.Printf("Preferring %s (%s) over %s (%s) for %s - %s\n", best.Id, best.Album.Name, trackId, linked.Album.Name, artist, title)
+	}
+	preferredVersions.Lock()
+	preferredVersions.byTrack[key] = best.Id
+	preferredVersions.Unlock()
+	return best.Id, nil
+}
+
+// whether a is a better release of the aired title than b. In order: a
+// live take or remix only when the title is one too, the explicit or clean
+// version as set, an album over a single over a compilation, then the
+// earliest. b wins a tie, so the linked track stays unless beaten.
+func betterVersion(a versionTrack, b versionTrack, airedTitle string) bool {
+	for _, rank := range []func(t versionTrack) int{
+		func(t versionTrack) int {
+			if versionWords(t.Name+" "+t.Album.Name) == versionWords(airedTitle) {
+				return 1
+			}
+			return 0
+		},
+		func(t versionTrack) int {
+			if (preferExplicit == "explicit" && t.Explicit) || (preferExplicit == "clean" && !t.Explicit) {
+				return 1
+			}
+			return 0
+		},
+		func(t versionTrack) int {
+			if compilationName.MatchString(t.Album.Name) {
+				return 0
+			}
+			switch t.Album.AlbumType {
+			case "album":
+				return 2
+			case "single":
+				return 1
+			}
+			return 0
+		},
+	} {
+		if ra, rb := rank(a), rank(b); ra != rb {
+			return ra > rb
+		}
+	}
+	// "1994" sorts before "1994-03-08", which is fine for telling decades of
+	// reissues apart
+	return a.Album.ReleaseDate != "" && (b.Album.ReleaseDate == "" || a.Album.ReleaseDate < b.Album.ReleaseDate)
+}
+
+// the words in s that make a track another recording, sorted and once each
+// so "Remix (Live)" and "Live Remix" are the same: "live remix"
+func versionWords(s string) string {
+	words := []string{}
+	for _, word := range otherVersion.FindAllString(strings.ToLower(s), -1) {
+		word = strings.TrimSuffix(word, "ed")
+		if indexOf(words, word) < 0 {
+			words = append(words, word)
+		}
+	}
+	sort.Strings(words)
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+)
+
+// releases of One: the compilation the feed links, the album it first came
+// out on in explicit and clean versions, the single before it and a live take
+func addOneReleases(env *testEnv) {
+	for _, r := range []struct{ id, name, album, albumType, date, isrc string }{
+		{"best", "One", "Greatest Hits", "compilation", "2010-05-01", "CA0000000001"},
+		{"single", "One", "One", "single", "1993-11-01", "CA0000000001"},
+		{"album", "One", "First Album", "album", "1994-03-08", "CA0000000001"},
+		{"clean", "One", "First Album", "album", "1994-03-08", "CA0000000009"},
+		{"remaster", "One - 2014 Remaster", "First Album (Deluxe)", "album", "2014-03-08", "CA0000000014"},
+		{"live", "One - Live", "Live at Home", "album", "1996-06-01", "CA0000000002"},
+	} {
+		env.spotify.AddTrack(r.id, r.name, "A")
+		env.spotify.SetAlbum(r.id, r.album, r.albumType, r.date)
+		env.spotify.SetISRC(r.id, r.isrc)
+	}
+	env.spotify.SetExplicit("album")
+	env.spotify.SetExplicit("remaster")
+}
+
+func TestPreferredVersionsAreSwappedIn(t *testing.T) {
+	oldPrefer, oldExplicit := preferOriginals, preferExplicit
+	t.Cleanup(func() {
+		preferOriginals, preferExplicit = oldPrefer, oldExplicit
+		preferredVersions.byTrack = map[string]string{}
+	})
+	preferOriginals, preferExplicit = true, "clean"
+	env := newTestEnv(t)
+	addOneReleases(env)
+	env.station.played(
+		songAt("A - One", "best", "2021-07-01 12:00:00"),
+		songAt("A - One (Live)", "best", "2021-07-01 12:04:00"),
+	)
+
+	env.login(t)
+
+	waitFor(t, "the preferred versions", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist(playlistName)), []string{"clean", "live"})
+	})
+	for _, record := range historyRecords() {
+		if record.ReplacedSpotifyId != "best" {
+			t.Errorf("%s replaced %q, want the compilation", record.SongTitle, record.ReplacedSpotifyId)
+		}
+	}
+}
+
+func TestPreferredVersionIsPlayableInTheMarket(t *testing.T) {
+	oldPrefer, oldExplicit := preferOriginals, preferExplicit
+	t.Cleanup(func() {
+		preferOriginals, preferExplicit = oldPrefer, oldExplicit
+		preferredVersions.byTrack = map[string]string{}
+	})
+	preferOriginals, preferExplicit = true, ""
+	env := newTestEnv(t)
+	addOneReleases(env)
+	env.spotify.Restrict("album", "market")
+	env.station.played(songAt("A - One", "best", "2021-07-01 12:00:00"))
+
+	env.login(t)
+
+	// the clean album is the best release left that plays in the market
+	waitFor(t, "the playable release", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist(playlistName)), []string{"clean"})
+	})
+}
+
+func TestBetterVersion(t *testing.T) {
+	oldExplicit := preferExplicit
+	defer func() { preferExplicit = oldExplicit }()
+
+	release := func(name, album, albumType, date string, explicit bool) versionTrack {
+		t := versionTrack{Explicit: explicit}
+		t.Name, t.Album.Name, t.Album.AlbumType, t.Album.ReleaseDate = name, album, albumType, date
+		return t
+	}
+	original := release("One", "First Album", "album", "1994-03-08", true)
+	for _, c := range []struct {
+		explicit string
+		a, b     versionTrack
+		aired    string
+		want     bool
+	}{
+		{"", original, release("One", "Greatest Hits", "album", "2010", true), "One", true},
+		{"", original, release("One", "One", "single", "1993", true), "One", true},
+		{"", original, release("One", "First Album", "album", "1994-03-08", false), "One", false},
+		{"clean", original, release("One", "First Album", "album", "1994-03-08", false), "One", false},
+		{"explicit", original, release("One", "First Album", "album", "1994-03-08", false), "One", true},
+		{"", original, release("One - Remix", "Remixes", "album", "1990", true), "One", true},
+		{"", original, release("One - Remixed", "Remixes", "album", "1999", true), "One (Remix)", false},
+		{"", release("One - 2014 Remaster", "First Album", "album", "2014", true), original, "One", false},
+	} {
+		preferExplicit = c.explicit
+		if got := betterVersion(c.a, c.b, c.aired); got != c.want {
+			t.Errorf("%+v better than %+v for %q with %q preferred = %t", c.a, c.b, c.aired, c.explicit, got)
+		}
+	}
+}
+
+func TestCompilationNames(t *testing.T) {
+	for name, want := range map[string]bool{
+		"Greatest Hits":                  true,
+		"The Very Best of Fleetwood Mac": true,
+		"Best Of":                        true,
+		"The Essential Johnny Cash":      true,
+		"The Ultimate Collection":        true,
+		"Number Ones":                    true,
+		"Gold":                           true,
+		"Gold: Greatest Hits":            true,
+		"Heart of Gold":                  false,
+		"Fool's Gold":                    false,
+		"Hits Different":                 false,
+		"Collection of Thoughts":         false,
+		"First Album":                    false,
+	} {
+		if got := compilationName.MatchString(name); got != want {
+			t.Errorf("%q is a compilation = %t, want %t", name, got, want)
+		}
+	}
+	if a, b := versionWords("One (Remix) - Live"), versionWords("Live Remix of One"); a != b {
+		t.Errorf("the same version words gave %q and %q", a, b)
+	}
+}
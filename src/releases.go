@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// whether to keep a playlist for each decade songs were released in, from
+// the first decade on, and one of songs released within the last
+// newReleaseMonths
+var decadesEnabled = envOr("DECADE_PLAYLISTS", "") == "true"
+var firstDecade = 1960
+var newReleasesEnabled = envOr("NEW_RELEASES_PLAYLIST", "") == "true"
+var newReleaseMonths = 6
+
+var newReleasesName = derivedPlaylistPrefix + "New Releases"
+
+func init() {
+	if year, err := strconv.Atoi(os.Getenv("DECADES_FROM")); err == nil {
+		firstDecade = year / 10 * 10
+	}
+	if months, err := strconv.Atoi(os.Getenv("NEW_RELEASE_MONTHS")); err == nil {
+		newReleaseMonths = months
+	}
+}
+
+// "SONiC 90s" for the nineties, "SONiC 2010s" for the twenty-tens
+func decadeName(decade int) string {
+	if decade < 2000 {
+		return fmt.Sprintf("SONiC %02ds", decade%100)
+	}
+	return fmt.Sprintf("SONiC %ds", decade)
+}
+
+// a playlist for each decade up to this one and the new releases, which go
+// by the release date of the track's album on Spotify
+func releasePlaylists(client *http.Client) ([]derivedPlaylist, error) {
+	if !decadesEnabled && !newReleasesEnabled {
+		return nil, nil
+	}
+	if client == nil {
+		return nil, fmt.Errorf("decade and new release playlists need Spotify's release dates, add spotify to SINKS")
+	}
+	cache, err := openTrackCache(client)
+	if err != nil {
+		return nil, err
+	}
+	released := cache.songReleased
+
+	playlists := []derivedPlaylist{}
+	if decadesEnabled {
+		for decade := firstDecade; decade <= clock.Now().Year(); decade += 10 {
+			decade := decade
+			playlists = append(playlists, derivedPlaylist{
+				name: decadeName(decade),
+				fits: func(song Song) bool {
+					date, known := released(song)
+					return known && date.Year()/10*10 == decade
+				},
+			})
+		}
+	}
+	if newReleasesEnabled {
+		playlists = append(playlists, derivedPlaylist{
+			name: newReleasesName,
+			fits: func(song Song) bool {
+				date, known := released(song)
+				return known && !date.Before(newReleaseCutoff())
+			},
+			// songs whose date isn't known stay, they went in when it was
+			prune: func(song Song) bool {
+				date, known := released(song)
+				return known && date.Before(newReleaseCutoff())
+			},
+		})
+	}
+	return playlists, nil
+}
+
+// songs released before this are no longer new
+func newReleaseCutoff() time.Time {
+	return clock.Now().AddDate(0, -newReleaseMonths, 0)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseReleaseDate(t *testing.T) {
+	for date, want := range map[string]time.Time{
+		"1994-03-08": time.Date(1994, 3, 8, 0, 0, 0, 0, time.UTC),
+		"1994-03":    time.Date(1994, 3, 1, 0, 0, 0, 0, time.UTC),
+		"1994":       time.Date(1994, 1, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		if got, ok := parseReleaseDate(date); !ok || !got.Equal(want) {
+			t.Errorf("parseReleaseDate(%q) = %s, %v", date, got, ok)
+		}
+	}
+	for _, date := range []string{"", "0000", "soon"} {
+		if _, ok := parseReleaseDate(date); ok {
+			t.Errorf("parseReleaseDate(%q) gave a date", date)
+		}
+	}
+	if decadeName(1990) != "SONiC 90s" || decadeName(1960) != "SONiC 60s" || decadeName(2000) != "SONiC 2000s" {
+		t.Errorf("decades are named %q, %q and %q", decadeName(1990), decadeName(1960), decadeName(2000))
+	}
+}
+
+func TestReleasePlaylistsAgeOutNewReleases(t *testing.T) {
+	oldDecades, oldNew, oldPrune := decadesEnabled, newReleasesEnabled, pruneInterval
+	t.Cleanup(func() { decadesEnabled, newReleasesEnabled, pruneInterval = oldDecades, oldNew, oldPrune })
+	decadesEnabled, newReleasesEnabled, pruneInterval = true, true, 10*time.Millisecond
+	env := newTestEnv(t)
+	at := newFixedClock(time.Date(2021, 7, 1, 12, 30, 0, 0, stationTimeZone))
+	clock = at
+
+	for id, date := range map[string]string{"t1": "1994-03-08", "t2": "2003", "t3": "2021-05-01", "t4": "2021-01-15", "t5": "0000"} {
+		env.spotify.AddTrack(id, id, "A")
+		env.spotify.SetReleaseDate(id, date)
+	}
+	env.station.played(
+		songAt("A - t1", "t1", "2021-07-01 12:00:00"),
+		songAt("A - t2", "t2", "2021-07-01 12:04:00"),
+		songAt("A - t3", "t3", "2021-07-01 12:08:00"),
+		songAt("A - t4", "t4", "2021-07-01 12:12:00"),
+		songAt("A - t5", "t5", "2021-07-01 12:16:00"),
+	)
+
+	env.login(t)
+
+	for name, want := range map[string][]string{
+		"SONiC 90s":            {"t1"},
+		"SONiC 2000s":          {"t2"},
+		"SONiC 2020s":          {"t3", "t4"},
+		"SONiC 60s":            {},
+		"SONiC – New Releases": {"t3", "t4"},
+	} {
+		waitFor(t, name, func() bool {
+			p := env.spotify.Playlist(name)
+			return p != nil && sameTracks(tracksOf(p), want)
+		})
+	}
+
+	// six months on from the middle of January is past the start of August
+	at.set(time.Date(2021, 8, 1, 12, 0, 0, 0, stationTimeZone))
+	waitFor(t, "t4 aged out", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist("SONiC – New Releases")), []string{"t3"})
+	})
+	if got := tracksOf(env.spotify.Playlist("SONiC 2020s")); !sameTracks(got, []string{"t3", "t4"}) {
+		t.Errorf("the 2020s lost songs, has %q", got)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// when set, every now playing response is appended here so it can be replayed
+var recordFeedPath = os.Getenv("RECORD_FEED")
+
+// one line of a recording: what the station answered and when
+type recordedPoll struct {
+	At       time.Time       `json:"at"`
+	Response json.RawMessage `json:"response"`
+}
+
+// appends a now playing response to a recording
+func recordPoll(path string, body []byte) error {
+	line, err := json.Marshal(recordedPoll{At: clock.Now(), Response: json.RawMessage(bytes.TrimSpace(body))})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// reads a recording, oldest poll first
+func loadRecording(path string) ([]recordedPoll, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	polls := []recordedPoll{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		poll := recordedPoll{}
+		if err := json.Unmarshal(scanner.Bytes(), &poll); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err.Error())
+		}
+		polls = append(polls, poll)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(polls) == 0 {
+		return nil, fmt.Errorf("%s: no polls recorded", path)
+	}
+
+	sort.SliceStable(polls, func(i, j int) bool { return polls[i].At.Before(polls[j].At) })
+	return polls, nil
+}
+
+// feedTransport answers requests for the now playing widget from a
+// recording, going by the clock, and passes everything else through
+type feedTransport struct {
+	polls []recordedPoll
+	next  http.RoundTripper
+
+	// closed once the clock has gone past the last recorded poll
+	finished chan struct{}
+	once     sync.Once
+}
+
+func (t *feedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.String() != sonicNowPlayingURL {
+		return t.next.RoundTrip(req)
+	}
+
+	now := clock.Now()
+	body := []byte("{}")
+	for _, poll := range t.polls {
+		if poll.At.After(now) {
+			break
+		}
+		body = poll.Response
+	}
+	if !now.Before(t.polls[len(t.polls)-1].At) {
+		t.once.Do(func() { close(t.finished) })
+	}
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// runs MainTask over a recording on a virtual clock, speed times faster than
+// real time, against the fake Spotify at spotifyBase. Returns the ID of the
+// playlist it filled.
+func replayOn(path string, speed float64, spotifyBase string) (string, error) {
+	if speed <= 0 {
+		return "", fmt.Errorf("speed must be above 0")
+	}
+	polls, err := loadRecording(path)
+	if err != nil {
+		return "", err
+	}
+
+	feed := &feedTransport{polls: polls, next: http.DefaultTransport, finished: make(chan struct{})}
+	virtual := newVirtualClock(polls[0].At.Add(-pollInterval), speed)
+	defer virtual.Close()
+
+	oldAPI, oldEndpoint, oldClient, oldClock, oldCtx := spotifyAPIURL, config.Endpoint, httpClient, clock, ctx
+	oldOutbox, oldOutboxInterval, oldHistory, oldSinks := outboxPath, outboxInterval, historyPath, enabledSinks
+	defer func() {
+		spotifyAPIURL, config.Endpoint, httpClient, clock, ctx = oldAPI, oldEndpoint, oldClient, oldClock, oldCtx
+		outboxPath, outboxInterval, historyPath, enabledSinks = oldOutbox, oldOutboxInterval, oldHistory, oldSinks
+		resetOutbox()
+		resetHistory()
+	}()
+	spotifyAPIURL = spotifyBase + "/v1"
+	config.Endpoint = oauth2.Endpoint{AuthURL: spotifyBase + "/authorize", TokenURL: spotifyBase + "/api/token"}
+	httpClient = &http.Client{Transport: feed}
+	clock = virtual
+	// keep the replay's queue and history away from the real ones, and only
+	// let the queue tick alongside polls so virtual time doesn't move on in
+	// the middle of one
+	outboxPath, outboxInterval, historyPath = "", pollInterval, ""
+	// the replay only knows what the fake Spotify ends up with
+	enabledSinks = "spotify"
+	resetOutbox()
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithCancel(oldCtx)
+	defer cancel()
+
+	client := spotifyClient(&oauth2.Token{AccessToken: "replay", Expiry: time.Now().Add(24 * time.Hour)})
+	if err := startSession(client); err != nil {
+		return "", err
+	}
+
+	var running sync.WaitGroup
+	running.Add(2)
+	go func() {
+		defer running.Done()
+		MainTask(client)
+	}()
+	go func() {
+		defer running.Done()
+		runOutbox()
+	}()
+	select {
+	case <-feed.finished:
+	case <-oldCtx.Done():
+	}
+	cancel()
+	running.Wait()
+
+	// send whatever the last polls queued
+	if err := flushOutbox(); err != nil {
+		return "", err
+	}
+
+	return mainTarget("spotify").playlistId, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdvdb/SONiC-On-Demand/fakespotify"
+)
+
+// replay runs a recording against a fake Spotify of its own and returns the
+// playlist it ended up with
+func replay(path string, speed float64) ([]string, error) {
+	fake := fakespotify.New()
+	defer fake.Close()
+	playlistId, err := replayOn(path, speed, fake.URL)
+	if err != nil {
+		return nil, err
+	}
+	if p := fake.PlaylistById(playlistId); p != nil {
+		return p.Tracks, nil
+	}
+	return nil, nil
+}
+
+// writeRecording saves songs as a recording, each aired at the given offset
+// in minutes after noon
+func writeRecording(t *testing.T, polls map[float64]SonicInfo) string {
+	t.Helper()
+	noon := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	lines := []string{}
+	for minutes, info := range polls {
+		response, _ := json.Marshal(info)
+		line, _ := json.Marshal(recordedPoll{
+			At:       noon.Add(time.Duration(minutes * float64(time.Minute))),
+			Response: response,
+		})
+		lines = append(lines, string(line))
+	}
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReplayDrivesMainTaskOnVirtualTime(t *testing.T) {
+	newTestEnv(t)
+	pollInterval = 150 * time.Second
+
+	path := writeRecording(t, map[float64]SonicInfo{
+		0:   song("A - One", "track1"),
+		2:   song("A - One", "track1"),
+		4:   song("B - Two", "track2"),
+		5.5: song("Local - Demo", ""),
+		// gone before the next poll at 12:10, so it's never seen
+		8:  song("A - One", "track1"),
+		10: song("D - Four", "track3"),
+	})
+
+	began := time.Now()
+	tracks, err := replay(path, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"track1", "track2", "track3"}; !sameTracks(tracks, want) {
+		t.Errorf("replay left %v, want %v", tracks, want)
+	}
+	if elapsed := time.Since(began); elapsed > 2*time.Second {
+		t.Errorf("ten virtual minutes took %s", elapsed)
+	}
+	if _, ok := clock.(realClock); !ok {
+		t.Errorf("replay left the virtual clock in place")
+	}
+}
+
+func TestReplayRejectsBadInput(t *testing.T) {
+	newTestEnv(t)
+	path := writeRecording(t, map[float64]SonicInfo{0: song("A - One", "track1")})
+
+	if _, err := replay(path, 0); err == nil {
+		t.Errorf("replay accepted a speed of 0")
+	}
+	if _, err := replay(filepath.Join(t.TempDir(), "missing.jsonl"), 600); err == nil {
+		t.Errorf("replay accepted a missing recording")
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.jsonl")
+	ioutil.WriteFile(empty, []byte("\n"), 0644)
+	if _, err := replay(empty, 600); err == nil {
+		t.Errorf("replay accepted an empty recording")
+	}
+}
+
+func TestRecordFeedCapturesResponses(t *testing.T) {
+	env := newTestEnv(t)
+	recordFeedPath = filepath.Join(t.TempDir(), "capture.jsonl")
+	defer func() { recordFeedPath = "" }()
+
+	env.station.play(song("A - One", "track1"), song("B - Two", "track2"))
+	getNowPlaying()
+	getNowPlaying()
+
+	polls, err := loadRecording(recordFeedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(polls) != 2 {
+		t.Fatalf("recorded %d polls, want 2", len(polls))
+	}
+	got := SonicInfo{}
+	json.Unmarshal(polls[1].Response, &got)
+	if got.Spotify != "track2" {
+		t.Errorf("second poll recorded %+v", got)
+	}
+}
@@ -0,0 +1,47 @@
+//go:build replay
+// +build replay
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/jdvdb/SONiC-On-Demand/fakespotify"
+)
+
+// replays need the fake Spotify, which only builds in with -tags replay so
+// it stays out of the app itself
+
+func replayCommand(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	speed := flags.Float64("speed", 600, "how many times faster than real time to run")
+	flags.BoolVar(&dryRun, "dry-run", dryRun, "record playlist changes instead of making them on the fake")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: replay [-speed N] [-dry-run] recording.jsonl")
+	}
+
+	fake := fakespotify.New()
+	defer fake.Close()
+	playlistId, err := replayOn(flags.Arg(0), *speed, fake.URL)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		fmt.Print(dryRunSummary())
+		return nil
+	}
+
+	tracks := []string{}
+	if p := fake.PlaylistById(playlistId); p != nil {
+		tracks = p.Tracks
+	}
+	fmt.Printf("Playlist after replay (%d tracks):\n", len(tracks))
+	fmt.Println(strings.Join(tracks, "\n"))
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !replay
+// +build !replay
+
+package main
+
+import "fmt"
+
+func replayCommand(args []string) error {
+	return fmt.Errorf("replay is only in builds made with -tags replay")
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rules sending the airings that match them to playlists of their own, on
+// every sink beside the main one: "Playlist: condition, condition; Playlist:
+// ...". A condition is field=value, where the value can be several
+// separated by | or a range min..max with either end left out:
+//
+//	station=CHDI            the station it aired on
+//	time=06:00..10:00       when it aired, station time, the end not included
+//	day=mon..fri, day=sat|sun
+//	artist=Foo Fighters|Nirvana
+//	genre=indie|punk        whole words of any of its artists' genres
+//	energy=0.7..            or valence, danceability or tempo
+//	year=1990..1999         when its album came out
+//
+// An airing goes in every playlist whose conditions all hold.
+var routes = envOr("ROUTES", "")
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// routeCondition is one thing a rule asks of an airing
+type routeCondition struct {
+	field string
+	// any of which will do, for station, day, artist and genre
+	values []string
+	// for time, in minutes into the day, and for year and audio features,
+	// ends included but for time's
+	min float64
+	max float64
+}
+
+// routeRule is a playlist and what an airing needs to go in it
+type routeRule struct {
+	name       string
+	conditions []routeCondition
+}
+
+// reads rules in the form ROUTES takes
+func parseRoutes(spec string) ([]routeRule, error) {
+	rules := []routeRule{}
+	for _, part := range strings.Split(spec, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		nameAndConditions := strings.SplitN(part, ":", 2)
+		if len(nameAndConditions) != 2 || strings.TrimSpace(nameAndConditions[0]) == "" {
+			return nil, fmt.Errorf("route %q needs a playlist name, then a colon and its conditions", strings.TrimSpace(part))
+		}
+		rule := routeRule{name: strings.TrimSpace(nameAndConditions[0])}
+		for _, condition := range strings.Split(nameAndConditions[1], ",") {
+			if strings.TrimSpace(condition) == "" {
+				continue
+			}
+			parsed, err := parseRouteCondition(strings.TrimSpace(condition))
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %s", rule.name, err.Error())
+			}
+			rule.conditions = append(rule.conditions, parsed)
+		}
+		if len(rule.conditions) == 0 {
+			return nil, fmt.Errorf("route %q has no conditions", rule.name)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseRouteCondition(condition string) (routeCondition, error) {
+	fieldAndValue := strings.SplitN(condition, "=", 2)
+	if len(fieldAndValue) != 2 || strings.TrimSpace(fieldAndValue[1]) == "" {
+		return routeCondition{}, fmt.Errorf("condition %q isn't field=value", condition)
+	}
+	field, value := strings.ToLower(strings.TrimSpace(fieldAndValue[0])), strings.TrimSpace(fieldAndValue[1])
+	parsed := routeCondition{field: field, min: math.Inf(-1), max: math.Inf(1)}
+
+	switch field {
+	case "station", "artist", "genre":
+		for _, v := range strings.Split(value, "|") {
+			if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+				parsed.values = append(parsed.values, v)
+			}
+		}
+	case "day":
+		for _, v := range strings.Split(value, "|") {
+			days, err := parseDays(strings.ToLower(strings.TrimSpace(v)))
+			if err != nil {
+				return routeCondition{}, err
+			}
+			parsed.values = append(parsed.values, days...)
+		}
+	case "time":
+		ends := strings.SplitN(value, "..", 2)
+		if len(ends) != 2 {
+			return routeCondition{}, fmt.Errorf("time %q isn't from..to", value)
+		}
+		for i, limit := range []*float64{&parsed.min, &parsed.max} {
+			at, err := time.Parse("15:04", strings.TrimSpace(ends[i]))
+			if err != nil {
+				return routeCondition{}, fmt.Errorf("time %q isn't hh:mm..hh:mm", value)
+			}
+			*limit = float64(at.Hour()*60 + at.Minute())
+		}
+	case "year":
+		ends := strings.SplitN(value, "..", 2)
+		if len(ends) == 1 {
+			ends = append(ends, ends[0])
+		}
+		for i, limit := range []*float64{&parsed.min, &parsed.max} {
+			end := strings.TrimSpace(ends[i])
+			if end == "" {
+				continue
+			}
+			year, err := strconv.Atoi(end)
+			if err != nil {
+				return routeCondition{}, fmt.Errorf("year %q isn't a year or a range of them", value)
+			}
+			*limit = float64(year)
+		}
+	default:
+		band, err := parseBand(condition)
+		if err != nil {
+			return routeCondition{}, fmt.Errorf("unknown condition %q, use station, time, day, artist, genre, year or an audio feature", condition)
+		}
+		parsed.field, parsed.min, parsed.max = band.feature, band.min, band.max
+	}
+	if len(parsed.values) == 0 && (field == "station" || field == "artist" || field == "genre") {
+		return routeCondition{}, fmt.Errorf("condition %q has no values", condition)
+	}
+	return parsed, nil
+}
+
+// the days in "mon" or a range like "mon..fri", which can go over the
+// weekend as "fri..mon" does
+func parseDays(days string) ([]string, error) {
+	ends := strings.SplitN(days, "..", 2)
+	indexes := []int{}
+	for _, end := range ends {
+		i := indexOf(weekdays, strings.TrimSpace(end))
+		if i < 0 {
+			return nil, fmt.Errorf("day %q isn't one of %s", days, strings.Join(weekdays, ", "))
+		}
+		indexes = append(indexes, i)
+	}
+	if len(indexes) == 1 {
+		return []string{weekdays[indexes[0]]}, nil
+	}
+	found := []string{}
+	for i := indexes[0]; ; i = (i + 1) % len(weekdays) {
+		found = append(found, weekdays[i])
+		if i == indexes[1] {
+			return found, nil
+		}
+	}
+}
+
+func indexOf(list []string, s string) int {
+	for i, item := range list {
+		if item == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// routeFacts is what a rule can find out about a song beyond the airing,
+// known false when there's nothing to go by
+type routeFacts struct {
+	genres   func(song Song) ([]string, bool)
+	features func(song Song) (audioFeatures, bool)
+	released func(song Song) (time.Time, bool)
+}
+
+// whether the song meets every condition
+func (r routeRule) fits(song Song, facts routeFacts) bool {
+	for _, condition := range r.conditions {
+		if !condition.holds(song, facts) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c routeCondition) holds(song Song, facts routeFacts) bool {
+	aired := song.AiredAt.In(stationTimeZone)
+	switch c.field {
+	case "station":
+		return c.has(strings.ToLower(song.Station))
+	case "artist":
+		// written however the station and the rule like, and with whoever
+		// else is featured
+		artist := normaliseArtist(song.Artist)
+		for _, value := range c.values {
+			if normaliseArtist(value) == artist {
+				return true
+			}
+		}
+		return false
+	case "day":
+		return c.has(weekdays[aired.Weekday()])
+	case "time":
+		minute := float64(aired.Hour()*60 + aired.Minute())
+		if c.min <= c.max {
+			return minute >= c.min && minute < c.max
+		}
+		// over midnight
+		return minute >= c.min || minute < c.max
+	case "genre":
+		genres, known := facts.genres(song)
+		if !known {
+			return false
+		}
+		for _, genre := range genres {
+			for _, term := range c.values {
+				if genreHas(strings.ToLower(genre), term) {
+					return true
+				}
+			}
+		}
+		return false
+	case "year":
+		released, known := facts.released(song)
+		year := float64(released.Year())
+		return known && year >= c.min && year <= c.max
+	default:
+		features, known := facts.features(song)
+		value, _ := features.value(c.field)
+		return known && value >= c.min && value <= c.max
+	}
+}
+
+func (c routeCondition) has(value string) bool {
+	return indexOf(c.values, value) >= 0
+}
+
+// a playlist for each rule in ROUTES
+func routePlaylists(client *http.Client) ([]derivedPlaylist, error) {
+	rules, err := parseRoutes(routes)
+	if err != nil {
+		return nil, fmt.Errorf("ROUTES: %s", err.Error())
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	facts, err := spotifyFacts(client, rules)
+	if err != nil {
+		return nil, err
+	}
+
+	playlists := []derivedPlaylist{}
+	for _, rule := range rules {
+		rule := rule
+		playlists = append(playlists, derivedPlaylist{
+			name: rule.name,
+			fits: func(song Song) bool { return rule.fits(song, facts) },
+		})
+	}
+	return playlists, nil
+}
+
+// looks up what the rules ask of a track on Spotify, only opening the caches
+// some rule needs
+func spotifyFacts(client *http.Client, rules []routeRule) (routeFacts, error) {
+	facts := routeFacts{
+		genres:   func(Song) ([]string, bool) { return nil, false },
+		features: func(Song) (audioFeatures, bool) { return audioFeatures{}, false },
+		released: func(Song) (time.Time, bool) { return time.Time{}, false },
+	}
+	for _, rule := range rules {
+		for _, condition := range rule.conditions {
+			switch condition.field {
+			case "station", "time", "day", "artist":
+				continue
+			}
+			if client == nil {
+				return facts, fmt.Errorf("route %q goes by what Spotify knows of a track, add spotify to SINKS", rule.name)
+			}
+			switch condition.field {
+			case "genre":
+				cache, err := openTrackCache(client)
+				if err != nil {
+					return facts, err
+				}
+				cache.wantGenres()
+				facts.genres = cache.songGenres
+			case "year":
+				cache, err := openTrackCache(client)
+				if err != nil {
+					return facts, err
+				}
+				facts.released = cache.songReleased
+			default:
+				cache, err := openFeatureCache(client)
+				if err != nil {
+					return facts, err
+				}
+				facts.features = cache.songFeatures
+			}
+		}
+	}
+	return facts, nil
+}
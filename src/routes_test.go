@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jdvdb/SONiC-On-Demand/fakespotify"
+)
+
+func TestRouteConditions(t *testing.T) {
+	facts := routeFacts{
+		genres:   func(Song) ([]string, bool) { return []string{"Canadian Indie", "indie rock"}, true },
+		features: func(Song) (audioFeatures, bool) { return audioFeatures{Energy: 0.8, Tempo: 120}, true },
+		released: func(Song) (time.Time, bool) { return time.Date(1994, 3, 8, 0, 0, 0, 0, time.UTC), true },
+	}
+	// a Thursday
+	song := Song{Artist: "Arcade Fire feat. David Bowie", Title: "One", AiredAt: time.Date(2021, 7, 1, 23, 30, 0, 0, stationTimeZone), Station: "CHDI"}
+	for spec, want := range map[string]bool{
+		"station=chdi":                    true,
+		"station=CKUA":                    false,
+		"day=mon..fri":                    true,
+		"day=fri..mon":                    false,
+		"day=sat|thu":                     true,
+		"time=22:00..02:00":               true,
+		"time=06:00..23:30":               false,
+		"artist=foo fighters|arcade fire": true,
+		"artist=The Arcade Fire":          true,
+		"artist=david bowie":              false,
+		"genre=indie":                     true,
+		"genre=rock|punk":                 true,
+		"genre=pop":                       false,
+		"energy=0.7.., tempo=100..135":    true,
+		"energy=..0.5":                    false,
+		"year=1990..1999":                 true,
+		"year=1994":                       true,
+		"year=2000..":                     false,
+		"day=thu, time=23:00..23:59, year=..1999": true,
+	} {
+		rules, err := parseRoutes("Test: " + spec)
+		if err != nil {
+			t.Errorf("%s: %s", spec, err.Error())
+			continue
+		}
+		if got := rules[0].fits(song, facts); got != want {
+			t.Errorf("%s fits %v, want %v", spec, got, want)
+		}
+	}
+
+	// the station it aired on, not the one being polled now
+	rules, _ := parseRoutes("Test: station=CKUA")
+	song.Station = "CKUA"
+	if !rules[0].fits(song, facts) {
+		t.Errorf("a song aired on CKUA doesn't fit station=CKUA")
+	}
+
+	for _, spec := range []string{"Test", "Test: ", "Test: loudness=1..", "Test: day=someday", "Test: time=6..10", "Test: artist=", "Test: year=nineties"} {
+		if _, err := parseRoutes(spec); err == nil {
+			t.Errorf("parseRoutes(%q) gave no error", spec)
+		}
+	}
+}
+
+func TestRoutesSendAiringsToEveryPlaylistTheyMatch(t *testing.T) {
+	oldRoutes, oldFeatures := routes, audioFeaturesPath
+	t.Cleanup(func() { routes, audioFeaturesPath = oldRoutes, oldFeatures })
+	routes = "Lunch: day=mon..fri, time=12:00..12:10; Loud 90s: energy=0.7.., year=1990..1999; Indie: genre=indie"
+	audioFeaturesPath = ""
+	env := newTestEnv(t)
+
+	env.spotify.AddTrack("t1", "One", "Arcade Fire")
+	env.spotify.SetGenres("Arcade Fire", "canadian indie")
+	env.spotify.SetReleaseDate("t1", "2004-09-14")
+	env.spotify.AddTrack("t2", "Two", "Nirvana")
+	env.spotify.SetReleaseDate("t2", "1991-09-24")
+	env.spotify.SetFeatures("t2", fakespotify.Features{Energy: 0.9})
+	env.spotify.AddTrack("t3", "Three", "Beck")
+	env.spotify.SetReleaseDate("t3", "1994")
+	env.spotify.SetFeatures("t3", fakespotify.Features{Energy: 0.3})
+	env.station.played(
+		songAt("Arcade Fire - One", "t1", "2021-07-01 12:00:00"),
+		songAt("Nirvana - Two", "t2", "2021-07-01 12:04:00"),
+		songAt("Beck - Three", "t3", "2021-07-01 12:12:00"),
+	)
+
+	env.login(t)
+
+	for name, want := range map[string][]string{
+		"Lunch":      {"t1", "t2"},
+		"Loud 90s":   {"t2"},
+		"Indie":      {"t1"},
+		playlistName: {"t1", "t2", "t3"},
+	} {
+		waitFor(t, name, func() bool {
+			p := env.spotify.Playlist(name)
+			return p != nil && sameTracks(tracksOf(p), want)
+		})
+	}
+
+	records := historyRecords()
+	if len(records) != 3 || len(records[1].Playlists) != 3 {
+		t.Errorf("Two was put in %q, want the main playlist, Lunch and Loud 90s", records[1].Playlists)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// the station's weekly programme, one show a line: "sat 21:00..23:00
+// Saturday Night Mix". Days take the same forms as in ROUTES, and a show can
+// run over midnight. The times are in scheduleTimeZone.
+var scheduleFile = envOr("SCHEDULE_FILE", "")
+var scheduleTimeZone = loadTimeZone(envOr("SCHEDULE_TZ", envOr("STATION_TZ", "America/Edmonton")))
+
+// whether to keep a playlist per show, and whether each only holds the
+// songs since its latest episode began
+var showsEnabled = envOr("SHOW_PLAYLISTS", "") == "true"
+var showRollover = envOr("SHOW_ROLLOVER", "") == "true"
+
+// showSlot is when a show is on
+type showSlot struct {
+	name string
+	days []string
+	// minutes into the day it starts, and how long it runs
+	start    int
+	duration time.Duration
+}
+
+// the schedule read by loadSchedule, empty when there's none
+var schedule []showSlot
+
+// reads scheduleFile, if there is one
+func loadSchedule() error {
+	schedule = nil
+	if scheduleFile == "" {
+		return nil
+	}
+	file, err := os.Open(scheduleFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	slots := []showSlot{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		slot, err := parseShowSlot(text)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", scheduleFile, line, err.Error())
+		}
+		slots = append(slots, slot)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	schedule = slots
+	return nil
+}
+
+// reads "days hh:mm..hh:mm Show Name"
+func parseShowSlot(line string) (showSlot, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return showSlot{}, fmt.Errorf("%q isn't days, times and a show name", line)
+	}
+	slot := showSlot{name: strings.Join(fields[2:], " ")}
+	for _, days := range strings.Split(strings.ToLower(fields[0]), "|") {
+		parsed, err := parseDays(days)
+		if err != nil {
+			return showSlot{}, err
+		}
+		slot.days = append(slot.days, parsed...)
+	}
+
+	ends := strings.SplitN(fields[1], "..", 2)
+	minutes := []int{}
+	for _, end := range ends {
+		at, err := time.Parse("15:04", end)
+		if err != nil || len(ends) != 2 {
+			return showSlot{}, fmt.Errorf("times %q aren't hh:mm..hh:mm", fields[1])
+		}
+		minutes = append(minutes, at.Hour()*60+at.Minute())
+	}
+	slot.start = minutes[0]
+	length := minutes[1] - minutes[0]
+	if length <= 0 {
+		// over midnight
+		length += 24 * 60
+	}
+	slot.duration = time.Duration(length) * time.Minute
+	return slot, nil
+}
+
+// when the slot's episodes that start on the day of at begin, false if it's
+// not on that day
+func (s showSlot) startOn(at time.Time) (time.Time, bool) {
+	at = at.In(scheduleTimeZone)
+	if indexOf(s.days, weekdays[at.Weekday()]) < 0 {
+		return time.Time{}, false
+	}
+	return time.Date(at.Year(), at.Month(), at.Day(), s.start/60, s.start%60, 0, 0, scheduleTimeZone), true
+}
+
+// the show on at the time and when its episode began, empty when nothing
+// in the schedule was on. An earlier line wins where shows overlap.
+func showAt(at time.Time) (string, time.Time) {
+	for _, slot := range schedule {
+		// an episode from the day before may still be on
+		for _, day := range []time.Time{at, at.AddDate(0, 0, -1)} {
+			start, ok := slot.startOn(day)
+			if ok && !at.Before(start) && at.Before(start.Add(slot.duration)) {
+				return slot.name, start
+			}
+		}
+	}
+	return "", time.Time{}
+}
+
+// when the latest episode of the show to have begun by the time did, zero if
+// none has in the past week
+func latestEpisode(show string, at time.Time) time.Time {
+	latest := time.Time{}
+	for _, slot := range schedule {
+		if slot.name != show {
+			continue
+		}
+		for days := 0; days <= 7; days++ {
+			start, ok := slot.startOn(at.AddDate(0, 0, -days))
+			if ok && !start.After(at) && start.After(latest) {
+				latest = start
+			}
+		}
+	}
+	return latest
+}
+
+// a playlist for each show in the schedule, in the order they're first
+// listed
+func showPlaylists(client *http.Client) ([]derivedPlaylist, error) {
+	if !showsEnabled {
+		return nil, nil
+	}
+	if len(schedule) == 0 {
+		return nil, fmt.Errorf("show playlists need a schedule, set SCHEDULE_FILE")
+	}
+	playlists, seen := []derivedPlaylist{}, map[string]bool{}
+	for _, slot := range schedule {
+		if seen[slot.name] {
+			continue
+		}
+		seen[slot.name] = true
+		show := slot.name
+		playlist := derivedPlaylist{
+			name: derivedPlaylistPrefix + show,
+			fits: func(song Song) bool {
+				name, _ := showAt(song.AiredAt)
+				return name == show
+			},
+		}
+		if showRollover {
+			// only what aired since the latest episode began, songs with no
+			// airing to go by stay
+			playlist.prune = func(song Song) bool {
+				return !song.AiredAt.IsZero() && song.AiredAt.Before(latestEpisode(show, clock.Now()))
+			}
+			playlist.period = func(song Song) time.Time {
+				_, start := showAt(song.AiredAt)
+				return start
+			}
+		}
+		playlists = append(playlists, playlist)
+	}
+	return playlists, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSchedule points SCHEDULE_FILE at a file with the lines and loads it
+func writeSchedule(t *testing.T, lines string) {
+	path := filepath.Join(t.TempDir(), "schedule.txt")
+	if err := ioutil.WriteFile(path, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldFile, oldSchedule := scheduleFile, schedule
+	t.Cleanup(func() { scheduleFile, schedule = oldFile, oldSchedule })
+	scheduleFile = path
+	if err := loadSchedule(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShowAtGoesByTheWeeklySchedule(t *testing.T) {
+	writeSchedule(t, `# the weekday shows
+mon..fri 06:00..10:00 Morning Show
+fri|sat 22:00..02:00 Saturday Night Mix
+`)
+	at := func(day int, hour int, minute int) time.Time {
+		// July 2021 began on a Thursday
+		return time.Date(2021, 7, day, hour, minute, 0, 0, scheduleTimeZone)
+	}
+	for _, c := range []struct {
+		at      time.Time
+		show    string
+		episode time.Time
+	}{
+		{at(1, 6, 0), "Morning Show", at(1, 6, 0)},
+		{at(1, 10, 0), "", time.Time{}},
+		{at(3, 7, 0), "", time.Time{}},
+		{at(2, 23, 0), "Saturday Night Mix", at(2, 22, 0)},
+		// Friday's episode, after midnight
+		{at(3, 1, 59), "Saturday Night Mix", at(2, 22, 0)},
+		{at(4, 1, 0), "Saturday Night Mix", at(3, 22, 0)},
+		{at(4, 2, 0), "", time.Time{}},
+	} {
+		show, episode := showAt(c.at)
+		if show != c.show || !episode.Equal(c.episode) {
+			t.Errorf("at %s: %q from %s, want %q from %s", c.at, show, episode, c.show, c.episode)
+		}
+	}
+	if got, want := latestEpisode("Morning Show", at(4, 12, 0)), at(2, 6, 0); !got.Equal(want) {
+		t.Errorf("latest Morning Show began %s, want %s", got, want)
+	}
+
+	for _, line := range []string{"mon 06:00..10:00", "someday 06:00..10:00 Show", "mon 6..10 Show"} {
+		if _, err := parseShowSlot(line); err == nil {
+			t.Errorf("parseShowSlot(%q) gave no error", line)
+		}
+	}
+}
+
+func TestShowPlaylistsRollOverEachEpisode(t *testing.T) {
+	oldEnabled, oldRollover, oldPrune := showsEnabled, showRollover, pruneInterval
+	t.Cleanup(func() { showsEnabled, showRollover, pruneInterval = oldEnabled, oldRollover, oldPrune })
+	// the hourly check never comes round, the new episode's first song
+	// clears the playlist
+	showsEnabled, showRollover, pruneInterval = true, true, time.Hour
+	writeSchedule(t, "thu 12:00..12:10 Lunch Mix\nthu 12:10..13:00 Afternoon\n")
+	env := newTestEnv(t)
+	at := newFixedClock(time.Date(2021, 7, 1, 12, 30, 0, 0, stationTimeZone))
+	clock = at
+
+	env.station.played(
+		songAt("A - One", "t1", "2021-07-01 12:00:00"),
+		songAt("B - Two", "t2", "2021-07-01 12:04:00"),
+		songAt("C - Three", "t3", "2021-07-01 12:12:00"),
+	)
+
+	env.login(t)
+
+	waitFor(t, "Lunch Mix", func() bool {
+		p := env.spotify.Playlist("SONiC – Lunch Mix")
+		return p != nil && sameTracks(tracksOf(p), []string{"t1", "t2"})
+	})
+	waitFor(t, "Afternoon", func() bool {
+		p := env.spotify.Playlist("SONiC – Afternoon")
+		return p != nil && sameTracks(tracksOf(p), []string{"t3"})
+	})
+	for _, record := range historyRecords() {
+		if want := map[string]string{"One": "Lunch Mix", "Two": "Lunch Mix", "Three": "Afternoon"}[record.Title]; record.Show != want {
+			t.Errorf("%s is tagged with %q, want %q", record.Title, record.Show, want)
+		}
+	}
+
+	// the next week's episode starts the playlist again
+	at.set(time.Date(2021, 7, 8, 12, 1, 0, 0, stationTimeZone))
+	env.station.play(songAt("D - Four", "t4", "2021-07-08 12:00:00"))
+	waitFor(t, "only this week's Lunch Mix", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist("SONiC – Lunch Mix")), []string{"t4"})
+	})
+	if got := tracksOf(env.spotify.Playlist("SONiC – Afternoon")); !sameTracks(got, []string{"t3"}) {
+		t.Errorf("the Afternoon rolled over before its episode, has %q", got)
+	}
+}
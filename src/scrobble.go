@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// where each scrobbler keeps the plays it still has to send and the ones it
+// has, as scrobbles-<service>.json. Empty keeps them in memory.
+var scrobbleDir = dataDir
+
+// how often the history is checked for airings to scrobble
+var scrobbleInterval = 15 * time.Second
+
+// older plays are refused, so they aren't kept or sent
+const scrobbleMaxAge = 14 * 24 * time.Hour
+
+// scrobble is an airing as a play to log
+type scrobble struct {
+	// the airing's history key
+	Key       string        `json:"key"`
+	Artist    string        `json:"artist"`
+	Title     string        `json:"title"`
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	SpotifyId string        `json:"spotify_id,omitempty"`
+	Station   string        `json:"station,omitempty"`
+}
+
+// scrobbleService is somewhere plays are logged
+type scrobbleService interface {
+	// short and unique, used in config and file names
+	Name() string
+	// says what's on air now, nothing is kept if it fails
+	NowPlaying(play scrobble) error
+	// logs finished plays, oldest first
+	Scrobble(plays []scrobble) error
+	// the most plays Scrobble takes at once
+	BatchSize() int
+}
+
+// the play an airing is, as the feed's Song_title splits into artist and
+// title
+func (r HistoryRecord) play() scrobble {
+	return scrobble{
+		Key:       r.key(),
+		Artist:    r.Artist,
+		Title:     r.Title,
+		StartedAt: r.airedAt(),
+		Duration:  time.Duration(r.Length) * time.Second,
+		SpotifyId: r.SpotifyId,
+		Station:   r.Station,
+	}
+}
+
+// whether the play has gone on long enough to be logged: half the song or
+// four minutes, whichever comes first. Songs of 30 seconds or less never are.
+func (p scrobble) qualifies(now time.Time) bool {
+	if p.Duration > 0 && p.Duration <= 30*time.Second {
+		return false
+	}
+	wait := 4 * time.Minute
+	if p.Duration > 0 && p.Duration/2 < wait {
+		wait = p.Duration / 2
+	}
+	return !now.Before(p.StartedAt.Add(wait))
+}
+
+// whether the song is still on air
+func (p scrobble) playing(now time.Time) bool {
+	return p.Duration > 0 && now.Before(p.StartedAt.Add(p.Duration))
+}
+
+// scrobbler follows the history, sending each airing to a service once it
+// qualifies. Plays that fail are kept and retried with backoff, in order.
+type scrobbler struct {
+	service scrobbleService
+	path    string
+
+	mu    sync.Mutex
+	state scrobblerState
+	// the airing last sent as now playing
+	nowPlaying string
+	failures   int
+	retryAt    time.Time
+	// set once the service turns down the login, after which nothing more
+	// is sent this run
+	rejected error
+}
+
+type scrobblerState struct {
+	Pending []scrobble `json:"pending"`
+	// when each airing sent started, forgotten once it's too old to resend
+	Done map[string]time.Time `json:"done"`
+}
+
+// reads what was left to send before a restart. Without a saved state it
+// starts from now, rather than logging the last two weeks of history again.
+func newScrobbler(service scrobbleService) (*scrobbler, error) {
+	s := &scrobbler{service: service, state: scrobblerState{Done: map[string]time.Time{}}}
+	if scrobbleDir != "" {
+		s.path = filepath.Join(scrobbleDir, "scrobbles-"+service.Name()+".json")
+	}
+
+	data, err := ioutil.ReadFile(s.path)
+	if s.path == "" || os.IsNotExist(err) {
+		for _, record := range historyRecords() {
+			s.state.Done[record.key()] = record.airedAt()
+		}
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		return nil, fmt.Errorf("%s: %s", s.path, err.Error())
+	}
+	if s.state.Done == nil {
+		s.state.Done = map[string]time.Time{}
+	}
+	return s, nil
+}
+
+// writes the state out in one go, s must be locked
+func (s *scrobbler) save() error {
+	// a dry run's scrobbles were never sent
+	if dryRun {
+		return nil
+	}
+	return writeJSONFile(s.path, s.state)
+}
+
+// queues the airings that have qualified since the last check and says
+// what's on air now
+func (s *scrobbler) check() {
+	now := clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := map[string]bool{}
+	for _, play := range s.state.Pending {
+		pending[play.Key] = true
+	}
+	queued := false
+	for _, record := range historyRecords() {
+		play := record.play()
+		if play.Artist == "" || play.Title == "" || pending[play.Key] || now.Sub(play.StartedAt) > scrobbleMaxAge {
+			continue
+		}
+		if _, done := s.state.Done[play.Key]; done {
+			continue
+		}
+
+		if play.qualifies(now) {
+			s.state.Pending = append(s.state.Pending, play)
+			pending[play.Key] = true
+			queued = true
+		} else if record.Source == sourcePoll && play.playing(now) && s.nowPlaying != play.Key && s.rejected == nil {
+			s.nowPlaying = play.Key
+			if err := s.service.NowPlaying(play); err != nil {
+				fmt.Printf("Couldn't tell %s what's playing: %s\n", s.service.Name(), err.Error())
+			}
+		}
+	}
+
+	for key, startedAt := range s.state.Done {
+		if now.Sub(startedAt) > scrobbleMaxAge {
+			delete(s.state.Done, key)
+		}
+	}
+	if queued {
+		if err := s.save(); err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+}
+
+// sends the queued plays oldest first until they're all gone or a batch
+// fails. A batch the service will never take is dropped so the rest can go.
+func (s *scrobbler) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.state.Pending) > 0 {
+		batch := s.state.Pending
+		if len(batch) > s.service.BatchSize() {
+			batch = batch[:s.service.BatchSize()]
+		}
+		err := s.service.Scrobble(batch)
+		if _, ok := err.(loginRejected); ok {
+			s.rejected = err
+			return err
+		} else if err != nil && retryable(err) {
+			s.failures++
+			s.retryAt = clock.Now().Add(backoff(s.failures, err))
+			return err
+		} else if err != nil {
+			fmt.Printf("Dropping %d scrobble(s) for %s: %s\n", len(batch), s.service.Name(), err.Error())
+		}
+
+		s.failures = 0
+		s.retryAt = time.Time{}
+		for _, play := range batch {
+			s.state.Done[play.Key] = play.StartedAt
+		}
+		s.state.Pending = s.state.Pending[len(batch):]
+		if err := s.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// how many plays are waiting to be sent
+func (s *scrobbler) pendingLen() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.state.Pending)
+}
+
+// checks the history and sends what's qualified every scrobbleInterval until
+// ctx is cancelled
+func (s *scrobbler) Run() {
+	done := ctx.Done()
+	ticker := clock.NewTicker(scrobbleInterval)
+	defer ticker.Stop()
+
+	for {
+		s.check()
+
+		s.mu.Lock()
+		waiting := clock.Now().Before(s.retryAt) || s.rejected != nil
+		s.mu.Unlock()
+		if !waiting {
+			err := s.flush()
+			if _, ok := err.(loginRejected); ok {
+				fmt.Printf("%s turned down the login, scrobbles are kept until it's set again and the app restarted: %s\n", s.service.Name(), err.Error())
+			} else if err != nil {
+				fmt.Printf("Couldn't scrobble to %s, will retry: %s\n", s.service.Name(), err.Error())
+			}
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// the services configured to scrobble to, each following the history
+func openScrobblers() []*scrobbler {
+	services := []struct {
+		name       string
+		configured bool
+		open       func() (scrobbleService, error)
+	}{
+		{"Last.fm", lastfmAPIKey != "", func() (scrobbleService, error) { return newLastfm() }},
+		{"ListenBrainz", listenbrainzToken != "", func() (scrobbleService, error) { return newListenBrainz() }},
+	}
+
+	scrobblers := []*scrobbler{}
+	for _, service := range services {
+		if !service.configured {
+			continue
+		}
+		opened, err := service.open()
+		if err == nil {
+			var s *scrobbler
+			if s, err = newScrobbler(opened); err == nil {
+				scrobblers = append(scrobblers, s)
+			}
+		}
+		if err != nil {
+			fmt.Printf("Not scrobbling to %s: %s\n", service.name, err.Error())
+		}
+	}
+	return scrobblers
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+var searchURL = "/search?type=track&limit=10&q="
+var getTrackURL = "/tracks/"
+
+type SearchResults struct {
+	Tracks struct {
+		Items []SearchTrack `json:"items"`
+	} `json:"tracks"`
+}
+
+type SearchTrack struct {
+	Id      string         `json:"id"`
+	Name    string         `json:"name"`
+	Artists []PlaylistInfo `json:"artists"`
+	// the recording's ISRC, which other services can look songs up by
+	ExternalIds struct {
+		ISRC string `json:"isrc"`
+	} `json:"external_ids"`
+}
+
+// the artist Spotify lists first, which is the one the station names
+func (t SearchTrack) artist() string {
+	if len(t.Artists) == 0 {
+		return ""
+	}
+	return t.Artists[0].Name
+}
+
+// looks for a song the feed had no Spotify link for. Only a result with the
+// same artist and title counts, so a cover or a different song that happens
+// to share words never gets in. Returns "" when nothing matches.
+func searchTrack(client *http.Client, artist string, title string) (string, error) {
+	if artist == "" || title == "" {
+		return "", nil
+	}
+
+	query := fmt.Sprintf("track:%s artist:%s", normaliseTitle(title), normaliseArtist(artist))
+	res, err := client.Get(spotifyURL(searchURL) + url.QueryEscape(query))
+	if err != nil {
+		return "", err
+	}
+
+	defer res.Body.Close()
+
+	if err := checkResponse(res); err != nil {
+		return "", err
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	data := SearchResults{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return "", err
+	}
+
+	want := songKey(artist, title)
+	for _, track := range data.Tracks.Items {
+		if songKey(track.artist(), track.Name) == want {
+			return track.Id, nil
+		}
+	}
+	return "", nil
+}
+
+// the ISRC Spotify has for a track, "" if it has none
+func lookupISRC(client *http.Client, trackId string) (string, error) {
+	res, err := client.Get(spotifyURL(getTrackURL) + url.PathEscape(trackId))
+	if err != nil {
+		return "", err
+	}
+
+	defer res.Body.Close()
+
+	if err := checkResponse(res); err != nil {
+		return "", err
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	track := SearchTrack{}
+	if err := json.Unmarshal(body, &track); err != nil {
+		return "", err
+	}
+	return track.ExternalIds.ISRC, nil
+}
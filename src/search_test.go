@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestSearchTrackOnlyAcceptsTheSameSong(t *testing.T) {
+	env := newTestEnv(t)
+	env.spotify.AddTrack("original", "Mr. Brightside", "The Killers")
+	env.spotify.AddTrack("cover", "Mr. Brightside", "Some Cover Band")
+	env.spotify.AddTrack("other", "Brightside Story", "The Killers")
+	client := spotifyClient(&oauth2.Token{AccessToken: "fake"})
+
+	for _, c := range []struct{ artist, title, want string }{
+		{"The Killers", "Mr Brightside", "original"},
+		{"Killers", "Mr. Brightside (Live)", "original"},
+		{"Nobody", "Mr. Brightside", ""},
+		{"", "Mr. Brightside", ""},
+	} {
+		got, err := searchTrack(client, c.artist, c.title)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("searchTrack(%q, %q) = %q, want %q", c.artist, c.title, got, c.want)
+		}
+	}
+}
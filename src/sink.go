@@ -0,0 +1,694 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Song is an aired song as a sink sees it
+type Song struct {
+	Artist    string        `json:"artist"`
+	Title     string        `json:"title"`
+	Duration  time.Duration `json:"duration"`
+	SpotifyId string        `json:"spotify_id,omitempty"`
+	ISRC      string        `json:"isrc,omitempty"`
+	AiredAt   time.Time     `json:"aired_at"`
+	// the callsign of the station it aired on
+	Station string `json:"station,omitempty"`
+}
+
+// the song an airing is of
+func (r HistoryRecord) song() Song {
+	return Song{
+		Artist:    r.Artist,
+		Title:     r.Title,
+		Duration:  time.Duration(r.Length) * time.Second,
+		SpotifyId: r.SpotifyId,
+		ISRC:      r.ISRC,
+		AiredAt:   r.airedAt(),
+		Station:   r.Station,
+	}
+}
+
+// SinkTrack is a song already in a sink's playlist, with the sink's own ID
+// for it
+type SinkTrack struct {
+	Id string
+	Song
+}
+
+// PlaylistSink is somewhere playlists of aired songs can be kept
+type PlaylistSink interface {
+	// short and unique, used in config and to tag queued songs
+	Name() string
+	// finds the playlist with this name, making it if there isn't one, and
+	// returns the sink's ID for it
+	EnsurePlaylist(name string) (string, error)
+	// everything in the playlist, in order
+	List(playlistId string) ([]SinkTrack, error)
+	// appends songs to the end of the playlist in the order given
+	Add(playlistId string, songs []Song) error
+	// takes tracks out of the playlist
+	Remove(playlistId string, tracks []SinkTrack) error
+}
+
+// a sink that can't place every song says which it can
+type selectiveSink interface {
+	Accepts(song Song) bool
+}
+
+// a sink whose Remove takes out every copy of a track can also take out
+// single copies, by where they are in the playlist as listed
+type copyRemover interface {
+	RemoveAt(playlistId string, tracks []SinkTrack, positions []int) error
+}
+
+// a sink with upkeep of its own runs it alongside the poller until ctx is
+// cancelled
+type backgroundSink interface {
+	Run()
+}
+
+// which sinks to keep playlists on, comma separated
+var enabledSinks = envOr("SINKS", "spotify")
+
+// the main playlist every aired song goes into
+var playlistName = "SONiC On Demand"
+
+// what the names of derived playlists start with, "SONiC – Chill"
+var derivedPlaylistPrefix = "SONiC – "
+
+// whether a sink is in enabledSinks
+func sinkEnabled(name string) bool {
+	for _, enabled := range strings.Split(enabledSinks, ",") {
+		if strings.TrimSpace(enabled) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// builds the enabled sinks. The Spotify one needs a logged in client, the
+// rest don't.
+func newSinks(client *http.Client) ([]PlaylistSink, error) {
+	built := []PlaylistSink{}
+	for _, name := range strings.Split(enabledSinks, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "spotify":
+			if client == nil {
+				return nil, fmt.Errorf("the spotify sink needs a login")
+			}
+			built = append(built, &spotifySink{client: client})
+		case "file":
+			built = append(built, newFileSink())
+		case "library":
+			sink, err := newLibrarySink()
+			if err != nil {
+				return nil, err
+			}
+			built = append(built, sink)
+		case "plex":
+			sink, err := newPlexSink()
+			if err != nil {
+				return nil, err
+			}
+			built = append(built, sink)
+		case "deezer":
+			sink, err := newDeezerSink()
+			if err != nil {
+				return nil, err
+			}
+			built = append(built, sink)
+		case "youtube":
+			sink, err := newYouTubeSink()
+			if err != nil {
+				return nil, err
+			}
+			built = append(built, sink)
+		case "subsonic":
+			sink, err := newSubsonicSink()
+			if err != nil {
+				return nil, err
+			}
+			built = append(built, sink)
+		default:
+			return nil, fmt.Errorf("unknown sink %q in SINKS", name)
+		}
+	}
+	if len(built) == 0 {
+		return nil, fmt.Errorf("no sinks enabled, set SINKS")
+	}
+	return built, nil
+}
+
+// playlistTarget is one playlist on one sink, with what's in it so songs
+// only go in once
+type playlistTarget struct {
+	sink       PlaylistSink
+	name       string
+	playlistId string
+	// which songs go in a derived playlist, nil for the main one which takes
+	// every song
+	fits func(song Song) bool
+	// which songs already in a derived playlist should come out, nil when
+	// none ever do
+	prune func(song Song) bool
+	// when the period a song aired in began, for a derived playlist that
+	// starts over each period, and the latest period seen
+	period      func(song Song) time.Time
+	periodStart time.Time
+	// the full parts of the playlist before this one, oldest first
+	earlier []*playlistTarget
+
+	mu sync.Mutex
+	// Spotify IDs in the playlist
+	ids map[string]bool
+	// songKeys of everything in the playlist, and of the tracks with no
+	// Spotify ID to go by
+	keys       map[string]bool
+	keysWithId map[string]bool
+	// ISRCs in the playlist, and the songKeys of the tracks with one
+	isrcs        map[string]bool
+	keysWithISRC map[string]bool
+	size         int
+}
+
+// finds or makes the named playlist on a sink and reads what's in it, moving
+// on through its later parts while the one read is full
+func openTarget(sink PlaylistSink, name string) (*playlistTarget, error) {
+	target, err := openPlaylist(sink, name)
+	for err == nil && target.full() {
+		target, err = target.nextPart()
+	}
+	return target, err
+}
+
+// finds or makes one playlist on a sink and reads what's in it
+func openPlaylist(sink PlaylistSink, name string) (*playlistTarget, error) {
+	playlistId, err := sink.EnsurePlaylist(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", sink.Name(), err.Error())
+	}
+	tracks, err := sink.List(playlistId)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", sink.Name(), err.Error())
+	}
+	tracks = withTrackISRCs(tracks)
+
+	target := newPlaylistTarget(sink, name, playlistId)
+	for _, track := range tracks {
+		target.remember(track.Song)
+	}
+	// and the ones still waiting to go in from before a restart
+	for _, song := range withISRCs(queuedSongs(sink.Name(), playlistId)) {
+		target.remember(song)
+	}
+	return target, nil
+}
+
+func newPlaylistTarget(sink PlaylistSink, name string, playlistId string) *playlistTarget {
+	return &playlistTarget{
+		sink:         sink,
+		name:         name,
+		playlistId:   playlistId,
+		ids:          map[string]bool{},
+		keys:         map[string]bool{},
+		keysWithId:   map[string]bool{},
+		isrcs:        map[string]bool{},
+		keysWithISRC: map[string]bool{},
+	}
+}
+
+// withISRCs for the songs of listed tracks
+func withTrackISRCs(tracks []SinkTrack) []SinkTrack {
+	songs := []Song{}
+	for _, track := range tracks {
+		songs = append(songs, track.Song)
+	}
+	filled := []SinkTrack{}
+	for i, song := range withISRCs(songs) {
+		filled = append(filled, SinkTrack{Id: tracks[i].Id, Song: song})
+	}
+	return filled
+}
+
+// fills in the ISRCs of songs on Spotify when the track cache is open, so
+// the single and the album version of a recording count as one song
+func withISRCs(songs []Song) []Song {
+	if openedTrackCache == nil {
+		return songs
+	}
+	return openedTrackCache.withISRCs(songs)
+}
+
+func (t *playlistTarget) remember(song Song) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.size++
+	if song.SpotifyId != "" {
+		t.ids[song.SpotifyId] = true
+	}
+	if song.ISRC != "" {
+		t.isrcs[song.ISRC] = true
+	}
+	if song.Title != "" {
+		key := songKey(song.Artist, song.Title)
+		t.keys[key] = true
+		if song.SpotifyId != "" {
+			t.keysWithId[key] = true
+		}
+		if song.ISRC != "" {
+			t.keysWithISRC[key] = true
+		}
+	}
+}
+
+// how many tracks are in the playlist or on their way
+func (t *playlistTarget) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.size
+}
+
+// takes copies of songs that are still in the playlist off its count
+func (t *playlistTarget) uncount(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.size -= n
+}
+
+// drops tracks taken out of the playlist, so the songs can go in again
+func (t *playlistTarget) forget(tracks []SinkTrack) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, track := range tracks {
+		t.size--
+		delete(t.ids, track.Song.SpotifyId)
+		delete(t.isrcs, track.Song.ISRC)
+		if track.Song.Title != "" {
+			key := songKey(track.Song.Artist, track.Song.Title)
+			delete(t.keys, key)
+			delete(t.keysWithId, key)
+			delete(t.keysWithISRC, key)
+		}
+	}
+}
+
+// whether the song is in the playlist or any earlier part of it
+func (t *playlistTarget) has(song Song) bool {
+	for _, part := range t.parts() {
+		if part.holds(song) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the song is in this part of the playlist. Songs are the same when
+// they're the same Spotify track or recording by ISRC. Otherwise they're
+// compared by artist and title, unless both sides have an ISRC or Spotify ID
+// to tell them apart.
+func (t *playlistTarget) holds(song Song) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := ""
+	if song.Title != "" {
+		key = songKey(song.Artist, song.Title)
+	}
+	if song.SpotifyId != "" && t.ids[song.SpotifyId] {
+		return true
+	}
+	if song.ISRC != "" {
+		if t.isrcs[song.ISRC] {
+			return true
+		}
+		// a live take or a remix is a different recording of the same name
+		return key != "" && t.keys[key] && !t.keysWithISRC[key]
+	}
+	if song.SpotifyId != "" {
+		// only a track with no ID of its own can match by name
+		return key != "" && t.keys[key] && !t.keysWithId[key]
+	}
+	return key != "" && t.keys[key]
+}
+
+// whether the sink can place the song at all
+func (t *playlistTarget) accepts(song Song) bool {
+	if selective, ok := t.sink.(selectiveSink); ok {
+		return selective.Accepts(song)
+	}
+	return true
+}
+
+// how long a song a library didn't have is taken as still missing before
+// it's looked up again, in case it's been added since
+var missExpiry = 24 * time.Hour
+
+// matcher finds songs in a sink's own library, looking each up once and
+// reporting the ones it doesn't have once. A song that wasn't there is looked
+// up again once missExpiry has passed.
+type matcher struct {
+	library string
+	// the library's ID for a song, empty if it isn't there
+	search func(song Song) (string, error)
+
+	mu sync.Mutex
+	// library IDs by songKey, "" for songs the library doesn't have
+	matched map[string]string
+	// when each song the library didn't have was last looked up, by songKey
+	missedAt map[string]time.Time
+	misses   []Song
+}
+
+func newMatcher(library string, search func(song Song) (string, error)) *matcher {
+	return &matcher{library: library, search: search, matched: map[string]string{}, missedAt: map[string]time.Time{}}
+}
+
+func (m *matcher) match(song Song) (string, error) {
+	key := songKey(song.Artist, song.Title)
+	m.mu.Lock()
+	songId, known := m.matched[key]
+	stale := known && songId == "" && clock.Now().Sub(m.missedAt[key]) >= missExpiry
+	m.mu.Unlock()
+	if known && !stale {
+		return songId, nil
+	}
+
+	songId, err := m.search(song)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.matched[key] = songId
+	switch {
+	case songId == "" && !stale:
+		fmt.Printf("Not in the %s library: %s\n", m.library, song.entry().displayName())
+		m.misses = append(m.misses, song)
+		m.missedAt[key] = clock.Now()
+	case songId == "":
+		m.missedAt[key] = clock.Now()
+	case stale:
+		fmt.Printf("Now in the %s library: %s\n", m.library, song.entry().displayName())
+		m.forgetMiss(key)
+	}
+	return songId, nil
+}
+
+// takes a song off the misses once the library has it, with mu held
+func (m *matcher) forgetMiss(key string) {
+	delete(m.missedAt, key)
+	kept := m.misses[:0]
+	for _, missed := range m.misses {
+		if songKey(missed.Artist, missed.Title) != key {
+			kept = append(kept, missed)
+		}
+	}
+	m.misses = kept
+}
+
+// only songs in the library can go in. A search that fails lets the song
+// through, the sink looks again when the outbox sends it.
+func (m *matcher) Accepts(song Song) bool {
+	songId, err := m.match(song)
+	if err != nil {
+		fmt.Println(err.Error())
+		return true
+	}
+	return songId != ""
+}
+
+// the songs that couldn't be found in the library, as of the last time each
+// was looked up
+func (m *matcher) Misses() []Song {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Song(nil), m.misses...)
+}
+
+// a sink that matches songs against its own library reports the ones it
+// couldn't find
+type missReporter interface {
+	Misses() []Song
+}
+
+// what offering a song to a target came to
+const (
+	offerQueued = iota
+	offerDuplicate
+	offerRejected
+)
+
+// queues the song unless the playlist has it already or the sink can't
+// place it
+func (t *playlistTarget) offer(song Song) (int, error) {
+	if !t.accepts(song) {
+		return offerRejected, nil
+	}
+	if t.has(song) {
+		return offerDuplicate, nil
+	}
+	if err := enqueueSongs(t.sink.Name(), t.playlistId, song); err != nil {
+		return offerRejected, err
+	}
+	t.remember(song)
+	return offerQueued, nil
+}
+
+// where the playlist lives, for the history: "sink:id"
+func (t *playlistTarget) String() string {
+	return t.sink.Name() + ":" + t.playlistId
+}
+
+// derivedPlaylist is a playlist of the aired songs that fit some rule,
+// kept on every sink beside the main one
+type derivedPlaylist struct {
+	name  string
+	fits  func(song Song) bool
+	prune func(song Song) bool
+	// when the period the song aired in began, for a playlist that starts
+	// over each period: what prune takes out goes as soon as a song from a
+	// new period arrives, rather than at the next hourly check
+	period func(song Song) time.Time
+}
+
+// the derived playlists that are turned on
+func derivedPlaylists(client *http.Client) ([]derivedPlaylist, error) {
+	prefetchers, openedTrackCache, openedFeatureCache = nil, nil, nil
+	playlists := []derivedPlaylist{}
+	for _, kind := range []func(client *http.Client) ([]derivedPlaylist, error){moodPlaylists, genrePlaylists, releasePlaylists, showPlaylists, routePlaylists} {
+		more, err := kind(client)
+		if err != nil {
+			return nil, err
+		}
+		playlists = append(playlists, more...)
+	}
+	return playlists, nil
+}
+
+// what the derived playlists look up about Spotify tracks, each taking a
+// batch of track IDs and caching what it finds
+var prefetchers []func(trackIds []string) error
+
+// looks up many tracks at once ahead of offering them, rather than one by
+// one as each is offered
+func prefetchTracks(trackIds []string) {
+	for _, prefetch := range prefetchers {
+		if err := prefetch(trackIds); err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+}
+
+// the main playlist and the derived ones on every enabled sink, set up by
+// startSession
+var targets []*playlistTarget
+
+// the sinks by name, for the outbox
+var sinksByName = map[string]PlaylistSink{}
+
+// the main playlist on the named sink, nil if that sink isn't enabled
+func mainTarget(sinkName string) *playlistTarget {
+	for _, target := range currentTargets() {
+		if target.sink.Name() == sinkName && target.fits == nil {
+			return target
+		}
+	}
+	return nil
+}
+
+// sets up the enabled sinks and the main and derived playlists on each
+func openSinks(client *http.Client) error {
+	built, err := newSinks(client)
+	if err != nil {
+		return err
+	}
+	derived, err := derivedPlaylists(client)
+	if err != nil {
+		return err
+	}
+	// what's in the playlists is compared by the ISRCs it keeps, and the
+	// covers are made from the album art
+	if client != nil {
+		if _, err := openTrackCache(client); err != nil {
+			return err
+		}
+	}
+
+	opened := []*playlistTarget{}
+	byName := map[string]PlaylistSink{}
+	for _, sink := range built {
+		byName[sink.Name()] = sink
+		target, err := openTarget(sink, playlistName)
+		if err != nil {
+			return err
+		}
+		opened = append(opened, target)
+
+		for _, playlist := range derived {
+			target, err := openTarget(sink, playlist.name)
+			if err != nil {
+				return err
+			}
+			target.fits, target.prune, target.period = playlist.fits, playlist.prune, playlist.period
+			opened = append(opened, target)
+		}
+	}
+	targetsMu.Lock()
+	targets, sinksByName = opened, byName
+	targetsMu.Unlock()
+	return nil
+}
+
+// how often the derived playlists songs age out of are checked
+var pruneInterval = time.Hour
+
+// whether any derived playlist has songs come out again
+func pruning() bool {
+	for _, target := range currentTargets() {
+		if target.prune != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the song is from a later period than the playlist has had so
+// far, noting it if so
+func (t *playlistTarget) startsPeriod(song Song) bool {
+	if t.period == nil {
+		return false
+	}
+	start := t.period(song)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !start.After(t.periodStart) {
+		return false
+	}
+	t.periodStart = start
+	return true
+}
+
+// what the history knows of songs a sink lists without a Spotify ID or
+// airing time: the ID and latest airing of each
+type airingLookup struct {
+	spotifyIds map[string]string
+	airedById  map[string]time.Time
+	airedByKey map[string]time.Time
+}
+
+func newAiringLookup() airingLookup {
+	l := airingLookup{map[string]string{}, map[string]time.Time{}, map[string]time.Time{}}
+	for _, record := range historyRecords() {
+		key := songKey(record.Artist, record.Title)
+		if record.SpotifyId != "" {
+			l.spotifyIds[key] = record.SpotifyId
+			if record.StartedAt.After(l.airedById[record.SpotifyId]) {
+				l.airedById[record.SpotifyId] = record.StartedAt
+			}
+		}
+		if record.StartedAt.After(l.airedByKey[key]) {
+			l.airedByKey[key] = record.StartedAt
+		}
+	}
+	return l
+}
+
+// the song with what its sink left out filled in from the history
+func (l airingLookup) fill(song Song) Song {
+	key := songKey(song.Artist, song.Title)
+	if song.SpotifyId == "" {
+		song.SpotifyId = l.spotifyIds[key]
+	}
+	if song.AiredAt.IsZero() {
+		song.AiredAt = l.airedByKey[key]
+		if aired, ok := l.airedById[song.SpotifyId]; ok {
+			song.AiredAt = aired
+		}
+	}
+	return song
+}
+
+// takes the songs that no longer belong out of the derived playlists that
+// have a rule for it
+func pruneTargets() error {
+	lookup := newAiringLookup()
+	for _, target := range currentTargets() {
+		if target.prune == nil {
+			continue
+		}
+		if err := pruneTarget(target, lookup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// takes the songs that no longer belong out of every part of the playlist
+func pruneTarget(target *playlistTarget, lookup airingLookup) error {
+	for _, part := range target.parts() {
+		tracks, err := part.sink.List(part.playlistId)
+		if err != nil {
+			return err
+		}
+		stale := []SinkTrack{}
+		for _, track := range tracks {
+			if target.prune(lookup.fill(track.Song)) {
+				stale = append(stale, track)
+			}
+		}
+		if len(stale) == 0 {
+			continue
+		}
+		fmt.Printf("Taking %d song(s) out of %s on %s\n", len(stale), part.name, part.sink.Name())
+		if err := part.sink.Remove(part.playlistId, stale); err != nil {
+			return err
+		}
+		part.forget(stale)
+	}
+	return nil
+}
+
+// prunes the derived playlists now and every pruneInterval until ctx is
+// cancelled
+func runPruner() {
+	done := ctx.Done()
+	ticker := clock.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := pruneTargets(); err != nil {
+			fmt.Println(err.Error())
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C():
+		}
+	}
+}
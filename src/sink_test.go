@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPlaylistTargetMatchesByIdThenName(t *testing.T) {
+	target := newPlaylistTarget(nil, "", "")
+	target.remember(Song{Artist: "A", Title: "One", SpotifyId: "track1"})
+	target.remember(Song{Artist: "Local", Title: "Demo"})
+
+	for _, c := range []struct {
+		song Song
+		want bool
+	}{
+		{Song{SpotifyId: "track1"}, true},
+		{Song{Artist: "a", Title: "One (Radio Edit)"}, true},
+		// a different release of a song that's in with an ID of its own
+		{Song{Artist: "A", Title: "One", SpotifyId: "track9"}, false},
+		// the Spotify release of a song that's only in by name
+		{Song{Artist: "Local", Title: "Demo", SpotifyId: "demo1"}, true},
+		{Song{Artist: "B", Title: "Two"}, false},
+	} {
+		if got := target.has(c.song); got != c.want {
+			t.Errorf("has(%+v) = %t, want %t", c.song, got, c.want)
+		}
+	}
+}
+
+func TestPlaylistTargetMatchesReleasesOfOneRecordingByISRC(t *testing.T) {
+	target := newPlaylistTarget(nil, "", "")
+	target.remember(Song{Artist: "A", Title: "One", SpotifyId: "single", ISRC: "CA0000000001"})
+	target.remember(Song{Artist: "B", Title: "Two", SpotifyId: "album"})
+
+	for _, c := range []struct {
+		song Song
+		want bool
+	}{
+		// the album version and a compilation copy of the single
+		{Song{Artist: "A", Title: "One", SpotifyId: "album1", ISRC: "CA0000000001"}, true},
+		{Song{Artist: "Various", Title: "One - 2011 Remaster", SpotifyId: "best1", ISRC: "CA0000000001"}, true},
+		// another recording by the same name
+		{Song{Artist: "A", Title: "One (Live)", SpotifyId: "live1", ISRC: "CA0000000002"}, false},
+		// nothing to tell it apart from a track in with no ISRC but its name
+		{Song{Artist: "B", Title: "Two", SpotifyId: "single2", ISRC: "CA0000000003"}, true},
+	} {
+		if got := target.has(c.song); got != c.want {
+			t.Errorf("has(%+v) = %t, want %t", c.song, got, c.want)
+		}
+	}
+}
+
+// playlistsByTitle waits for the airings to be in the history, which happens
+// just after their songs are queued, and says where each went
+func playlistsByTitle(t *testing.T, titles ...string) map[string][]string {
+	t.Helper()
+	playlists := map[string][]string{}
+	waitFor(t, "the history", func() bool {
+		for _, record := range historyRecords() {
+			playlists[record.SongTitle] = record.Playlists
+		}
+		for _, title := range titles {
+			if _, ok := playlists[title]; !ok {
+				return false
+			}
+		}
+		return true
+	})
+	return playlists
+}
+
+func TestSongsGoToEverySinkThatCanTakeThem(t *testing.T) {
+	env := newTestEnv(t)
+	enabledSinks = "spotify,file"
+	env.station.play(song("A - One", "track1"), song("Local - Demo", ""))
+
+	env.login(t)
+
+	waitFor(t, "the Spotify song", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist("SONiC On Demand")), []string{"track1"})
+	})
+	file := mainTarget("file")
+	waitFor(t, "both songs in the file", func() bool {
+		tracks, _ := file.sink.List(file.playlistId)
+		return len(tracks) == 2
+	})
+
+	playlists := playlistsByTitle(t, "A - One", "Local - Demo")
+	if got := playlists["A - One"]; len(got) != 2 || got[0] != "spotify:"+mainTarget("spotify").playlistId {
+		t.Errorf("A - One went to %v", got)
+	}
+	if got := playlists["Local - Demo"]; len(got) != 1 || got[0] != "file:"+file.playlistId {
+		t.Errorf("Local - Demo went to %v", got)
+	}
+}
+
+func TestMatcherLooksForMissesAgainOnceTheyExpire(t *testing.T) {
+	newTestEnv(t)
+	at := newFixedClock(time.Date(2021, 7, 1, 12, 0, 0, 0, stationTimeZone))
+	clock = at
+	library, searches := map[string]string{}, 0
+	m := newMatcher("Test", func(song Song) (string, error) {
+		searches++
+		return library[song.Title], nil
+	})
+	two := Song{Artist: "B", Title: "Two"}
+
+	if m.Accepts(two) || m.Accepts(two) || searches != 1 {
+		t.Fatalf("searched %d times for a missing song", searches)
+	}
+	if misses := m.Misses(); len(misses) != 1 {
+		t.Errorf("reported misses %+v", misses)
+	}
+
+	// added to the library since, but still taken as missing until it expires
+	library["Two"] = "lib2"
+	at.set(at.Now().Add(missExpiry - time.Minute))
+	if m.Accepts(two) {
+		t.Errorf("looked again before the miss expired")
+	}
+	at.set(at.Now().Add(time.Minute))
+	if !m.Accepts(two) || searches != 2 {
+		t.Errorf("didn't find the song once the miss expired, after %d searches", searches)
+	}
+	if misses := m.Misses(); len(misses) != 0 {
+		t.Errorf("still reports %+v", misses)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// spotifySink keeps playlists on the logged in user's Spotify account
+type spotifySink struct {
+	client *http.Client
+}
+
+func (s *spotifySink) Name() string {
+	return "spotify"
+}
+
+func (s *spotifySink) Ceiling() int {
+	return spotifyCeiling
+}
+
+// only songs Spotify has, and can play in the user's market, can go in
+func (s *spotifySink) Accepts(song Song) bool {
+	return song.SpotifyId != "" && !knownUnplayable(song.SpotifyId)
+}
+
+// will either find or create the playlist and return its ID
+func (s *spotifySink) EnsurePlaylist(name string) (string, error) {
+	var playlistId, err = checkForPlaylist(s.client, name)
+	if err != nil {
+		fmt.Println(err.Error())
+		return "", err
+	} else if playlistId == "" {
+		fmt.Println("Making Playlist")
+		return makePlaylist(s.client, name)
+	}
+	return playlistId, nil
+}
+
+func (s *spotifySink) List(playlistId string) ([]SinkTrack, error) {
+	return getAllSongs(s.client, playlistId)
+}
+
+// adds songs in batches of up to 100, in the order given
+func (s *spotifySink) Add(playlistId string, songs []Song) error {
+	songIds := []string{}
+	for _, song := range songs {
+		songIds = append(songIds, song.SpotifyId)
+	}
+	for len(songIds) > 0 {
+		batch := songIds
+		if len(batch) > maxSongsPerRequest {
+			batch = batch[:maxSongsPerRequest]
+		}
+		if err := addSongs(s.client, playlistId, batch); err != nil {
+			return err
+		}
+		songIds = songIds[len(batch):]
+	}
+	return nil
+}
+
+// takes out every copy of each track
+func (s *spotifySink) Remove(playlistId string, tracks []SinkTrack) error {
+	uris := []map[string]string{}
+	for _, track := range tracks {
+		uris = append(uris, map[string]string{"uri": "spotify:track:" + track.Id})
+	}
+	for len(uris) > 0 {
+		batch := uris
+		if len(batch) > maxSongsPerRequest {
+			batch = batch[:maxSongsPerRequest]
+		}
+		_, err := sendChange(s.client, fmt.Sprintf("remove %d track(s) from %s", len(batch), playlistId), "DELETE", playlistURL(addSongURL, playlistId), map[string]interface{}{
+			"tracks": batch,
+		})
+		if err != nil {
+			return err
+		}
+		uris = uris[len(batch):]
+	}
+	return nil
+}
+
+// takes out the copies at the positions given, from the end of the playlist
+// back so each request's positions still hold for the next
+func (s *spotifySink) RemoveAt(playlistId string, tracks []SinkTrack, positions []int) error {
+	order := make([]int, len(tracks))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return positions[order[i]] > positions[order[j]] })
+	for len(order) > 0 {
+		batch := order
+		if len(batch) > maxSongsPerRequest {
+			batch = batch[:maxSongsPerRequest]
+		}
+		copies := []map[string]interface{}{}
+		for _, i := range batch {
+			copies = append(copies, map[string]interface{}{"uri": "spotify:track:" + tracks[i].Id, "positions": []int{positions[i]}})
+		}
+		_, err := sendChange(s.client, fmt.Sprintf("remove %d copies from %s", len(batch), playlistId), "DELETE", playlistURL(addSongURL, playlistId), map[string]interface{}{
+			"tracks": copies,
+		})
+		if err != nil {
+			return err
+		}
+		order = order[len(batch):]
+	}
+	return nil
+}
+
+// will get the ID of the named playlist if it exists
+func checkForPlaylist(client *http.Client, name string) (string, error) {
+	nextURL := spotifyURL(getPlaylistsURL)
+
+	for nextURL != "" {
+		res, err := client.Get(nextURL)
+		if err != nil {
+			fmt.Println(err.Error())
+			return "", err
+		}
+
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			fmt.Println(err.Error())
+			return "", err
+		}
+		if err := checkResponse(res); err != nil {
+			return "", err
+		}
+
+		data := PlaylistList{}
+		json.Unmarshal(body, &data)
+		for _, value := range data.Items {
+			if value.Name == name {
+				return value.Id, nil
+			}
+		}
+		nextURL = data.Next
+	}
+	return "", nil
+}
+
+func makePlaylist(client *http.Client, name string) (string, error) {
+	body, err := sendChange(client, fmt.Sprintf("create playlist %q", name), "POST", spotifyURL(makePlaylistURL), map[string]string{
+		"name":        name,
+		"description": "Playlist made from SONiC 102.9",
+	})
+	if err != nil {
+		fmt.Println(err.Error())
+		return "", err
+	}
+
+	data := PlaylistInfo{}
+	json.Unmarshal(body, &data)
+
+	return data.Id, nil
+}
+
+func getAllSongs(client *http.Client, playlistId string) ([]SinkTrack, error) {
+	listed, err := getPlaylistTracks(client, playlistId)
+	if err != nil {
+		return nil, err
+	}
+	tracks := []SinkTrack{}
+	for _, track := range listed {
+		tracks = append(tracks, track.sinkTrack())
+	}
+	return tracks, nil
+}
+
+// every track in the playlist, with whether it can be played in the market
+func getPlaylistTracks(client *http.Client, playlistId string) ([]PlaylistTrack, error) {
+	tracks := []PlaylistTrack{}
+	totalSongs := 100
+	if isDryRunId(playlistId) {
+		// never made, so there's nothing to read
+		totalSongs = 0
+	}
+
+	for currentOffest := 0; currentOffest < totalSongs; currentOffest += 100 {
+
+		currentURL := playlistURL(getSongsUrl, playlistId) + "&offset=" + strconv.Itoa(currentOffest)
+
+		res, err := client.Get(currentURL)
+		if err != nil {
+			fmt.Println(err.Error())
+			return nil, err
+		}
+
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			fmt.Println(err.Error())
+			return nil, err
+		}
+		if err := checkResponse(res); err != nil {
+			return nil, err
+		}
+
+		data := SONiCPlaylist{}
+		json.Unmarshal(body, &data)
+		for _, value := range data.Items {
+			tracks = append(tracks, value.Track)
+		}
+		totalSongs = data.Total
+	}
+
+	return tracks, nil
+}
+
+// the track as a sink sees it
+func (t PlaylistTrack) sinkTrack() SinkTrack {
+	artists := []string{}
+	for _, artist := range t.Artists {
+		artists = append(artists, artist.Name)
+	}
+	return SinkTrack{
+		Id: t.Id,
+		Song: Song{
+			Artist:    strings.Join(artists, ", "),
+			Title:     t.Name,
+			Duration:  time.Duration(t.DurationMs) * time.Millisecond,
+			SpotifyId: t.Id,
+		},
+	}
+}
+
+// adds up to 100 songs to a playlist in one request, in the order given
+func addSongs(client *http.Client, playlistId string, songIds []string) error {
+	songURIs := []string{}
+	for _, songId := range songIds {
+		songURIs = append(songURIs, "spotify:track:"+songId)
+	}
+
+	_, err := sendChange(client, "add "+strings.Join(songURIs, ", ")+" to "+playlistId, "POST", playlistURL(addSongURL, playlistId), map[string][]string{
+		"uris": songURIs,
+	})
+	return err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// appStatus is what /status reports about the running app
+type appStatus struct {
+	User      string           `json:"user"`
+	Market    string           `json:"market"`
+	Playlists []playlistStatus `json:"playlists"`
+	// songs a sink's library doesn't have, which never went in there
+	NotInLibrary []missedSong `json:"not_in_library"`
+}
+
+// missedSong is an aired song a sink couldn't find in its library
+type missedSong struct {
+	Sink   string `json:"sink"`
+	Artist string `json:"artist"`
+	Title  string `json:"title"`
+}
+
+// playlistStatus is a playlist on a sink and the parts it's split over
+type playlistStatus struct {
+	Sink  string       `json:"sink"`
+	Name  string       `json:"name"`
+	Parts []partStatus `json:"parts"`
+}
+
+// partStatus is one part of a playlist, with the tracks the last sweep
+// found can't be played
+type partStatus struct {
+	Name        string             `json:"name"`
+	Id          string             `json:"id"`
+	Tracks      int                `json:"tracks"`
+	Unavailable []unavailableTrack `json:"unavailable,omitempty"`
+}
+
+// what's known about the playlists now
+func currentStatus() appStatus {
+	status := appStatus{User: currentUser, Market: currentMarket, Playlists: []playlistStatus{}}
+	for _, target := range currentTargets() {
+		parts := target.parts()
+		playlist := playlistStatus{Sink: target.sink.Name(), Name: parts[0].name}
+		for _, part := range parts {
+			playlist.Parts = append(playlist.Parts, partStatus{
+				Name:        part.name,
+				Id:          part.playlistId,
+				Tracks:      part.count(),
+				Unavailable: unavailableIn(part),
+			})
+		}
+		status.Playlists = append(status.Playlists, playlist)
+	}
+	status.NotInLibrary = notInLibrary()
+	return status
+}
+
+// the misses of every enabled sink that matches against a library, in the
+// order the sinks are named
+func notInLibrary() []missedSong {
+	names := []string{}
+	for name := range sinksByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	missed := []missedSong{}
+	for _, name := range names {
+		reporter, ok := sinksByName[name].(missReporter)
+		if !ok {
+			continue
+		}
+		for _, song := range reporter.Misses() {
+			missed = append(missed, missedSong{Sink: name, Artist: song.Artist, Title: song.Title})
+		}
+	}
+	return missed
+}
+
+// answers with currentStatus as JSON
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(currentStatus()); err != nil {
+		fmt.Println(err.Error())
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a Subsonic compatible server, like Navidrome, to keep playlists on
+var subsonicURL = strings.TrimSuffix(envOr("SUBSONIC_URL", ""), "/")
+var subsonicUser = envOr("SUBSONIC_USER", "")
+var subsonicPassword = envOr("SUBSONIC_PASSWORD", "")
+
+// the API version asked for, 1.13.0 is the first with token auth
+const subsonicVersion = "1.16.1"
+
+// subsonicSink keeps playlists on a Subsonic server, matching aired songs
+// against its library by artist and title
+type subsonicSink struct {
+	baseURL  string
+	user     string
+	password string
+
+	*matcher
+}
+
+func newSubsonicSink() (*subsonicSink, error) {
+	if subsonicURL == "" || subsonicUser == "" {
+		return nil, fmt.Errorf("the subsonic sink needs SUBSONIC_URL, SUBSONIC_USER and SUBSONIC_PASSWORD")
+	}
+	s := &subsonicSink{baseURL: subsonicURL, user: subsonicUser, password: subsonicPassword}
+	s.matcher = newMatcher("Subsonic", s.search)
+	return s, nil
+}
+
+func (s *subsonicSink) Name() string {
+	return "subsonic"
+}
+
+type subsonicSong struct {
+	Id     string `json:"id"`
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	// in seconds
+	Duration int `json:"duration"`
+}
+
+type subsonicPlaylist struct {
+	Id    string         `json:"id"`
+	Name  string         `json:"name"`
+	Entry []subsonicSong `json:"entry"`
+}
+
+// the envelope every answer comes in. Only the parts the sink reads.
+type subsonicResponse struct {
+	Status string `json:"status"`
+	Error  struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	SearchResult3 struct {
+		Song []subsonicSong `json:"song"`
+	} `json:"searchResult3"`
+	Playlists struct {
+		Playlist []subsonicPlaylist `json:"playlist"`
+	} `json:"playlists"`
+	Playlist subsonicPlaylist `json:"playlist"`
+}
+
+// a "failed" answer
+type subsonicError struct {
+	Endpoint string
+	Code     int
+	Message  string
+}
+
+func (e *subsonicError) Error() string {
+	return fmt.Sprintf("subsonic %s: %s (error %d)", e.Endpoint, e.Message, e.Code)
+}
+
+// the URL for an endpoint with the login and params filled in. Each call
+// gets a fresh salt so the password is never sent as is.
+func (s *subsonicSink) endpointURL(endpoint string, params url.Values) string {
+	salt := make([]byte, 8)
+	rand.Read(salt)
+	saltHex := hex.EncodeToString(salt)
+	token := md5.Sum([]byte(s.password + saltHex))
+
+	query := url.Values{}
+	for key, values := range params {
+		query[key] = values
+	}
+	query.Set("u", s.user)
+	query.Set("t", hex.EncodeToString(token[:]))
+	query.Set("s", saltHex)
+	query.Set("v", subsonicVersion)
+	query.Set("c", "sonic-on-demand")
+	query.Set("f", "json")
+	return s.baseURL + "/rest/" + endpoint + "?" + query.Encode()
+}
+
+// calls an endpoint and unwraps the answer
+func (s *subsonicSink) call(endpoint string, params url.Values) (subsonicResponse, error) {
+	data := struct {
+		Response subsonicResponse `json:"subsonic-response"`
+	}{}
+
+	res, err := httpClient.Get(s.endpointURL(endpoint, params))
+	if err != nil {
+		return data.Response, err
+	}
+	defer res.Body.Close()
+
+	if err := checkResponse(res); err != nil {
+		return data.Response, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return data.Response, err
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return data.Response, err
+	}
+
+	if data.Response.Status != "ok" {
+		err := &subsonicError{Endpoint: endpoint, Code: data.Response.Error.Code, Message: data.Response.Error.Message}
+		// 0 is a generic server error, anything else is the request's fault
+		// and will fail the same way next time
+		if err.Code == 0 {
+			return data.Response, err
+		}
+		return data.Response, permanentError{err}
+	}
+	return data.Response, nil
+}
+
+// calls an endpoint that changes something, or notes it in a dry run
+func (s *subsonicSink) change(action string, endpoint string, params url.Values) (subsonicResponse, error) {
+	if dryRun {
+		// without the login, which doesn't belong in a summary
+		id := recordDryRun(action, "GET", s.baseURL+"/rest/"+endpoint+"?"+params.Encode(), nil)
+		return subsonicResponse{Playlist: subsonicPlaylist{Id: id}}, nil
+	}
+	return s.call(endpoint, params)
+}
+
+func (s *subsonicSink) EnsurePlaylist(name string) (string, error) {
+	found, err := s.call("getPlaylists", nil)
+	if err != nil {
+		return "", err
+	}
+	for _, playlist := range found.Playlists.Playlist {
+		if playlist.Name == name {
+			return playlist.Id, nil
+		}
+	}
+
+	fmt.Println("Making Subsonic Playlist")
+	made, err := s.change(fmt.Sprintf("create playlist %q", name), "createPlaylist", url.Values{"name": {name}})
+	if err != nil {
+		return "", err
+	}
+	if made.Playlist.Id != "" {
+		return made.Playlist.Id, nil
+	}
+
+	// servers older than 1.14.0 don't say what they made
+	found, err = s.call("getPlaylists", nil)
+	if err != nil {
+		return "", err
+	}
+	for _, playlist := range found.Playlists.Playlist {
+		if playlist.Name == name {
+			return playlist.Id, nil
+		}
+	}
+	return "", fmt.Errorf("subsonic made playlist %q but doesn't list it", name)
+}
+
+func (s *subsonicSink) List(playlistId string) ([]SinkTrack, error) {
+	tracks := []SinkTrack{}
+	if isDryRunId(playlistId) {
+		// never made, so there's nothing to read
+		return tracks, nil
+	}
+
+	data, err := s.call("getPlaylist", url.Values{"id": {playlistId}})
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range data.Playlist.Entry {
+		tracks = append(tracks, entry.sinkTrack())
+	}
+	return tracks, nil
+}
+
+// adds the songs the library has in one go, skipping the rest
+func (s *subsonicSink) Add(playlistId string, songs []Song) error {
+	songIds := []string{}
+	for _, song := range songs {
+		songId, err := s.match(song)
+		if err != nil {
+			return err
+		}
+		if songId == "" {
+			continue
+		}
+		songIds = append(songIds, songId)
+	}
+	if len(songIds) == 0 {
+		return nil
+	}
+
+	_, err := s.change(fmt.Sprintf("add %d song(s) to %s", len(songIds), playlistId), "updatePlaylist", url.Values{
+		"playlistId":  {playlistId},
+		"songIdToAdd": songIds,
+	})
+	return err
+}
+
+// takes tracks out by where they are in the playlist, which is all
+// updatePlaylist knows them by
+func (s *subsonicSink) Remove(playlistId string, tracks []SinkTrack) error {
+	existing, err := s.List(playlistId)
+	if err != nil {
+		return err
+	}
+	gone := map[string]bool{}
+	for _, track := range tracks {
+		gone[track.Id] = true
+	}
+	indexes := []string{}
+	for i, track := range existing {
+		if gone[track.Id] {
+			indexes = append(indexes, strconv.Itoa(i))
+		}
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	_, err = s.change(fmt.Sprintf("remove %d track(s) from %s", len(indexes), playlistId), "updatePlaylist", url.Values{
+		"playlistId":        {playlistId},
+		"songIndexToRemove": indexes,
+	})
+	return err
+}
+
+// the library's ID for a song, empty if it isn't in the library
+func (s *subsonicSink) search(song Song) (string, error) {
+	want := songKey(song.Artist, song.Title)
+	data, err := s.call("search3", url.Values{
+		"query":       {strings.TrimSpace(song.Artist + " " + song.Title)},
+		"songCount":   {"20"},
+		"artistCount": {"0"},
+		"albumCount":  {"0"},
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, found := range data.SearchResult3.Song {
+		if songKey(found.Artist, found.Title) == want {
+			return found.Id, nil
+		}
+	}
+	return "", nil
+}
+
+func (e subsonicSong) sinkTrack() SinkTrack {
+	return SinkTrack{
+		Id: e.Id,
+		Song: Song{
+			Artist:   e.Artist,
+			Title:    e.Title,
+			Duration: time.Duration(e.Duration) * time.Second,
+		},
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSubsonic answers the few Subsonic endpoints the sink uses, for the user
+// "sonic" with password "secret"
+type fakeSubsonic struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	library   []subsonicSong
+	playlists []*subsonicPlaylist
+	searches  int
+}
+
+func newFakeSubsonic() *fakeSubsonic {
+	f := &fakeSubsonic{}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeSubsonic) addSong(id, artist, title string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.library = append(f.library, subsonicSong{Id: id, Artist: artist, Title: title, Duration: 200})
+}
+
+// the IDs of the songs in the named playlist
+func (f *fakeSubsonic) playlist(name string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, p := range f.playlists {
+		if p.Name == name {
+			ids := []string{}
+			for _, entry := range p.Entry {
+				ids = append(ids, entry.Id)
+			}
+			return ids
+		}
+	}
+	return nil
+}
+
+func (f *fakeSubsonic) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	q := r.URL.Query()
+	answer := map[string]interface{}{"status": "ok", "version": subsonicVersion}
+	defer func() {
+		json.NewEncoder(w).Encode(map[string]interface{}{"subsonic-response": answer})
+	}()
+	token := md5.Sum([]byte("secret" + q.Get("s")))
+	if q.Get("u") != "sonic" || q.Get("t") != hex.EncodeToString(token[:]) || q.Get("p") != "" {
+		answer["status"] = "failed"
+		answer["error"] = map[string]interface{}{"code": 40, "message": "Wrong username or password"}
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, "/rest/") {
+	case "search3":
+		f.searches++
+		words := strings.Fields(strings.ToLower(q.Get("query")))
+		songs := []subsonicSong{}
+		for _, song := range f.library {
+			haystack := strings.ToLower(song.Artist + " " + song.Title)
+			found := true
+			for _, word := range words {
+				found = found && strings.Contains(haystack, word)
+			}
+			if found {
+				songs = append(songs, song)
+			}
+		}
+		answer["searchResult3"] = map[string]interface{}{"song": songs}
+	case "getPlaylists":
+		answer["playlists"] = map[string]interface{}{"playlist": f.playlists}
+	case "createPlaylist":
+		p := &subsonicPlaylist{Id: "pl" + strconv.Itoa(len(f.playlists)+1), Name: q.Get("name")}
+		f.playlists = append(f.playlists, p)
+		answer["playlist"] = p
+	case "getPlaylist", "updatePlaylist":
+		id := q.Get("id")
+		if id == "" {
+			id = q.Get("playlistId")
+		}
+		var p *subsonicPlaylist
+		for _, other := range f.playlists {
+			if other.Id == id {
+				p = other
+			}
+		}
+		if p == nil {
+			answer["status"] = "failed"
+			answer["error"] = map[string]interface{}{"code": 70, "message": "Playlist not found"}
+			return
+		}
+		if r.URL.Path == "/rest/getPlaylist" {
+			answer["playlist"] = p
+			return
+		}
+
+		indexes := []int{}
+		for _, index := range q["songIndexToRemove"] {
+			i, _ := strconv.Atoi(index)
+			indexes = append(indexes, i)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(indexes)))
+		for _, i := range indexes {
+			p.Entry = append(p.Entry[:i], p.Entry[i+1:]...)
+		}
+		for _, songId := range q["songIdToAdd"] {
+			for _, song := range f.library {
+				if song.Id == songId {
+					p.Entry = append(p.Entry, song)
+				}
+			}
+		}
+	default:
+		answer["status"] = "failed"
+		answer["error"] = map[string]interface{}{"code": 0, "message": "Unknown endpoint"}
+	}
+}
+
+// useSubsonic points the sink at the fake for the rest of the test
+func useSubsonic(t *testing.T) *fakeSubsonic {
+	fake := newFakeSubsonic()
+	oldURL, oldUser, oldPassword := subsonicURL, subsonicUser, subsonicPassword
+	subsonicURL, subsonicUser, subsonicPassword = fake.URL, "sonic", "secret"
+	t.Cleanup(func() {
+		fake.Close()
+		subsonicURL, subsonicUser, subsonicPassword = oldURL, oldUser, oldPassword
+	})
+	return fake
+}
+
+func TestSubsonicSinkMatchesAgainstTheLibrary(t *testing.T) {
+	env := newTestEnv(t)
+	fake := useSubsonic(t)
+	fake.addSong("lib1", "A", "One (Remastered)")
+	fake.addSong("lib2", "Local", "Demo")
+	fake.addSong("lib3", "B", "Two Step")
+	enabledSinks = "spotify,subsonic"
+	env.station.play(song("A - One", "track1"), song("Local - Demo", ""), song("B - Two", "track2"), song("A - One", "track1"))
+
+	env.login(t)
+
+	waitFor(t, "the library's songs", func() bool {
+		return sameTracks(fake.playlist("SONiC On Demand"), []string{"lib1", "lib2"})
+	})
+	waitFor(t, "the Spotify songs", func() bool {
+		return sameTracks(tracksOf(env.spotify.Playlist("SONiC On Demand")), []string{"track1", "track2"})
+	})
+
+	playlists := playlistsByTitle(t, "B - Two")
+	sink := sinksByName["subsonic"].(*subsonicSink)
+	if misses := sink.Misses(); len(misses) != 1 || misses[0].Title != "Two" {
+		t.Errorf("reported misses %+v, want B - Two", misses)
+	}
+	fake.mu.Lock()
+	searches := fake.searches
+	fake.mu.Unlock()
+	if searches != 3 {
+		t.Errorf("searched the library %d times for 3 songs", searches)
+	}
+
+	if got := playlists["B - Two"]; len(got) != 1 || !strings.HasPrefix(got[0], "spotify:") {
+		t.Errorf("B - Two went to %v", got)
+	}
+	if got := currentStatus().NotInLibrary; len(got) != 1 || got[0] != (missedSong{Sink: "subsonic", Artist: "B", Title: "Two"}) {
+		t.Errorf("status shows %+v not in the library", got)
+	}
+}
+
+func TestSubsonicSinkRemovesAndRejectsBadLogins(t *testing.T) {
+	newTestEnv(t)
+	fake := useSubsonic(t)
+	fake.addSong("lib1", "A", "One")
+	fake.addSong("lib2", "B", "Two")
+
+	sink, err := newSubsonicSink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlistId, err := sink.EnsurePlaylist("SONiC On Demand")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Add(playlistId, []Song{{Artist: "A", Title: "One"}, {Artist: "B", Title: "Two"}}); err != nil {
+		t.Fatal(err)
+	}
+	tracks, err := sink.List(playlistId)
+	if err != nil || len(tracks) != 2 {
+		t.Fatalf("listed %v, %v", tracks, err)
+	}
+	if err := sink.Remove(playlistId, tracks[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.playlist("SONiC On Demand"); !sameTracks(got, []string{"lib2"}) {
+		t.Errorf("playlist has %v after removing lib1", got)
+	}
+
+	sink.password = "wrong"
+	_, err = sink.List(playlistId)
+	if err == nil || retryable(err) {
+		t.Errorf("a bad login gave %v, want an error not worth retrying", err)
+	}
+}
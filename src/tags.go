@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// what the library needs from a music file's tags
+type fileTags struct {
+	Artist   string
+	Title    string
+	Duration time.Duration
+}
+
+// reads the tags of an MP3 (ID3v2, falling back to ID3v1), FLAC (Vorbis
+// comments) or MP4/M4A (iTunes atoms) file, going by what the file starts
+// with rather than its extension
+func readTags(path string) (fileTags, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return fileTags{}, err
+	}
+	defer file.Close()
+
+	magic := make([]byte, 12)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return fileTags{}, fmt.Errorf("%s: too short to be music", path)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fileTags{}, err
+	}
+
+	var tags fileTags
+	switch {
+	case string(magic[4:8]) == "ftyp":
+		tags, err = readMP4Tags(file)
+	case string(magic[:4]) == "fLaC":
+		tags, err = readFLACTags(file)
+	case string(magic[:3]) == "ID3":
+		tags, err = readID3v2(file)
+		// a FLAC file can start with an ID3 tag too
+		if flac, flacErr := readFLACAfterID3(file); err == nil && flacErr == nil {
+			tags = mergeTags(tags, flac)
+		}
+	}
+	if err != nil {
+		return tags, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	if tags.Title == "" {
+		if v1, err := readID3v1(file); err == nil {
+			tags = mergeTags(tags, v1)
+		}
+	}
+	return tags, nil
+}
+
+// fills the gaps in a with b
+func mergeTags(a fileTags, b fileTags) fileTags {
+	if a.Artist == "" {
+		a.Artist = b.Artist
+	}
+	if a.Title == "" {
+		a.Title = b.Title
+	}
+	if a.Duration == 0 {
+		a.Duration = b.Duration
+	}
+	return a
+}
+
+// sizes in ID3v2.4 headers and frames use 7 bits a byte
+func syncsafe(b []byte) int {
+	size := 0
+	for _, c := range b {
+		size = size<<7 | int(c&0x7f)
+	}
+	return size
+}
+
+func readID3v2(r io.ReadSeeker) (fileTags, error) {
+	tags := fileTags{}
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return tags, err
+	}
+	version, flags, size := header[3], header[5], syncsafe(header[6:10])
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return tags, fmt.Errorf("ID3 tag cut short")
+	}
+
+	if flags&0x40 != 0 && version >= 3 && len(body) >= 4 {
+		// skip the extended header
+		extended := int(binary.BigEndian.Uint32(body))
+		if version == 3 {
+			extended += 4
+		} else {
+			extended = syncsafe(body[:4])
+		}
+		if extended > len(body) {
+			return tags, fmt.Errorf("bad ID3 extended header")
+		}
+		body = body[extended:]
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for len(body) >= headerLen && body[0] != 0 {
+		id := string(body[:idLen])
+		var frameSize int
+		switch version {
+		case 2:
+			frameSize = int(body[3])<<16 | int(body[4])<<8 | int(body[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(body[4:8]))
+		default:
+			frameSize = syncsafe(body[4:8])
+		}
+		if frameSize > len(body)-headerLen {
+			break
+		}
+		frame := body[headerLen : headerLen+frameSize]
+		body = body[headerLen+frameSize:]
+
+		switch id {
+		case "TIT2", "TT2":
+			tags.Title = id3Text(frame)
+		case "TPE1", "TP1":
+			tags.Artist = id3Text(frame)
+		case "TPE2", "TP2":
+			if tags.Artist == "" {
+				tags.Artist = id3Text(frame)
+			}
+		case "TLEN", "TLE":
+			if ms, err := strconv.Atoi(id3Text(frame)); err == nil {
+				tags.Duration = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	return tags, nil
+}
+
+// the first value of a text frame, in whichever encoding it says it's in
+func id3Text(frame []byte) string {
+	if len(frame) == 0 {
+		return ""
+	}
+	encoding, text := frame[0], frame[1:]
+	var value string
+	switch encoding {
+	case 1, 2:
+		order := binary.ByteOrder(binary.BigEndian)
+		if encoding == 1 && len(text) >= 2 {
+			if text[0] == 0xff && text[1] == 0xfe {
+				order = binary.LittleEndian
+			}
+			if (text[0] == 0xff && text[1] == 0xfe) || (text[0] == 0xfe && text[1] == 0xff) {
+				text = text[2:]
+			}
+		}
+		units := []uint16{}
+		for i := 0; i+1 < len(text); i += 2 {
+			unit := order.Uint16(text[i:])
+			if unit == 0 {
+				break
+			}
+			units = append(units, unit)
+		}
+		value = string(utf16.Decode(units))
+	case 3:
+		value = strings.SplitN(string(text), "\x00", 2)[0]
+	default:
+		value = latin1(bytes.SplitN(text, []byte{0}, 2)[0])
+	}
+	return strings.TrimSpace(value)
+}
+
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// the 128 byte tag at the end of older MP3s
+func readID3v1(r io.ReadSeeker) (fileTags, error) {
+	tag := make([]byte, 128)
+	if _, err := r.Seek(-128, io.SeekEnd); err != nil {
+		return fileTags{}, err
+	}
+	if _, err := io.ReadFull(r, tag); err != nil {
+		return fileTags{}, err
+	}
+	if string(tag[:3]) != "TAG" {
+		return fileTags{}, fmt.Errorf("no ID3v1 tag")
+	}
+	field := func(b []byte) string {
+		return strings.TrimSpace(latin1(bytes.SplitN(b, []byte{0}, 2)[0]))
+	}
+	return fileTags{Title: field(tag[3:33]), Artist: field(tag[33:63])}, nil
+}
+
+// reads on from the end of an ID3 tag in case it's a FLAC file underneath
+func readFLACAfterID3(r io.ReadSeeker) (fileTags, error) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != "fLaC" {
+		return fileTags{}, fmt.Errorf("not FLAC")
+	}
+	return readFLACBlocks(r)
+}
+
+func readFLACTags(r io.ReadSeeker) (fileTags, error) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return fileTags{}, err
+	}
+	return readFLACBlocks(r)
+}
+
+// walks the metadata blocks for the stream info, which has the length, and
+// the Vorbis comments
+func readFLACBlocks(r io.Reader) (fileTags, error) {
+	tags := fileTags{}
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return tags, fmt.Errorf("FLAC metadata cut short")
+		}
+		last, kind := header[0]&0x80 != 0, header[0]&0x7f
+		block := make([]byte, int(header[1])<<16|int(header[2])<<8|int(header[3]))
+		if _, err := io.ReadFull(r, block); err != nil {
+			return tags, fmt.Errorf("FLAC metadata cut short")
+		}
+
+		switch kind {
+		case 0:
+			if len(block) >= 18 {
+				rate := int64(block[10])<<12 | int64(block[11])<<4 | int64(block[12])>>4
+				samples := int64(block[13]&0x0f)<<32 | int64(binary.BigEndian.Uint32(block[14:18]))
+				if rate > 0 {
+					tags.Duration = time.Duration(samples) * time.Second / time.Duration(rate)
+				}
+			}
+		case 4:
+			for key, value := range vorbisComments(block) {
+				switch key {
+				case "TITLE":
+					tags.Title = value
+				case "ARTIST":
+					tags.Artist = value
+				case "ALBUMARTIST":
+					if tags.Artist == "" {
+						tags.Artist = value
+					}
+				}
+			}
+		}
+		if last {
+			return tags, nil
+		}
+	}
+}
+
+// the first value of each comment, keys upper cased
+func vorbisComments(block []byte) map[string]string {
+	comments := map[string]string{}
+	read := func() ([]byte, bool) {
+		if len(block) < 4 {
+			return nil, false
+		}
+		n := int(binary.LittleEndian.Uint32(block))
+		if n > len(block)-4 {
+			return nil, false
+		}
+		value := block[4 : 4+n]
+		block = block[4+n:]
+		return value, true
+	}
+
+	if _, ok := read(); !ok {
+		// the vendor string
+		return comments
+	}
+	if len(block) < 4 {
+		return comments
+	}
+	count := int(binary.LittleEndian.Uint32(block))
+	block = block[4:]
+	for i := 0; i < count; i++ {
+		comment, ok := read()
+		if !ok {
+			break
+		}
+		parts := strings.SplitN(string(comment), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.ToUpper(parts[0])
+		if _, seen := comments[key]; !seen {
+			comments[key] = strings.TrimSpace(parts[1])
+		}
+	}
+	return comments
+}
+
+// an atom's type and where its contents are
+type mp4Atom struct {
+	kind  string
+	start int64
+	size  int64
+}
+
+// the atoms directly inside [start, end)
+func mp4Atoms(r io.ReadSeeker, start int64, end int64) ([]mp4Atom, error) {
+	atoms := []mp4Atom{}
+	for offset := start; offset+8 <= end; {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return atoms, err
+		}
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return atoms, err
+		}
+		size, headerSize := int64(binary.BigEndian.Uint32(header)), int64(8)
+		switch size {
+		case 0:
+			size = end - offset
+		case 1:
+			large := make([]byte, 8)
+			if _, err := io.ReadFull(r, large); err != nil {
+				return atoms, err
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(large)), 16
+		}
+		if size < headerSize || offset+size > end {
+			return atoms, fmt.Errorf("bad MP4 atom at %d", offset)
+		}
+		atoms = append(atoms, mp4Atom{kind: string(header[4:8]), start: offset + headerSize, size: size - headerSize})
+		offset += size
+	}
+	return atoms, nil
+}
+
+// reads the title and artist out of moov/udta/meta/ilst and the length out
+// of moov/mvhd, skipping over the audio itself
+func readMP4Tags(r io.ReadSeeker) (fileTags, error) {
+	tags := fileTags{}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return tags, err
+	}
+
+	find := func(atoms []mp4Atom, kind string) (mp4Atom, bool) {
+		for _, atom := range atoms {
+			if atom.kind == kind {
+				return atom, true
+			}
+		}
+		return mp4Atom{}, false
+	}
+	read := func(atom mp4Atom) ([]byte, error) {
+		data := make([]byte, atom.size)
+		if _, err := r.Seek(atom.start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		_, err := io.ReadFull(r, data)
+		return data, err
+	}
+
+	top, err := mp4Atoms(r, 0, end)
+	if err != nil {
+		return tags, err
+	}
+	moov, ok := find(top, "moov")
+	if !ok {
+		return tags, fmt.Errorf("no moov atom")
+	}
+	inMoov, err := mp4Atoms(r, moov.start, moov.start+moov.size)
+	if err != nil {
+		return tags, err
+	}
+
+	if mvhd, ok := find(inMoov, "mvhd"); ok {
+		if data, err := read(mvhd); err == nil && len(data) >= 20 {
+			var scale, length uint64
+			if data[0] == 1 && len(data) >= 32 {
+				scale, length = uint64(binary.BigEndian.Uint32(data[20:24])), binary.BigEndian.Uint64(data[24:32])
+			} else {
+				scale, length = uint64(binary.BigEndian.Uint32(data[12:16])), uint64(binary.BigEndian.Uint32(data[16:20]))
+			}
+			if scale > 0 {
+				tags.Duration = time.Duration(length) * time.Second / time.Duration(scale)
+			}
+		}
+	}
+
+	udta, ok := find(inMoov, "udta")
+	if !ok {
+		return tags, nil
+	}
+	inUdta, err := mp4Atoms(r, udta.start, udta.start+udta.size)
+	if err != nil {
+		return tags, err
+	}
+	meta, ok := find(inUdta, "meta")
+	if !ok {
+		return tags, nil
+	}
+	// meta has a version and flags before its children
+	inMeta, err := mp4Atoms(r, meta.start+4, meta.start+meta.size)
+	if err != nil {
+		return tags, err
+	}
+	ilst, ok := find(inMeta, "ilst")
+	if !ok {
+		return tags, nil
+	}
+	items, err := mp4Atoms(r, ilst.start, ilst.start+ilst.size)
+	if err != nil {
+		return tags, err
+	}
+
+	albumArtist := ""
+	for _, item := range items {
+		inItem, err := mp4Atoms(r, item.start, item.start+item.size)
+		if err != nil {
+			continue
+		}
+		dataAtom, ok := find(inItem, "data")
+		if !ok {
+			continue
+		}
+		data, err := read(dataAtom)
+		if err != nil || len(data) < 8 {
+			continue
+		}
+		// type and locale come before the value
+		value := strings.TrimSpace(string(data[8:]))
+		switch item.kind {
+		case "\xa9nam":
+			tags.Title = value
+		case "\xa9ART":
+			tags.Artist = value
+		case "aART":
+			albumArtist = value
+		}
+	}
+	if tags.Artist == "" {
+		tags.Artist = albumArtist
+	}
+	return tags, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// be32 and le32 append n in four bytes, le16 in two
+func be32(b []byte, n int) []byte {
+	return append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func le32(b []byte, n int) []byte {
+	return append(b, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+}
+
+func le16(b []byte, n uint16) []byte {
+	return append(b, byte(n), byte(n>>8))
+}
+
+// id3Frame builds an ID3v2.3 text frame
+func id3Frame(id string, text []byte) []byte {
+	return append(append(be32([]byte(id), len(text)), 0, 0), text...)
+}
+
+// syncsafeBytes is the ID3 tag size encoding
+func syncsafeBytes(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+}
+
+// mp3File is an ID3v2.3 tag with a UTF-16 artist, then some audio
+func mp3File(artist, title string, ms string) []byte {
+	artistText := []byte{1, 0xff, 0xfe}
+	for _, unit := range utf16.Encode([]rune(artist)) {
+		artistText = le16(artistText, unit)
+	}
+	frames := append(id3Frame("TPE1", artistText), id3Frame("TIT2", append([]byte{0}, title...))...)
+	frames = append(frames, id3Frame("TLEN", append([]byte{3}, ms...))...)
+	// padding
+	frames = append(frames, make([]byte, 16)...)
+
+	file := append([]byte("ID3\x03\x00\x00"), syncsafeBytes(len(frames))...)
+	file = append(file, frames...)
+	return append(file, 0xff, 0xfb, 0x90, 0x00)
+}
+
+// flacFile is stream info for a length at 44.1kHz, then Vorbis comments
+func flacFile(artist, title string, length time.Duration) []byte {
+	info := make([]byte, 34)
+	rate := 44100
+	samples := int64(length / time.Second * 44100)
+	info[10], info[11], info[12] = byte(rate>>12), byte(rate>>4), byte(rate<<4)
+	info[13] = byte(samples >> 32 & 0x0f)
+	binary.BigEndian.PutUint32(info[14:18], uint32(samples))
+
+	comments := append(le32(nil, 6), "vendor"...)
+	comments = le32(comments, 2)
+	for _, c := range []string{"artist=" + artist, "TITLE=" + title} {
+		comments = le32(comments, len(c))
+		comments = append(comments, c...)
+	}
+
+	file := []byte("fLaC")
+	file = append(file, 0, 0, 0, byte(len(info)))
+	file = append(file, info...)
+	file = append(file, 0x84, byte(len(comments)>>16), byte(len(comments)>>8), byte(len(comments)))
+	return append(file, comments...)
+}
+
+// atom wraps contents in an MP4 atom
+func atom(kind string, contents ...[]byte) []byte {
+	body := bytes.Join(contents, nil)
+	return append(append(be32(nil, 8+len(body)), kind...), body...)
+}
+
+// m4aFile has the audio before the tags, like most encoders write it
+func m4aFile(artist, title string, length time.Duration) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:16], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:20], uint32(length/time.Millisecond))
+	item := func(kind, value string) []byte {
+		return atom(kind, atom("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, []byte(value)))
+	}
+	meta := atom("meta", []byte{0, 0, 0, 0}, atom("hdlr", make([]byte, 25)), atom("ilst", item("\xa9nam", title), item("\xa9ART", artist)))
+	return bytes.Join([][]byte{
+		atom("ftyp", []byte("M4A \x00\x00\x00\x00")),
+		atom("mdat", make([]byte, 64)),
+		atom("moov", atom("mvhd", mvhd), atom("udta", meta)),
+	}, nil)
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadTags(t *testing.T) {
+	dir := t.TempDir()
+	id3v1 := append([]byte{0xff, 0xfb, 0x90, 0x00}, make([]byte, 128)...)
+	copy(id3v1[4:], "TAG")
+	copy(id3v1[7:], "Old Song")
+	copy(id3v1[37:], "Old Band")
+
+	for name, c := range map[string]struct {
+		data []byte
+		want fileTags
+	}{
+		"a.mp3":  {mp3File("Beyoncé", "Halo", "261000"), fileTags{"Beyoncé", "Halo", 261 * time.Second}},
+		"b.flac": {flacFile("The Band", "Song", 200*time.Second), fileTags{"The Band", "Song", 200 * time.Second}},
+		"c.m4a":  {m4aFile("Artist", "Track", 185*time.Second), fileTags{"Artist", "Track", 185 * time.Second}},
+		"d.mp3":  {id3v1, fileTags{"Old Band", "Old Song", 0}},
+	} {
+		path := filepath.Join(dir, name)
+		writeFile(t, path, c.data)
+		got, err := readTags(path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if got != c.want {
+			t.Errorf("%s read as %+v, want %+v", name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/oauth2"
+)
+
+// the last login is kept here so the command line tools can act for the
+// same user without a browser. Empty doesn't keep it.
+var tokenPath = filepath.Join(dataDir, "token.json")
+
+func saveToken(token *oauth2.Token) error {
+	return saveTokenAt(tokenPath, token)
+}
+
+// the token from the last login, refreshed as needed once it's in a client
+func loadToken() (*oauth2.Token, error) {
+	return loadTokenFrom(tokenPath, "log in through the web page first")
+}
+
+// keeps a login for another service, empty path doesn't keep it
+func saveTokenAt(path string, token *oauth2.Token) error {
+	return writeJSONFileMode(path, token, 0600)
+}
+
+// a login saved with saveTokenAt, with what to do when there isn't one
+func loadTokenFrom(path string, hint string) (*oauth2.Token, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no saved login, %s", hint)
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, fmt.Errorf("no saved login at %s, %s", path, hint)
+	}
+
+	token := &oauth2.Token{}
+	if err := readJSONFile(path, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// a client for the saved login with its session started, for commands. The
+// client is nil when Spotify isn't one of the sinks, no login is needed then.
+func savedSession() (*http.Client, error) {
+	if !sinkEnabled("spotify") {
+		return nil, startSession(nil)
+	}
+	token, err := loadToken()
+	if err != nil {
+		return nil, err
+	}
+	client := spotifyClient(token)
+	return client, startSession(client)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// what the derived playlists need of Spotify's tracks and artists, so none is
+// asked about twice. Empty keeps it in memory.
+var trackCachePath = filepath.Join(dataDir, "tracks.json")
+
+var getTracksURL = "/tracks?ids="
+var getArtistsURL = "/artists?ids="
+
+// Spotify takes at most this many IDs when getting several tracks or artists
+const maxIdsPerLookup = 50
+
+// cachedTrack is what's kept of a Spotify track
+type cachedTrack struct {
+	Artists []string `json:"artists"`
+	// the album's, as precise as Spotify has it: "1994", "1994-03" or
+	// "1994-03-08"
+	ReleaseDate string `json:"release_date"`
+	// the album art's URL, the size nearest coverSize
+	Cover string `json:"cover,omitempty"`
+	ISRC  string `json:"isrc,omitempty"`
+}
+
+// the width of album art wanted for playlist covers
+const coverSize = 300
+
+// trackCache keeps tracks and, when genre playlists want them, their
+// artists' genres, asking Spotify for the ones it doesn't have a batch at a
+// time
+type trackCache struct {
+	client *http.Client
+	path   string
+
+	mu     sync.Mutex
+	genres bool
+	data   struct {
+		// nil for tracks Spotify doesn't have
+		Tracks map[string]*cachedTrack `json:"tracks"`
+		// genres by artist ID
+		Artists map[string][]string `json:"artists"`
+	}
+}
+
+// the cache every derived playlist shares while the sinks are open
+var openedTrackCache *trackCache
+
+// the shared cache, read from trackCachePath the first time
+func openTrackCache(client *http.Client) (*trackCache, error) {
+	if openedTrackCache != nil {
+		return openedTrackCache, nil
+	}
+	cache := newTrackCache(client, trackCachePath)
+	if err := cache.load(); err != nil {
+		return nil, err
+	}
+	openedTrackCache = cache
+	prefetchers = append(prefetchers, cache.fetch)
+	return cache, nil
+}
+
+func newTrackCache(client *http.Client, path string) *trackCache {
+	c := &trackCache{client: client, path: path}
+	c.data.Tracks, c.data.Artists = map[string]*cachedTrack{}, map[string][]string{}
+	return c
+}
+
+// looks up the genres of each track's artists from now on too
+func (c *trackCache) wantGenres() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.genres = true
+}
+
+// reads the saved tracks, a missing file is none
+func (c *trackCache) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return readJSONFile(c.path, &c.data)
+}
+
+// writes the cache out in one go, c must be locked
+func (c *trackCache) save() error {
+	return writeJSONFile(c.path, c.data)
+}
+
+// the track, looking it up if it's new. Nil when Spotify doesn't have it.
+func (c *trackCache) track(trackId string) (*cachedTrack, error) {
+	if err := c.fetch([]string{trackId}); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.data.Tracks[trackId], nil
+}
+
+// the genres of all of a track's artists, looking them up if it's new.
+// known is false when the track couldn't be looked up.
+func (c *trackCache) trackGenres(trackId string) ([]string, bool, error) {
+	track, err := c.track(trackId)
+	if err != nil || track == nil {
+		return nil, false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	genres := []string{}
+	for _, artistId := range track.Artists {
+		genres = append(genres, c.data.Artists[artistId]...)
+	}
+	return genres, true, nil
+}
+
+// when the track's album came out, false if Spotify doesn't say
+func (c *trackCache) releaseDate(trackId string) (time.Time, bool, error) {
+	track, err := c.track(trackId)
+	if err != nil || track == nil {
+		return time.Time{}, false, err
+	}
+	released, ok := parseReleaseDate(track.ReleaseDate)
+	return released, ok, nil
+}
+
+// the genres of the song's artists, known false when it isn't on Spotify or
+// couldn't be looked up
+func (c *trackCache) songGenres(song Song) ([]string, bool) {
+	if song.SpotifyId == "" {
+		return nil, false
+	}
+	genres, known, err := c.trackGenres(song.SpotifyId)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+	return genres, known
+}
+
+// when the song's album came out, known false when it isn't on Spotify or
+// Spotify doesn't say
+func (c *trackCache) songReleased(song Song) (time.Time, bool) {
+	if song.SpotifyId == "" {
+		return time.Time{}, false
+	}
+	date, known, err := c.releaseDate(song.SpotifyId)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+	return date, known
+}
+
+// the track's album art, empty if Spotify has none
+func (c *trackCache) cover(trackId string) (string, error) {
+	track, err := c.track(trackId)
+	if err != nil || track == nil {
+		return "", err
+	}
+	return track.Cover, nil
+}
+
+// fills in the ISRCs of the songs on Spotify that don't have one, looking
+// them all up at once
+func (c *trackCache) withISRCs(songs []Song) []Song {
+	trackIds := []string{}
+	for _, song := range songs {
+		if song.ISRC == "" {
+			trackIds = append(trackIds, song.SpotifyId)
+		}
+	}
+	if err := c.fetch(trackIds); err != nil {
+		// the songs are still compared by artist and title
+		fmt.Println(err.Error())
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	filled := make([]Song, len(songs))
+	for i, song := range songs {
+		if track := c.data.Tracks[song.SpotifyId]; song.ISRC == "" && track != nil {
+			song.ISRC = track.ISRC
+		}
+		filled[i] = song
+	}
+	return filled
+}
+
+// albumImage is one size of a Spotify album's art
+type albumImage struct {
+	URL   string `json:"url"`
+	Width int    `json:"width"`
+}
+
+// the URL of the image closest to the width, empty when there are none
+func nearestImage(images []albumImage, width int) string {
+	best, off := "", 0
+	for _, image := range images {
+		distance := image.Width - width
+		if distance < 0 {
+			distance = -distance
+		}
+		if best == "" || distance < off {
+			best, off = image.URL, distance
+		}
+	}
+	return best
+}
+
+// reads a release date to the start of the year or month when that's all
+// there is. Spotify has "0000" for some it doesn't know.
+func parseReleaseDate(date string) (time.Time, bool) {
+	for _, layout := range []string{"2006-01-02", "2006-01", "2006"} {
+		if released, err := time.Parse(layout, date); err == nil && released.Year() > 1000 {
+			return released, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// looks up the tracks that aren't cached yet, then the artists that aren't
+// if genres are wanted, as many to a request as Spotify takes. The cache is
+// only locked around reading and filling it, not while Spotify answers, and
+// only saved when something new was found.
+func (c *trackCache) fetch(trackIds []string) error {
+	c.mu.Lock()
+	missing := []string{}
+	for _, id := range trackIds {
+		if _, ok := c.data.Tracks[id]; !ok && id != "" {
+			missing = append(missing, id)
+		}
+	}
+	c.mu.Unlock()
+
+	found := map[string]*cachedTrack{}
+	err := inBatches(missing, func(batch []string) error {
+		tracks := struct {
+			Tracks []*struct {
+				Artists []struct {
+					Id string `json:"id"`
+				} `json:"artists"`
+				Album struct {
+					ReleaseDate string       `json:"release_date"`
+					Images      []albumImage `json:"images"`
+				} `json:"album"`
+				ExternalIds struct {
+					ISRC string `json:"isrc"`
+				} `json:"external_ids"`
+			} `json:"tracks"`
+		}{}
+		if err := getSpotifyIds(c.client, getTracksURL, batch, &tracks); err != nil {
+			return err
+		}
+		for i, id := range batch {
+			if i >= len(tracks.Tracks) || tracks.Tracks[i] == nil {
+				found[id] = nil
+				continue
+			}
+			album := tracks.Tracks[i].Album
+			track := &cachedTrack{
+				Artists:     []string{},
+				ReleaseDate: album.ReleaseDate,
+				Cover:       nearestImage(album.Images, coverSize),
+				ISRC:        tracks.Tracks[i].ExternalIds.ISRC,
+			}
+			for _, artist := range tracks.Tracks[i].Artists {
+				track.Artists = append(track.Artists, artist.Id)
+			}
+			found[id] = track
+		}
+		return nil
+	})
+	// whatever was found before a failure is kept
+	c.mu.Lock()
+	for id, track := range found {
+		c.data.Tracks[id] = track
+	}
+	changed := len(found) > 0
+	missing = []string{}
+	if err == nil && c.genres {
+		for _, id := range trackIds {
+			if track := c.data.Tracks[id]; track != nil {
+				for _, artistId := range track.Artists {
+					if _, ok := c.data.Artists[artistId]; !ok && artistId != "" {
+						missing = append(missing, artistId)
+					}
+				}
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	genres := map[string][]string{}
+	if err == nil {
+		err = inBatches(missing, func(batch []string) error {
+			artists := struct {
+				Artists []*struct {
+					Genres []string `json:"genres"`
+				} `json:"artists"`
+			}{}
+			if err := getSpotifyIds(c.client, getArtistsURL, batch, &artists); err != nil {
+				return err
+			}
+			for i, id := range batch {
+				genres[id] = []string{}
+				if i < len(artists.Artists) && artists.Artists[i] != nil {
+					genres[id] = append(genres[id], artists.Artists[i].Genres...)
+				}
+			}
+			return nil
+		})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, artistGenres := range genres {
+		c.data.Artists[id] = artistGenres
+	}
+	if changed || len(genres) > 0 {
+		if saveErr := c.save(); err == nil {
+			err = saveErr
+		}
+	}
+	return err
+}
+
+// calls do with the unique IDs, maxIdsPerLookup at a time
+func inBatches(ids []string, do func(batch []string) error) error {
+	unique, seen := []string{}, map[string]bool{}
+	for _, id := range ids {
+		if !seen[id] {
+			unique = append(unique, id)
+			seen[id] = true
+		}
+	}
+	for len(unique) > 0 {
+		batch := unique
+		if len(batch) > maxIdsPerLookup {
+			batch = batch[:maxIdsPerLookup]
+		}
+		unique = unique[len(batch):]
+		if err := do(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gets several things by ID from an endpoint like getTracksURL into out
+func getSpotifyIds(client *http.Client, endpoint string, ids []string, out interface{}) error {
+	return getSpotify(client, spotifyURL(endpoint)+strings.Join(ids, ","), out)
+}
+
+// gets a Spotify API URL into out
+func getSpotify(client *http.Client, url string, out interface{}) error {
+	res, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := checkResponse(res); err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
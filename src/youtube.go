@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Google's OAuth endpoints, there's no golang.org/x/oauth2/google vendored
+var googleEndpoint = oauth2.Endpoint{
+	AuthURL:   "https://accounts.google.com/o/oauth2/auth",
+	TokenURL:  "https://oauth2.googleapis.com/token",
+	AuthStyle: oauth2.AuthStyleInParams,
+}
+
+var youtubeConfig = oauth2.Config{
+	ClientID:     os.Getenv("YOUTUBE_CLIENTID"),
+	ClientSecret: os.Getenv("YOUTUBE_CLIENTSECRET"),
+	Scopes:       []string{"https://www.googleapis.com/auth/youtube"},
+	RedirectURL:  "http://localhost:3000/youtube/callback",
+	Endpoint:     googleEndpoint,
+}
+
+var youtubeAPIURL = "https://www.googleapis.com/youtube/v3"
+
+// the YouTube login, kept like the Spotify one
+var youtubeTokenPath = filepath.Join(dataDir, "youtube-token.json")
+
+// the API allows 10,000 units a day by default, reset at midnight Pacific.
+// What's been spent is kept so a restart doesn't forget it. Empty keeps it in
+// memory.
+var youtubeDailyQuota = 10000
+var youtubeQuotaPath = filepath.Join(dataDir, "youtube-quota.json")
+var youtubeQuotaZone = loadTimeZone("America/Los_Angeles")
+
+// how many videos a playlist takes before songs go in a new part, a little
+// under the 5,000 YouTube allows
+var youtubeCeiling = 4900
+
+// what each call costs in quota units
+const (
+	youtubeListCost   = 1
+	youtubeSearchCost = 100
+	youtubeWriteCost  = 50
+)
+
+func init() {
+	if quota, err := strconv.Atoi(os.Getenv("YOUTUBE_DAILY_QUOTA")); err == nil {
+		youtubeDailyQuota = quota
+	}
+}
+
+// GET /youtube/login
+func youtubeLoginHandler(w http.ResponseWriter, r *http.Request) {
+	url := youtubeConfig.AuthCodeURL(stateString, oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+}
+
+// saves the YouTube login, then carries on to the next one
+func youtubeCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("state") != stateString {
+		fmt.Println("invalid state")
+		http.Redirect(w, r, "/error", http.StatusTemporaryRedirect)
+		return
+	}
+	token, err := youtubeConfig.Exchange(context.WithValue(ctx, oauth2.HTTPClient, httpClient), r.FormValue("code"))
+	if err != nil {
+		fmt.Println("code exchange failed: " + err.Error())
+		http.Redirect(w, r, "/error", http.StatusTemporaryRedirect)
+		return
+	}
+	if err := saveTokenAt(youtubeTokenPath, token); err != nil {
+		fmt.Println(err.Error())
+	}
+	youtubeLogin = token
+	continueLogin(w, r)
+}
+
+// the login from this run, before falling back to the saved one
+var youtubeLogin *oauth2.Token
+
+// whether the YouTube sink still needs someone to log in
+func needsYouTubeLogin() bool {
+	if !sinkEnabled("youtube") || youtubeLogin != nil {
+		return false
+	}
+	_, err := loadTokenFrom(youtubeTokenPath, "")
+	return err != nil
+}
+
+// youtubeQuota is the day's quota and what's been spent of it
+type youtubeQuota struct {
+	mu    sync.Mutex
+	Day   string `json:"day"`
+	Spent int    `json:"spent"`
+}
+
+// reads what's been spent today, a missing file is nothing
+func loadYouTubeQuota() (*youtubeQuota, error) {
+	quota := &youtubeQuota{}
+	if err := readJSONFile(youtubeQuotaPath, quota); err != nil {
+		return nil, err
+	}
+	return quota, nil
+}
+
+// takes cost units from today's quota, or says how long until there's more.
+// Calls are paid for whether they work or not, so it's spent up front.
+func (q *youtubeQuota) spend(cost int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := clock.Now().In(youtubeQuotaZone)
+	if today := now.Format("2006-01-02"); q.Day != today {
+		q.Day, q.Spent = today, 0
+	}
+	if q.Spent+cost > youtubeDailyQuota {
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, youtubeQuotaZone)
+		return &apiError{
+			Method:     "YouTube",
+			Path:       "quota",
+			Status:     fmt.Sprintf("daily quota spent (%d of %d units)", q.Spent, youtubeDailyQuota),
+			StatusCode: http.StatusTooManyRequests,
+			RetryAfter: midnight.Sub(now),
+		}
+	}
+	q.Spent += cost
+	return q.save()
+}
+
+// what YouTube said, when it says the quota's gone before we think it has
+func (q *youtubeQuota) exhaust() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.Spent = youtubeDailyQuota
+	q.save()
+}
+
+// what's left today
+func (q *youtubeQuota) remaining() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.Day != clock.Now().In(youtubeQuotaZone).Format("2006-01-02") {
+		return youtubeDailyQuota
+	}
+	return youtubeDailyQuota - q.Spent
+}
+
+// q must be locked
+func (q *youtubeQuota) save() error {
+	return writeJSONFile(youtubeQuotaPath, q)
+}
+
+// youtubeSink keeps a playlist on the logged in user's YouTube channel,
+// finding a video for each aired song
+type youtubeSink struct {
+	client *http.Client
+	quota  *youtubeQuota
+
+	*matcher
+
+	mu sync.Mutex
+	// videos put in each playlist this run, so a retried batch that got part
+	// way doesn't put them in twice
+	inserted map[string]bool
+}
+
+func newYouTubeSink() (*youtubeSink, error) {
+	token := youtubeLogin
+	if token == nil {
+		var err error
+		if token, err = loadTokenFrom(youtubeTokenPath, "log in to YouTube at localhost:3000/youtube/login first"); err != nil {
+			return nil, err
+		}
+	}
+	quota, err := loadYouTubeQuota()
+	if err != nil {
+		return nil, err
+	}
+	s := &youtubeSink{
+		client:   youtubeConfig.Client(context.WithValue(ctx, oauth2.HTTPClient, httpClient), token),
+		quota:    quota,
+		inserted: map[string]bool{},
+	}
+	s.matcher = newMatcher("YouTube", s.search)
+	return s, nil
+}
+
+func (s *youtubeSink) Name() string {
+	return "youtube"
+}
+
+func (s *youtubeSink) Ceiling() int {
+	return youtubeCeiling
+}
+
+// GETs from the API once the quota allows it
+func (s *youtubeSink) get(cost int, endpoint string, params url.Values, out interface{}) error {
+	if err := s.quota.spend(cost); err != nil {
+		return err
+	}
+	res, err := s.client.Get(youtubeAPIURL + endpoint + "?" + params.Encode())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if err := s.checkQuota(res, body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
+
+// sends a change once the quota allows it, or notes it in a dry run
+func (s *youtubeSink) change(action string, method string, endpoint string, params url.Values, payload interface{}) ([]byte, error) {
+	if !dryRun {
+		if err := s.quota.spend(youtubeWriteCost); err != nil {
+			return nil, err
+		}
+	}
+	body, err := sendChange(s.client, action, method, youtubeAPIURL+endpoint+"?"+params.Encode(), payload)
+	if apiErr, ok := err.(*apiError); ok && apiErr.StatusCode == http.StatusForbidden && strings.Contains(string(body), "quotaExceeded") {
+		s.quota.exhaust()
+		return nil, s.quota.spend(youtubeWriteCost)
+	}
+	return body, err
+}
+
+// turns a 403 for running out of quota into a wait until midnight, and other
+// failures into *apiError
+func (s *youtubeSink) checkQuota(res *http.Response, body []byte) error {
+	err := checkResponse(res)
+	if err == nil {
+		return nil
+	}
+	if res.StatusCode == http.StatusForbidden && strings.Contains(string(body), "quotaExceeded") {
+		s.quota.exhaust()
+		return s.quota.spend(youtubeListCost)
+	}
+	return err
+}
+
+type youtubePlaylists struct {
+	NextPageToken string `json:"nextPageToken"`
+	Items         []struct {
+		Id      string `json:"id"`
+		Snippet struct {
+			Title string `json:"title"`
+		} `json:"snippet"`
+	} `json:"items"`
+}
+
+type youtubePlaylistItems struct {
+	NextPageToken string `json:"nextPageToken"`
+	Items         []struct {
+		Id      string `json:"id"`
+		Snippet struct {
+			Title                  string `json:"title"`
+			VideoOwnerChannelTitle string `json:"videoOwnerChannelTitle"`
+			ResourceId             struct {
+				VideoId string `json:"videoId"`
+			} `json:"resourceId"`
+		} `json:"snippet"`
+	} `json:"items"`
+}
+
+type youtubeSearchResults struct {
+	Items []struct {
+		Id struct {
+			VideoId string `json:"videoId"`
+		} `json:"id"`
+		Snippet struct {
+			Title        string `json:"title"`
+			ChannelTitle string `json:"channelTitle"`
+		} `json:"snippet"`
+	} `json:"items"`
+}
+
+func (s *youtubeSink) EnsurePlaylist(name string) (string, error) {
+	pageToken := ""
+	for {
+		page := youtubePlaylists{}
+		params := url.Values{"part": {"snippet"}, "mine": {"true"}, "maxResults": {"50"}}
+		if pageToken != "" {
+			params.Set("pageToken", pageToken)
+		}
+		if err := s.get(youtubeListCost, "/playlists", params, &page); err != nil {
+			return "", err
+		}
+		for _, playlist := range page.Items {
+			if playlist.Snippet.Title == name {
+				return playlist.Id, nil
+			}
+		}
+		if pageToken = page.NextPageToken; pageToken == "" {
+			break
+		}
+	}
+
+	fmt.Println("Making YouTube Playlist")
+	body, err := s.change(fmt.Sprintf("create playlist %q", name), "POST", "/playlists", url.Values{"part": {"snippet,status"}}, map[string]interface{}{
+		"snippet": map[string]string{"title": name, "description": "Playlist made from SONiC 102.9"},
+		"status":  map[string]string{"privacyStatus": "private"},
+	})
+	if err != nil {
+		return "", err
+	}
+	made := struct {
+		Id string `json:"id"`
+	}{}
+	json.Unmarshal(body, &made)
+	return made.Id, nil
+}
+
+func (s *youtubeSink) List(playlistId string) ([]SinkTrack, error) {
+	tracks := []SinkTrack{}
+	if isDryRunId(playlistId) {
+		// never made, so there's nothing to read
+		return tracks, nil
+	}
+
+	pageToken := ""
+	for {
+		page := youtubePlaylistItems{}
+		params := url.Values{"part": {"snippet"}, "playlistId": {playlistId}, "maxResults": {"50"}}
+		if pageToken != "" {
+			params.Set("pageToken", pageToken)
+		}
+		if err := s.get(youtubeListCost, "/playlistItems", params, &page); err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			song := youtubeSong(item.Snippet.Title, item.Snippet.VideoOwnerChannelTitle)
+			tracks = append(tracks, SinkTrack{Id: item.Id, Song: song})
+			s.mu.Lock()
+			s.inserted[playlistId+"/"+item.Snippet.ResourceId.VideoId] = true
+			s.mu.Unlock()
+		}
+		if pageToken = page.NextPageToken; pageToken == "" {
+			return tracks, nil
+		}
+	}
+}
+
+// a video as a song: Topic channels are "Artist - Topic" with the song's
+// title, anything else is hopefully titled "Artist - Title"
+func youtubeSong(title string, channel string) Song {
+	title = html.UnescapeString(title)
+	if strings.HasSuffix(channel, " - Topic") {
+		return Song{Artist: strings.TrimSuffix(channel, " - Topic"), Title: title}
+	}
+	artist, songTitle := splitSongTitle(title)
+	return Song{Artist: artist, Title: songTitle}
+}
+
+// puts each song's video in, one request a video as the API wants
+func (s *youtubeSink) Add(playlistId string, songs []Song) error {
+	for _, song := range songs {
+		videoId, err := s.match(song)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		done := videoId == "" || s.inserted[playlistId+"/"+videoId]
+		s.mu.Unlock()
+		if done {
+			continue
+		}
+
+		_, err = s.change("add video "+videoId+" to "+playlistId, "POST", "/playlistItems", url.Values{"part": {"snippet"}}, map[string]interface{}{
+			"snippet": map[string]interface{}{
+				"playlistId": playlistId,
+				"resourceId": map[string]string{"kind": "youtube#video", "videoId": videoId},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.inserted[playlistId+"/"+videoId] = true
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *youtubeSink) Remove(playlistId string, tracks []SinkTrack) error {
+	for _, track := range tracks {
+		if _, err := s.change("remove item "+track.Id+" from "+playlistId, "DELETE", "/playlistItems", url.Values{"id": {track.Id}}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the video for a song, preferring the official upload on the artist's
+// auto-generated "Artist - Topic" channel
+func (s *youtubeSink) search(song Song) (string, error) {
+	found := youtubeSearchResults{}
+	err := s.get(youtubeSearchCost, "/search", url.Values{
+		"part":            {"snippet"},
+		"type":            {"video"},
+		"videoCategoryId": {"10"},
+		"maxResults":      {"10"},
+		"q":               {strings.TrimSpace(song.Artist + " - " + song.Title)},
+	}, &found)
+	if err != nil {
+		return "", err
+	}
+
+	want := songKey(song.Artist, song.Title)
+	artist, title := normaliseArtist(song.Artist), normaliseTitle(song.Title)
+	topic, other := "", ""
+	for _, item := range found.Items {
+		if !strings.HasSuffix(item.Snippet.ChannelTitle, " - Topic") {
+			// an upload whose title names both, like "Artist - Title (Official Video)"
+			name := normalise(html.UnescapeString(item.Snippet.Title))
+			if other == "" && strings.Contains(name, artist) && strings.Contains(name, title) {
+				other = item.Id.VideoId
+			}
+			continue
+		}
+		video := youtubeSong(item.Snippet.Title, item.Snippet.ChannelTitle)
+		if songKey(video.Artist, video.Title) == want {
+			return item.Id.VideoId, nil
+		}
+		if topic == "" && normaliseArtist(video.Artist) == artist && strings.Contains(normalise(video.Title), title) {
+			topic = item.Id.VideoId
+		}
+	}
+	if topic != "" {
+		return topic, nil
+	}
+	return other, nil
+}
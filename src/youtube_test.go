@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+type fakeVideo struct {
+	Id      string
+	Title   string
+	Channel string
+}
+
+// fakeYouTube is Google's token endpoint and the few Data API endpoints the
+// sink uses, searching by every word of q
+type fakeYouTube struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	videos    []fakeVideo
+	playlists map[string][]string
+	names     map[string]string
+	calls     map[string]int
+}
+
+func newFakeYouTube() *fakeYouTube {
+	f := &fakeYouTube{playlists: map[string][]string{}, names: map[string]string{}, calls: map[string]int{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeYouTube) addVideo(id, title, channel string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.videos = append(f.videos, fakeVideo{id, title, channel})
+}
+
+// the videos in the named playlist
+func (f *fakeYouTube) playlist(name string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id, other := range f.names {
+		if other == name {
+			return append([]string(nil), f.playlists[id]...)
+		}
+	}
+	return nil
+}
+
+func (f *fakeYouTube) count(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[key]
+}
+
+func (f *fakeYouTube) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[r.Method+" "+r.URL.Path]++
+
+	if r.URL.Path == "/token" {
+		writeJSON(w, map[string]interface{}{"access_token": "yt-token", "refresh_token": "yt-refresh", "token_type": "Bearer", "expires_in": 3600})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer yt-token" {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	switch r.Method + " " + r.URL.Path {
+	case "GET /v3/playlists":
+		items := []map[string]interface{}{}
+		for id, name := range f.names {
+			items = append(items, map[string]interface{}{"id": id, "snippet": map[string]string{"title": name}})
+		}
+		writeJSON(w, map[string]interface{}{"items": items})
+	case "POST /v3/playlists":
+		var body struct {
+			Snippet struct{ Title string } `json:"snippet"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		id := "PL" + strconv.Itoa(len(f.names)+1)
+		f.names[id] = body.Snippet.Title
+		writeJSON(w, map[string]string{"id": id})
+	case "GET /v3/playlistItems":
+		items := []map[string]interface{}{}
+		for i, videoId := range f.playlists[q.Get("playlistId")] {
+			for _, v := range f.videos {
+				if v.Id == videoId {
+					items = append(items, map[string]interface{}{"id": "item" + strconv.Itoa(i), "snippet": map[string]interface{}{
+						"title": v.Title, "videoOwnerChannelTitle": v.Channel, "resourceId": map[string]string{"videoId": v.Id},
+					}})
+				}
+			}
+		}
+		writeJSON(w, map[string]interface{}{"items": items})
+	case "POST /v3/playlistItems":
+		var body struct {
+			Snippet struct {
+				PlaylistId string `json:"playlistId"`
+				ResourceId struct {
+					VideoId string `json:"videoId"`
+				} `json:"resourceId"`
+			} `json:"snippet"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.playlists[body.Snippet.PlaylistId] = append(f.playlists[body.Snippet.PlaylistId], body.Snippet.ResourceId.VideoId)
+		writeJSON(w, map[string]string{"id": "item"})
+	case "GET /v3/search":
+		words := strings.Fields(strings.ToLower(strings.Replace(q.Get("q"), " - ", " ", -1)))
+		items := []map[string]interface{}{}
+		for _, v := range f.videos {
+			haystack := strings.ToLower(v.Title + " " + v.Channel)
+			found := true
+			for _, word := range words {
+				found = found && strings.Contains(haystack, word)
+			}
+			if found {
+				items = append(items, map[string]interface{}{
+					"id":      map[string]string{"videoId": v.Id},
+					"snippet": map[string]string{"title": v.Title, "channelTitle": v.Channel},
+				})
+			}
+		}
+		writeJSON(w, map[string]interface{}{"items": items})
+	default:
+		http.Error(w, "", http.StatusNotFound)
+	}
+}
+
+// useYouTube points the sink and its login at the fake
+func useYouTube(t *testing.T) *fakeYouTube {
+	fake := newFakeYouTube()
+	oldAPI, oldEndpoint, oldToken, oldQuotaPath, oldQuota := youtubeAPIURL, youtubeConfig.Endpoint, youtubeTokenPath, youtubeQuotaPath, youtubeDailyQuota
+	youtubeAPIURL = fake.URL + "/v3"
+	youtubeConfig.Endpoint = oauth2.Endpoint{AuthURL: fake.URL + "/auth", TokenURL: fake.URL + "/token", AuthStyle: oauth2.AuthStyleInParams}
+	youtubeTokenPath, youtubeQuotaPath, youtubeLogin = filepath.Join(t.TempDir(), "youtube-token.json"), "", nil
+	t.Cleanup(func() {
+		fake.Close()
+		youtubeAPIURL, youtubeConfig.Endpoint, youtubeTokenPath, youtubeQuotaPath, youtubeDailyQuota = oldAPI, oldEndpoint, oldToken, oldQuotaPath, oldQuota
+		youtubeLogin = nil
+	})
+	return fake
+}
+
+func TestYouTubeLoginStartsTheSessionAndPrefersTopicUploads(t *testing.T) {
+	env := newTestEnv(t)
+	fake := useYouTube(t)
+	fake.addVideo("lyrics", "A - One (Lyrics)", "Lyric Videos Daily")
+	fake.addVideo("official", "One", "A - Topic")
+	fake.addVideo("live", "One (Live)", "A - Topic")
+	fake.addVideo("fan", "B - Two [Official Video]", "B Official")
+	enabledSinks = "youtube"
+	env.station.play(song("A - One", "track1"), song("B - Two", "track2"), song("C - Three", "track3"))
+
+	rec := httptest.NewRecorder()
+	loginHandler(rec, httptest.NewRequest("GET", "/", nil))
+	if location := rec.Header().Get("Location"); location != "/youtube/login" {
+		t.Fatalf("login sent the browser to %q first", location)
+	}
+	rec = httptest.NewRecorder()
+	youtubeLoginHandler(rec, httptest.NewRequest("GET", "/youtube/login", nil))
+	authURL, _ := url.Parse(rec.Header().Get("Location"))
+	if authURL.Query().Get("access_type") != "offline" {
+		t.Errorf("didn't ask for a refresh token: %s", authURL)
+	}
+
+	rec = httptest.NewRecorder()
+	youtubeCallbackHandler(rec, httptest.NewRequest("GET", "/youtube/callback?code=c&state="+authURL.Query().Get("state"), nil))
+	if location := rec.Header().Get("Location"); location != "/run" {
+		t.Fatalf("callback sent the browser to %q", location)
+	}
+	if needsYouTubeLogin() {
+		t.Errorf("still wants a YouTube login")
+	}
+
+	playlistsByTitle(t, "A - One", "B - Two", "C - Three")
+	waitFor(t, "both videos", func() bool {
+		return sameTracks(fake.playlist("SONiC On Demand"), []string{"official", "fan"})
+	})
+	if misses := sinksByName["youtube"].(*youtubeSink).Misses(); len(misses) != 1 || misses[0].Title != "Three" {
+		t.Errorf("reported misses %+v", misses)
+	}
+}
+
+func TestYouTubeQuotaStopsBeforeRunningOut(t *testing.T) {
+	oldClock, oldQuota, oldPath := clock, youtubeDailyQuota, youtubeQuotaPath
+	defer func() { clock, youtubeDailyQuota, youtubeQuotaPath = oldClock, oldQuota, oldPath }()
+	// 11pm Pacific
+	at := newFixedClock(time.Date(2021, 7, 2, 6, 0, 0, 0, time.UTC))
+	clock, youtubeDailyQuota, youtubeQuotaPath = at, 250, filepath.Join(t.TempDir(), "quota.json")
+
+	quota, _ := loadYouTubeQuota()
+	for i := 0; i < 2; i++ {
+		if err := quota.spend(youtubeSearchCost); err != nil {
+			t.Fatalf("search %d: %v", i, err)
+		}
+	}
+	err := quota.spend(youtubeSearchCost)
+	apiErr, ok := err.(*apiError)
+	if !ok || !retryable(err) || apiErr.RetryAfter != time.Hour {
+		t.Fatalf("third search gave %v, want a retry in an hour", err)
+	}
+	if err := quota.spend(youtubeWriteCost); err != nil {
+		t.Errorf("an insert that fits was refused: %v", err)
+	}
+
+	// a restart remembers, midnight forgets
+	reloaded, _ := loadYouTubeQuota()
+	if left := reloaded.remaining(); left != 0 {
+		t.Errorf("%d units left after a restart, want 0", left)
+	}
+	at.set(at.Now().Add(time.Hour))
+	if err := reloaded.spend(youtubeSearchCost); err != nil {
+		t.Errorf("quota didn't reset at midnight Pacific: %v", err)
+	}
+}
+
+func TestYouTubeSinkWaitsForQuotaInsteadOfDropping(t *testing.T) {
+	env := newTestEnv(t)
+	fake := useYouTube(t)
+	fake.addVideo("v1", "One", "A - Topic")
+	fake.addVideo("v2", "Two", "B - Topic")
+	enabledSinks = "youtube"
+	youtubeLogin = &oauth2.Token{AccessToken: "yt-token", TokenType: "Bearer", Expiry: time.Now().Add(time.Hour)}
+	// looking for the playlist, making it, reading it back, one search and
+	// one insert
+	youtubeDailyQuota = 1 + 50 + 1 + 100 + 50
+	env.station.play(song("A - One", "track1"), song("B - Two", "track2"))
+
+	if err := startSession(nil); err != nil {
+		t.Fatal(err)
+	}
+	startTasks(nil)
+
+	waitFor(t, "the first video", func() bool { return sameTracks(fake.playlist("SONiC On Demand"), []string{"v1"}) })
+	playlistsByTitle(t, "B - Two")
+	time.Sleep(50 * time.Millisecond)
+	if n := fake.count("GET /v3/search"); n != 1 {
+		t.Errorf("searched %d times with quota for 1", n)
+	}
+	if n := outboxLen(); n != 1 {
+		t.Errorf("%d song(s) queued, want B - Two kept for tomorrow", n)
+	}
+}